@@ -0,0 +1,136 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// recon-dryrun reports the differences between a local prefix tree and a
+// remote recon peer, without recovering anything.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+	"gopkg.in/hockeypuck/conflux.v2/recon/leveldb"
+)
+
+var (
+	configFile = flag.String("config", "", "recon settings file (TOML)")
+	timeout    = flag.Duration("timeout", 5*time.Minute, "session timeout")
+	elements   = flag.Bool("elements", false, "list differing elements")
+)
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: recon-dryrun [flags] <leveldb path> <partner recon addr>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	settings := recon.DefaultSettings()
+	if *configFile != "" {
+		var err error
+		settings, err = recon.LoadSettings(*configFile)
+		if err != nil {
+			die(err)
+		}
+	}
+	addr, err := net.ResolveTCPAddr("tcp", flag.Arg(1))
+	if err != nil {
+		die(err)
+	}
+
+	ptree, err := leveldb.New(settings.PTreeConfig, flag.Arg(0))
+	if err != nil {
+		die(err)
+	}
+	err = ptree.Create()
+	if err != nil {
+		die(err)
+	}
+	defer ptree.Close()
+
+	peer := recon.NewPeer(settings, ptree)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	result, err := peer.DryRun(ctx, addr)
+	if err != nil {
+		die(err)
+	}
+
+	type prefixDiff struct {
+		Prefix      string
+		LocalNeeds  int
+		RemoteNeeds int
+	}
+	render := struct {
+		RemoteAddr  string
+		LocalNeeds  int
+		RemoteNeeds int
+		Prefixes    []prefixDiff
+		Elements    *struct {
+			LocalNeeds  []string
+			RemoteNeeds []string
+		} `json:",omitempty"`
+	}{
+		RemoteAddr:  result.RemoteAddr.String(),
+		LocalNeeds:  len(result.LocalNeeds),
+		RemoteNeeds: len(result.RemoteNeeds),
+	}
+	for _, diff := range result.Prefixes {
+		render.Prefixes = append(render.Prefixes, prefixDiff{
+			Prefix:      diff.Prefix.String(),
+			LocalNeeds:  diff.LocalNeeds,
+			RemoteNeeds: diff.RemoteNeeds,
+		})
+	}
+	if *elements {
+		render.Elements = &struct {
+			LocalNeeds  []string
+			RemoteNeeds []string
+		}{}
+		for _, z := range result.LocalNeeds {
+			render.Elements.LocalNeeds = append(render.Elements.LocalNeeds, fmt.Sprintf("%x", z.Bytes()))
+		}
+		for _, z := range result.RemoteNeeds {
+			render.Elements.RemoteNeeds = append(render.Elements.RemoteNeeds, fmt.Sprintf("%x", z.Bytes()))
+		}
+	}
+	out, err := json.MarshalIndent(render, "", "\t")
+	if err != nil {
+		die(err)
+	}
+	os.Stdout.Write(out)
+	os.Stdout.Write([]byte("\n"))
+}
@@ -0,0 +1,163 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// recon-replay replays a recorded recon session transcript against a local
+// prefix tree, and reports where the local peer's behaviour diverges from
+// the recording.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+	"gopkg.in/hockeypuck/conflux.v2/recon/leveldb"
+)
+
+var (
+	configFile = flag.String("config", "", "recon settings file (TOML)")
+	timeout    = flag.Duration("timeout", 5*time.Minute, "replay timeout")
+	messages   = flag.Bool("messages", false, "list the recorded messages")
+)
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+type message struct {
+	Time   time.Time
+	Offset int
+	Msg    string
+}
+
+func listMessages(t *recon.Transcript, sent bool) []message {
+	msgs, err := t.Messages(sent)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	var result []message
+	for i := range msgs {
+		result = append(result, message{Time: msgs[i].Time, Offset: msgs[i].Offset, Msg: msgs[i].String()})
+	}
+	return result
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: recon-replay [flags] <leveldb path> <transcript file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	settings := recon.DefaultSettings()
+	if *configFile != "" {
+		var err error
+		settings, err = recon.LoadSettings(*configFile)
+		if err != nil {
+			die(err)
+		}
+	}
+	// Don't record a transcript of the replay.
+	settings.TranscriptDir = ""
+
+	f, err := os.Open(flag.Arg(1))
+	if err != nil {
+		die(err)
+	}
+	transcript, err := recon.ReadTranscript(f)
+	f.Close()
+	if err != nil {
+		die(err)
+	}
+
+	ptree, err := leveldb.New(settings.PTreeConfig, flag.Arg(0))
+	if err != nil {
+		die(err)
+	}
+	err = ptree.Create()
+	if err != nil {
+		die(err)
+	}
+	defer ptree.Close()
+
+	peer := recon.NewPeer(settings, ptree)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	result, err := peer.Replay(ctx, transcript)
+	if err != nil {
+		die(err)
+	}
+
+	render := struct {
+		Role          string
+		RemoteAddr    string
+		Start         time.Time
+		RecordedError string        `json:",omitempty"`
+		RemoteConfig  *recon.Config `json:",omitempty"`
+		Diverged      bool
+		Offset        int       `json:",omitempty"`
+		Index         int       `json:",omitempty"`
+		Expected      string    `json:",omitempty"`
+		Actual        string    `json:",omitempty"`
+		Error         string    `json:",omitempty"`
+		Sent          []message `json:",omitempty"`
+		Received      []message `json:",omitempty"`
+	}{
+		Role:          result.Role,
+		RemoteAddr:    result.RemoteAddr,
+		Start:         transcript.Start,
+		RecordedError: transcript.Error,
+		RemoteConfig:  result.RemoteConfig,
+		Diverged:      result.Diverged,
+	}
+	if result.Diverged {
+		render.Offset = result.Offset
+		render.Index = result.Index
+		render.Expected = result.Expected
+		render.Actual = result.Actual
+	}
+	if result.Err != nil {
+		render.Error = result.Err.Error()
+	}
+	if *messages {
+		render.Sent = listMessages(transcript, true)
+		render.Received = listMessages(transcript, false)
+	}
+	out, err := json.MarshalIndent(render, "", "\t")
+	if err != nil {
+		die(err)
+	}
+	os.Stdout.Write(out)
+	os.Stdout.Write([]byte("\n"))
+	if result.Diverged {
+		ptree.Close()
+		os.Exit(2)
+	}
+}
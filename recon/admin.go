@@ -0,0 +1,319 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// maxRecentSessions is the number of session results kept for status
+// reporting.
+const maxRecentSessions = 20
+
+// statusTracker tracks how a peer was started, its active sessions and the
+// results of recent sessions, for status reporting.
+type statusTracker struct {
+	mu      sync.Mutex
+	mode    PeerMode
+	started time.Time
+	active  map[*session]struct{}
+	recent  []SessionResult
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{active: make(map[*session]struct{})}
+}
+
+func (t *statusTracker) start(mode PeerMode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mode = mode
+	t.started = time.Now()
+}
+
+func (t *statusTracker) sessionStarted(s *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active[s] = struct{}{}
+}
+
+func (t *statusTracker) sessionEnded(s *session, stats *SessionStats) {
+	result := SessionResult{
+		Role:              s.Role,
+		Start:             s.Start,
+		DurationSecs:      stats.Duration.Seconds(),
+		BytesSent:         stats.BytesSent,
+		BytesReceived:     stats.BytesReceived,
+		ElementsRecovered: stats.ElementsRecovered,
+		Outcome:           sessionOutcome(stats.Err),
+	}
+	if s.RemoteAddr != nil {
+		result.RemoteAddr = s.RemoteAddr.String()
+	}
+	if stats.Err != nil {
+		result.Error = stats.Err.Error()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.active, s)
+	if len(t.recent) == maxRecentSessions {
+		t.recent = append(t.recent[:0], t.recent[1:]...)
+	}
+	t.recent = append(t.recent, result)
+}
+
+// PeerStatus is a snapshot of the state of a peer.
+type PeerStatus struct {
+	// Mode is the mode the peer was started in, empty if not started.
+	Mode    string     `json:"mode"`
+	Started *time.Time `json:"started,omitempty"`
+	Stopped bool       `json:"stopped"`
+
+	// Mutating is set while queued mutations are flushed into the prefix
+	// tree, during which recon sessions are refused.
+	Mutating bool `json:"mutating"`
+
+	// RecoverQueueFull is set while recovered elements await
+	// acknowledgement, during which recon sessions are refused.
+	RecoverQueueFull bool `json:"recoverQueueFull"`
+
+	PendingInserts int `json:"pendingInserts"`
+	PendingRemoves int `json:"pendingRemoves"`
+
+	// RootSize is the number of elements in the prefix tree. It is omitted
+	// while mutating.
+	RootSize *int `json:"rootSize,omitempty"`
+
+	Dataset    string  `json:"dataset,omitempty"`
+	ReconAddr  string  `json:"reconAddr"`
+	ThreshMult int     `json:"threshMult"`
+	Config     *Config `json:"config"`
+
+	Sessions       []ActiveSession `json:"sessions"`
+	Partners       []PartnerHealth `json:"partners"`
+	RecentSessions []SessionResult `json:"recentSessions"`
+}
+
+// ActiveSession describes a recon session in progress.
+type ActiveSession struct {
+	Role          string    `json:"role"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	RemoteVersion string    `json:"remoteVersion,omitempty"`
+	Start         time.Time `json:"start"`
+	DurationSecs  float64   `json:"durationSecs"`
+	BytesSent     int64     `json:"bytesSent"`
+	BytesReceived int64     `json:"bytesReceived"`
+}
+
+// SessionResult describes a completed recon session.
+type SessionResult struct {
+	Role              string    `json:"role"`
+	RemoteAddr        string    `json:"remoteAddr"`
+	Start             time.Time `json:"start"`
+	DurationSecs      float64   `json:"durationSecs"`
+	BytesSent         int64     `json:"bytesSent"`
+	BytesReceived     int64     `json:"bytesReceived"`
+	ElementsRecovered int       `json:"elementsRecovered"`
+	Outcome           string    `json:"outcome"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// PartnerHealth is the JSON form of a PartnerStatus.
+type PartnerHealth struct {
+	Addr                string     `json:"addr"`
+	Sessions            int        `json:"sessions"`
+	LastAttempt         *time.Time `json:"lastAttempt,omitempty"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	BackoffUntil        *time.Time `json:"backoffUntil,omitempty"`
+	RTTSecs             float64    `json:"rttSecs"`
+	ElementsRecovered   int        `json:"elementsRecovered"`
+	Weight              float64    `json:"weight"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Status returns a snapshot of the state of the peer.
+func (p *Peer) Status() (*PeerStatus, error) {
+	settings := p.getSettings()
+	config, err := p.config(settings)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	status := &PeerStatus{
+		Stopped:          p.isDying(),
+		RecoverQueueFull: p.recoverQ.full(),
+		Dataset:          settings.Dataset,
+		ReconAddr:        settings.ReconAddr,
+		ThreshMult:       settings.ThreshMult,
+		Config:           config,
+		Sessions:         []ActiveSession{},
+		Partners:         []PartnerHealth{},
+	}
+
+	p.muElements.Lock()
+	status.PendingInserts = len(p.insertElements)
+	status.PendingRemoves = len(p.removeElements)
+	p.muElements.Unlock()
+
+	size, err := p.rootSize()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	status.RootSize = size
+	status.Mutating = size == nil
+
+	partners, err := p.PartnerStatus()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, ps := range partners {
+		status.Partners = append(status.Partners, PartnerHealth{
+			Addr:                ps.Addr.String(),
+			Sessions:            ps.Sessions,
+			LastAttempt:         optionalTime(ps.LastAttempt),
+			LastSuccess:         optionalTime(ps.LastSuccess),
+			LastError:           ps.LastError,
+			ConsecutiveFailures: ps.ConsecutiveFailures,
+			BackoffUntil:        optionalTime(ps.BackoffUntil),
+			RTTSecs:             ps.RTT.Seconds(),
+			ElementsRecovered:   ps.ElementsRecovered,
+			Weight:              ps.Weight,
+		})
+	}
+
+	t := p.status
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.started.IsZero() {
+		status.Mode = string(t.mode)
+		if t.mode == PeerModeDefault {
+			status.Mode = "default"
+		}
+		status.Started = optionalTime(t.started)
+	}
+	for s := range t.active {
+		active := ActiveSession{
+			Role:          s.Role,
+			RemoteAddr:    s.RemoteAddr.String(),
+			Start:         s.Start,
+			DurationSecs:  time.Since(s.Start).Seconds(),
+			BytesSent:     atomic.LoadInt64(&s.conn.sent),
+			BytesReceived: atomic.LoadInt64(&s.conn.received),
+		}
+		if s.RemoteConfig != nil {
+			active.RemoteVersion = s.RemoteConfig.Version
+		}
+		status.Sessions = append(status.Sessions, active)
+	}
+	sort.Slice(status.Sessions, func(i, j int) bool {
+		return status.Sessions[i].Start.Before(status.Sessions[j].Start)
+	})
+	status.RecentSessions = append([]SessionResult{}, t.recent...)
+	return status, nil
+}
+
+// rootSize returns the number of elements in the prefix tree, or nil if the
+// tree is being mutated.
+func (p *Peer) rootSize() (*int, error) {
+	// Holding the lock prevents a mutation from starting.
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.mutating {
+		return nil, nil
+	}
+	root, err := p.ptree.Root()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	size := root.Size()
+	return &size, nil
+}
+
+// NewAdminHandler returns an http.Handler reporting the state of p, for
+// monitoring and orchestration. It serves:
+//
+//	/status   the PeerStatus, as JSON
+//	/healthz  200 unless the peer has stopped
+//	/readyz   200 once the peer has started, while its prefix tree is readable
+func NewAdminHandler(p *Peer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", p.serveStatus)
+	mux.HandleFunc("/healthz", p.serveHealth)
+	mux.HandleFunc("/readyz", p.serveReady)
+	return mux
+}
+
+func (p *Peer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := p.Status()
+	if err != nil {
+		p.logErr(SERVE, err).Error("cannot report status")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
+
+func (p *Peer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if p.isDying() {
+		http.Error(w, "stopped", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (p *Peer) serveReady(w http.ResponseWriter, r *http.Request) {
+	p.status.mu.Lock()
+	started := !p.status.started.IsZero()
+	p.status.mu.Unlock()
+	if !started {
+		http.Error(w, "not started", http.StatusServiceUnavailable)
+		return
+	}
+	if p.isDying() {
+		http.Error(w, "stopped", http.StatusServiceUnavailable)
+		return
+	}
+	_, err := p.rootSize()
+	if err != nil {
+		http.Error(w, "prefix tree unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,133 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	gc "gopkg.in/check.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type AdminSuite struct{}
+
+var _ = gc.Suite(&AdminSuite{})
+
+func adminGet(c *gc.C, h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func (s *AdminSuite) TestStatus(c *gc.C) {
+	server := newTestPeer(c, cf.Zi(cf.P_SKS, 65537), cf.Zi(cf.P_SKS, 65539))
+	defer server.Stop()
+	client := newTestPeer(c, cf.Zi(cf.P_SKS, 65537))
+	defer client.Stop()
+	h := NewAdminHandler(client)
+
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+	<-client.RecoverChan
+	client.Insert(cf.Zi(cf.P_SKS, 65541))
+
+	rec := adminGet(c, h, "/status")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+	var status PeerStatus
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &status), gc.IsNil)
+	c.Assert(status.Mode, gc.Equals, "")
+	c.Assert(status.Stopped, gc.Equals, false)
+	c.Assert(status.PendingInserts, gc.Equals, 1)
+	c.Assert(status.RootSize, gc.NotNil)
+	c.Assert(*status.RootSize, gc.Equals, 1)
+	c.Assert(status.Config.BitQuantum, gc.Equals, client.settings.BitQuantum)
+	c.Assert(status.Sessions, gc.HasLen, 0)
+	c.Assert(status.RecentSessions, gc.HasLen, 1)
+	result := status.RecentSessions[0]
+	c.Assert(result.Role, gc.Equals, GOSSIP)
+	c.Assert(result.Outcome, gc.Equals, OutcomeSuccess)
+	c.Assert(result.BytesSent > 0, gc.Equals, true)
+	c.Assert(status.Partners, gc.HasLen, 0)
+}
+
+func (s *AdminSuite) TestActiveSession(c *gc.C) {
+	p := newTestPeer(c)
+	defer p.Stop()
+	conn, _ := net.Pipe()
+	sess, _ := p.newSession(SERVE, conn)
+	sess.RemoteConfig = &Config{Version: "1.1.6"}
+	p.startSession(sess)
+
+	status, err := p.Status()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status.Sessions, gc.HasLen, 1)
+	c.Assert(status.Sessions[0].Role, gc.Equals, SERVE)
+	c.Assert(status.Sessions[0].RemoteVersion, gc.Equals, "1.1.6")
+
+	p.endSession(sess, ErrPeerBusy)
+	status, err = p.Status()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status.Sessions, gc.HasLen, 0)
+	c.Assert(status.RecentSessions, gc.HasLen, 1)
+	c.Assert(status.RecentSessions[0].Outcome, gc.Equals, OutcomeBusy)
+	c.Assert(status.RecentSessions[0].Error, gc.Equals, ErrPeerBusy.Error())
+
+	for i := 0; i < maxRecentSessions+5; i++ {
+		sess, _ := p.newSession(GOSSIP, conn)
+		p.endSession(sess, nil)
+	}
+	status, err = p.Status()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status.RecentSessions, gc.HasLen, maxRecentSessions)
+	c.Assert(status.RecentSessions[0].Role, gc.Equals, GOSSIP)
+}
+
+func (s *AdminSuite) TestProbes(c *gc.C) {
+	p := newTestPeer(c)
+	p.SetListener(newPipeNetwork())
+	h := NewAdminHandler(p)
+
+	c.Assert(adminGet(c, h, "/healthz").Code, gc.Equals, http.StatusOK)
+	rec := adminGet(c, h, "/readyz")
+	c.Assert(rec.Code, gc.Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Body.String(), gc.Equals, "not started\n")
+
+	p.StartMode(PeerModeServeOnly)
+	c.Assert(adminGet(c, h, "/readyz").Code, gc.Equals, http.StatusOK)
+	status, err := p.Status()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status.Mode, gc.Equals, string(PeerModeServeOnly))
+	c.Assert(status.Started, gc.NotNil)
+
+	p.Stop()
+	c.Assert(adminGet(c, h, "/healthz").Code, gc.Equals, http.StatusServiceUnavailable)
+	c.Assert(adminGet(c, h, "/readyz").Code, gc.Equals, http.StatusServiceUnavailable)
+	status, err = p.Status()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status.Stopped, gc.Equals, true)
+}
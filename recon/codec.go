@@ -0,0 +1,274 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+// DecodeError describes a malformed message received from a remote peer.
+type DecodeError struct {
+	// MsgType is the type of the malformed message, or msgTypeUnknown if
+	// it could not be determined.
+	MsgType MsgType
+
+	// Reason describes what is wrong with the message.
+	Reason string
+}
+
+// msgTypeUnknown is the MsgType of a DecodeError for a message of unknown
+// type.
+const msgTypeUnknown = MsgType(0xff)
+
+func decodeErrorf(format string, args ...interface{}) *DecodeError {
+	return &DecodeError{MsgType: msgTypeUnknown, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Error implements error.
+func (e *DecodeError) Error() string {
+	if e.MsgType == msgTypeUnknown {
+		return "malformed message: " + e.Reason
+	}
+	return fmt.Sprintf("malformed %v message: %s", e.MsgType, e.Reason)
+}
+
+// maxMsgElements is the maximum number of elements in a message, allowing
+// for a full recover set and the elements of a node.
+const maxMsgElements = 2 * maxRecoverSize
+
+// msgLimits validates messages from a remote peer against the negotiated
+// config.
+type msgLimits struct {
+	bitQuantum    int
+	numSamples    int
+	maxPrefixBits int
+	maxElements   int
+}
+
+func newMsgLimits(config *PTreeConfig) *msgLimits {
+	return &msgLimits{
+		bitQuantum:    config.BitQuantum,
+		numSamples:    config.NumSamples(),
+		maxPrefixBits: cf.P_SKS.BitLen(),
+		maxElements:   maxMsgElements,
+	}
+}
+
+func (l *msgLimits) checkPrefix(prefix *cf.Bitstring) *DecodeError {
+	if prefix.BitLen() > l.maxPrefixBits {
+		return decodeErrorf("prefix length %d exceeds tree depth %d", prefix.BitLen(), l.maxPrefixBits)
+	}
+	if l.bitQuantum > 0 && prefix.BitLen()%l.bitQuantum != 0 {
+		return decodeErrorf("prefix length %d is not a multiple of bitquantum %d", prefix.BitLen(), l.bitQuantum)
+	}
+	return nil
+}
+
+func (l *msgLimits) checkElements(n int) *DecodeError {
+	if n > l.maxElements {
+		return decodeErrorf("%d elements exceeds maximum %d", n, l.maxElements)
+	}
+	return nil
+}
+
+// check returns a DecodeError if msg is not valid under the limits.
+func (l *msgLimits) check(msg ReconMsg) error {
+	var err *DecodeError
+	switch m := msg.(type) {
+	case *ReconRqstPoly:
+		err = l.checkPrefix(m.Prefix)
+		if err == nil && len(m.Samples) != l.numSamples {
+			err = decodeErrorf("%d samples, expected %d", len(m.Samples), l.numSamples)
+		}
+	case *ReconRqstFull:
+		err = l.checkPrefix(m.Prefix)
+		if err == nil {
+			err = l.checkElements(m.Elements.Len())
+		}
+	case *Elements:
+		err = l.checkElements(m.Len())
+	case *FullElements:
+		err = l.checkElements(m.Len())
+	case *DbRqst:
+		err = l.checkElements(len(m.Elements))
+	case *DbRepl:
+		err = l.checkElements(len(m.Records))
+	}
+	if err != nil {
+		err.MsgType = msg.MsgType()
+		return err
+	}
+	return nil
+}
+
+// Message types from MsgTypeCustomMin to MsgTypeCustomMax are reserved for
+// applications, and may be registered with RegisterMsgType.
+const (
+	MsgTypeCustomMin = MsgType(128)
+	MsgTypeCustomMax = MsgType(254)
+)
+
+// ErrMsgTypeRegistered is returned when registering a message type which is
+// already registered.
+var ErrMsgTypeRegistered error = errors.New("message type already registered")
+
+var (
+	msgFactoriesMu sync.RWMutex
+	msgFactories   = map[MsgType]func() ReconMsg{
+		MsgTypeReconRqstPoly: func() ReconMsg { return &ReconRqstPoly{} },
+		MsgTypeReconRqstFull: func() ReconMsg { return &ReconRqstFull{} },
+		MsgTypeElements:      func() ReconMsg { return &Elements{} },
+		MsgTypeFullElements:  func() ReconMsg { return &FullElements{} },
+		MsgTypeSyncFail:      func() ReconMsg { return &SyncFail{} },
+		MsgTypeDone:          func() ReconMsg { return &Done{} },
+		MsgTypeFlush:         func() ReconMsg { return &Flush{} },
+		MsgTypeError:         func() ReconMsg { return &Error{textMsg: &textMsg{}} },
+		MsgTypeDbRqst:        func() ReconMsg { return &DbRqst{} },
+		MsgTypeDbRepl:        func() ReconMsg { return &DbRepl{} },
+		MsgTypeConfig:        func() ReconMsg { return &Config{} },
+		MsgTypeMembership:    func() ReconMsg { return &Membership{} },
+	}
+)
+
+// RegisterMsgType registers a factory for decoding messages of an
+// application-defined type. The code must be in the reserved range
+// MsgTypeCustomMin to MsgTypeCustomMax, and the messages returned by factory
+// must report it as their MsgType.
+func RegisterMsgType(code MsgType, factory func() ReconMsg) error {
+	if code < MsgTypeCustomMin || code > MsgTypeCustomMax {
+		return errgo.Newf("message type %d outside reserved range %d-%d",
+			code, MsgTypeCustomMin, MsgTypeCustomMax)
+	}
+	if factory == nil {
+		return errgo.New("nil message factory")
+	}
+	msgFactoriesMu.Lock()
+	defer msgFactoriesMu.Unlock()
+	if _, ok := msgFactories[code]; ok {
+		return errgo.WithCausef(nil, ErrMsgTypeRegistered, "message type %d", code)
+	}
+	msgFactories[code] = factory
+	return nil
+}
+
+// newMsg returns a new message of type mt, or nil if the type is unknown.
+func newMsg(mt MsgType) ReconMsg {
+	msgFactoriesMu.RLock()
+	factory, ok := msgFactories[mt]
+	msgFactoriesMu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return factory()
+}
+
+func isCustomMsgType(mt MsgType) bool {
+	if mt < MsgTypeCustomMin || mt > MsgTypeCustomMax {
+		return false
+	}
+	msgFactoriesMu.RLock()
+	defer msgFactoriesMu.RUnlock()
+	_, ok := msgFactories[mt]
+	return ok
+}
+
+// maxPooledBuffer is the largest buffer returned to the pool, so that an
+// occasional large message doesn't pin its memory.
+const maxPooledBuffer = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// Encoder writes framed messages to an io.Writer.
+type Encoder struct {
+	w io.Writer
+	n int64
+}
+
+// NewEncoder returns an Encoder writing to w. Each message is written to w
+// in a single call, so w should be buffered when writing many small
+// messages.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes msg.
+func (e *Encoder) Encode(msg ReconMsg) error {
+	n, err := writeMsgSize(e.w, msg)
+	e.n += int64(n)
+	return err
+}
+
+// BytesWritten returns the number of bytes of messages written.
+func (e *Encoder) BytesWritten() int64 {
+	return e.n
+}
+
+// Decoder reads framed messages from an io.Reader. Malformed messages are
+// reported as a *DecodeError.
+type Decoder struct {
+	r io.Reader
+	n int64
+}
+
+// NewDecoder returns a Decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next message. It returns io.EOF if the input ends
+// between messages.
+func (d *Decoder) Decode() (ReconMsg, error) {
+	msg, n, err := readMsgSize(d.r)
+	d.n += int64(n)
+	if err != nil && errgo.Cause(err) == io.EOF {
+		return nil, io.EOF
+	}
+	return msg, err
+}
+
+// BytesRead returns the number of bytes of messages read, including those
+// which failed to decode.
+func (d *Decoder) BytesRead() int64 {
+	return d.n
+}
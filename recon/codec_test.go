@@ -0,0 +1,256 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type CodecSuite struct{}
+
+var _ = gc.Suite(&CodecSuite{})
+
+func encodeMsg(msg ReconMsg) []byte {
+	var buf bytes.Buffer
+	err := WriteMsgDirect(&buf, msg)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// rawMsg frames body as a message of type mt.
+func rawMsg(mt MsgType, body ...[]byte) []byte {
+	var buf bytes.Buffer
+	joined := bytes.Join(body, nil)
+	binary.Write(&buf, binary.BigEndian, uint32(len(joined)+1))
+	buf.WriteByte(byte(mt))
+	buf.Write(joined)
+	return buf.Bytes()
+}
+
+func u32(n int) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(n))
+	return buf
+}
+
+func (s *CodecSuite) TestMalformed(c *gc.C) {
+	tooBig := make([]byte, SksZpNbytes)
+	for i := range tooBig {
+		tooBig[i] = 0xff
+	}
+	for i, tc := range []struct {
+		data    []byte
+		msgType MsgType
+		err     string
+	}{
+		{rawMsg(MsgTypeReconRqstFull, u32(8), u32(2), []byte{0, 0}, u32(0)),
+			MsgTypeReconRqstFull, "malformed ReconRqstFull message: bitstring of 8 bits has 2 bytes"},
+		{rawMsg(MsgTypeElements, u32(1<<20)),
+			MsgTypeElements, "malformed Elements message: count 1048576 exceeds remaining 0 bytes"},
+		{rawMsg(MsgTypeElements, u32(1), tooBig),
+			MsgTypeElements, "malformed Elements message: element ff+ out of range"},
+		{rawMsg(MsgTypeDone, []byte{0}),
+			MsgTypeDone, "malformed Done message: 1 trailing bytes"},
+		{rawMsg(MsgTypeError, u32(10), []byte("short")),
+			MsgTypeError, "malformed Error message: length 10 exceeds remaining 5 bytes"},
+		{rawMsg(MsgTypeDbRqst, u32(1), []byte{1, 2, 3}),
+			MsgTypeDbRqst, "malformed DbRqst message: count 1 exceeds remaining 3 bytes"},
+		{rawMsg(MsgTypeConfig, u32(1), u32(4), []byte("mbar"), u32(2), []byte{0, 5}),
+			MsgTypeConfig, `malformed Config message: invalid length 2 for integer config value "mbar"`},
+		{rawMsg(MsgTypeMembership, []byte{0, 0, 0}),
+			MsgTypeMembership, "malformed Membership message: truncated"},
+		{rawMsg(MsgType(100)),
+			msgTypeUnknown, "malformed message: unexpected message type 100"},
+		{u32(0),
+			msgTypeUnknown, "malformed message: empty message"},
+	} {
+		_, err := ReadMsg(bytes.NewReader(tc.data))
+		c.Assert(err, gc.ErrorMatches, tc.err, gc.Commentf("case %d", i))
+		decodeErr, ok := err.(*DecodeError)
+		c.Assert(ok, gc.Equals, true, gc.Commentf("case %d", i))
+		c.Assert(decodeErr.MsgType, gc.Equals, tc.msgType, gc.Commentf("case %d", i))
+	}
+}
+
+// lenHider hides the Len method of a reader, as a connection would.
+type lenHider struct {
+	io.Reader
+}
+
+func (s *CodecSuite) TestDeclaredLength(c *gc.C) {
+	// A large declared length is not allocated before the data arrives.
+	data := append(u32(maxReadLen), byte(MsgTypeDone))
+	_, err := ReadMsg(lenHider{bytes.NewReader(data)})
+	c.Assert(err, gc.Equals, io.ErrUnexpectedEOF)
+
+	_, err = ReadMsg(lenHider{bytes.NewReader(u32(maxReadLen + 1))})
+	c.Assert(err, gc.ErrorMatches, "malformed message: read length .* exceeds maximum limit")
+}
+
+func (s *CodecSuite) TestLimits(c *gc.C) {
+	config := defaultPTreeConfig
+	limits := newMsgLimits(&config)
+	bs := func(bits int) *cf.Bitstring { return cf.NewBitstring(bits) }
+	for i, tc := range []struct {
+		msg ReconMsg
+		err string
+	}{
+		{&ReconRqstPoly{Prefix: bs(4), Samples: testSamples(config.NumSamples())}, ""},
+		{&ReconRqstPoly{Prefix: bs(4), Samples: testSamples(2)},
+			"malformed ReconRqstPoly message: 2 samples, expected 6"},
+		{&ReconRqstPoly{Prefix: bs(3), Samples: testSamples(config.NumSamples())},
+			"malformed ReconRqstPoly message: prefix length 3 is not a multiple of bitquantum 2"},
+		{&ReconRqstFull{Prefix: bs(130), Elements: cf.NewZSet()},
+			"malformed ReconRqstFull message: prefix length 130 exceeds tree depth 129"},
+		{&Elements{ZSet: cf.NewZSet(testSamples(maxMsgElements + 1)...)},
+			"malformed Elements message: 30001 elements exceeds maximum 30000"},
+		{&DbRqst{Elements: testSamples(10)}, ""},
+	} {
+		// Messages are validated after decoding.
+		msg, err := ReadMsg(bytes.NewReader(encodeMsg(tc.msg)))
+		c.Assert(err, gc.IsNil)
+		err = limits.check(msg)
+		if tc.err == "" {
+			c.Check(err, gc.IsNil, gc.Commentf("case %d", i))
+		} else {
+			c.Check(err, gc.ErrorMatches, tc.err, gc.Commentf("case %d", i))
+		}
+	}
+}
+
+func (s *CodecSuite) TestEncoderDecoder(c *gc.C) {
+	msgs := []ReconMsg{
+		&ReconRqstFull{Prefix: cf.NewBitstring(2), Elements: cf.NewZSet(testSamples(3)...)},
+		&Elements{ZSet: cf.NewZSet(testSamples(2)...)},
+		&DbRqst{Elements: testSamples(2)},
+		&Done{},
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, msg := range msgs {
+		c.Assert(enc.Encode(msg), gc.IsNil)
+	}
+	c.Assert(enc.BytesWritten(), gc.Equals, int64(buf.Len()))
+
+	dec := NewDecoder(&buf)
+	for _, msg := range msgs {
+		msg2, err := dec.Decode()
+		c.Assert(err, gc.IsNil)
+		c.Check(msg2, gc.DeepEquals, msg)
+	}
+	c.Assert(dec.BytesRead(), gc.Equals, enc.BytesWritten())
+	_, err := dec.Decode()
+	c.Assert(err, gc.Equals, io.EOF)
+}
+
+const testMsgTypePing = MsgType(200)
+
+// pingMsg is an application-defined message.
+type pingMsg struct{ Seq uint32 }
+
+func (msg *pingMsg) MsgType() MsgType { return testMsgTypePing }
+
+func (msg *pingMsg) Unmarshal(r io.Reader) error {
+	return binary.Read(r, binary.BigEndian, &msg.Seq)
+}
+
+func (msg *pingMsg) Marshal(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, msg.Seq)
+}
+
+func newPingMsg() ReconMsg { return &pingMsg{} }
+
+func init() {
+	err := RegisterMsgType(testMsgTypePing, newPingMsg)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s *CodecSuite) TestCustomMsgType(c *gc.C) {
+	msg, err := ReadMsg(bytes.NewReader(encodeMsg(&pingMsg{Seq: 42})))
+	c.Assert(err, gc.IsNil)
+	c.Assert(msg, gc.DeepEquals, &pingMsg{Seq: 42})
+	c.Assert(testMsgTypePing.String(), gc.Equals, "Custom(200)")
+
+	_, err = ReadMsg(bytes.NewReader(rawMsg(testMsgTypePing, []byte{1})))
+	c.Assert(err, gc.ErrorMatches, "malformed Custom\\(200\\) message: truncated")
+
+	err = RegisterMsgType(testMsgTypePing, newPingMsg)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrMsgTypeRegistered)
+	err = RegisterMsgType(MsgTypeConfig, newPingMsg)
+	c.Assert(err, gc.ErrorMatches, "message type 10 outside reserved range 128-254")
+	err = RegisterMsgType(msgTypeUnknown, newPingMsg)
+	c.Assert(err, gc.ErrorMatches, "message type 255 outside reserved range 128-254")
+}
+
+func FuzzReadMsg(f *testing.F) {
+	for _, msg := range []ReconMsg{
+		&ReconRqstPoly{Prefix: cf.NewBitstring(6), Size: 3, Samples: testSamples(6)},
+		&ReconRqstFull{Prefix: cf.NewBitstring(2), Elements: cf.NewZSet(testSamples(3)...)},
+		&Elements{ZSet: cf.NewZSet(testSamples(2)...)},
+		&FullElements{ZSet: cf.NewZSet()},
+		&SyncFail{},
+		&Done{},
+		&Flush{},
+		&Error{textMsg: &textMsg{Text: "oops"}, Code: ErrorCodeBusy, RetryAfter: 5 * time.Second},
+		&DbRqst{Elements: testSamples(2)},
+		&DbRepl{Records: []*Record{{Element: cf.Zi(cf.P_SKS, 65537), Content: []byte("content")}}},
+		&Config{Version: "1.1.3", HTTPPort: 11371, BitQuantum: 2, MBar: 5, Filters: "yminsky.dedup",
+			Custom: map[string]string{"dry run": "supported"}},
+		&Membership{Timestamp: 1, Peers: []string{"10.1.2.3:11370"}, MAC: []byte{1, 2, 3}},
+	} {
+		f.Add(encodeMsg(msg))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadMsg(bytes.NewReader(data))
+		if err != nil {
+			// Once a message is framed, only decode errors are returned.
+			framed := len(data) >= 4 && int(binary.BigEndian.Uint32(data)) <= len(data)-4
+			if _, ok := err.(*DecodeError); !ok && framed {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+			return
+		}
+		// A decoded message re-encodes to a canonical form, which decodes
+		// to the same message.
+		encoded := encodeMsg(msg)
+		msg2, err := ReadMsg(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("cannot decode re-encoded %v: %v", msg, err)
+		}
+		if !bytes.Equal(encoded, encodeMsg(msg2)) {
+			t.Fatalf("re-encoding %v is not stable", msg)
+		}
+	})
+}
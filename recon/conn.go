@@ -0,0 +1,243 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Dialer establishes connections to remote recon peers. *net.Dialer satisfies
+// this interface.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Listener creates the network listener on which a Peer accepts recon
+// sessions. *net.ListenConfig satisfies this interface.
+type Listener interface {
+	Listen(ctx context.Context, network, address string) (net.Listener, error)
+}
+
+// Dial timeouts and keepalives are configured in Settings, and applied to
+// each connection.
+var defaultDialer Dialer = &net.Dialer{KeepAlive: -1}
+
+var defaultListener Listener = &net.ListenConfig{KeepAlive: -1}
+
+// SetDialer sets the Dialer used to connect to recon partners. Partner
+// addresses are resolved according to their configured network type, and
+// passed to the Dialer by network name and address string.
+func (p *Peer) SetDialer(d Dialer) {
+	p.muHooks.Lock()
+	defer p.muHooks.Unlock()
+	p.dialer = d
+}
+
+// SetListener sets the Listener used by Serve to accept recon sessions on the
+// configured recon address.
+func (p *Peer) SetListener(l Listener) {
+	p.muHooks.Lock()
+	defer p.muHooks.Unlock()
+	p.listener = l
+}
+
+func (p *Peer) getDialer() Dialer {
+	p.muHooks.RLock()
+	defer p.muHooks.RUnlock()
+	if p.dialer == nil {
+		return defaultDialer
+	}
+	return p.dialer
+}
+
+func (p *Peer) getListener() Listener {
+	p.muHooks.RLock()
+	defer p.muHooks.RUnlock()
+	if p.listener == nil {
+		return defaultListener
+	}
+	return p.listener
+}
+
+// keepAliveConn is implemented by connections supporting TCP keepalives.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// setKeepAlive enables keepalives on conn with period d, or disables them if
+// d is zero.
+func setKeepAlive(conn net.Conn, d time.Duration) {
+	if ac, ok := conn.(*addrConn); ok {
+		conn = ac.Conn
+	}
+	if kaConn, ok := conn.(keepAliveConn); ok {
+		kaConn.SetKeepAlive(d > 0)
+		if d > 0 {
+			kaConn.SetKeepAlivePeriod(d)
+		}
+	}
+}
+
+// remoteIP returns the IP address of a network address, if it has one.
+func remoteIP(addr net.Addr) (net.IP, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.IP != nil
+	case *net.UDPAddr:
+		return a.IP, a.IP != nil
+	case *net.IPAddr:
+		return a.IP, a.IP != nil
+	case nil:
+		return nil, false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	return ip, ip != nil
+}
+
+// addrConn overrides the remote address reported by a connection.
+type addrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+// RemoteAddr implements net.Conn.
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// contextConn is a net.Conn bound to the lifetime of a context. Deadlines set
+// on the connection are capped by the context deadline, and pending reads and
+// writes are interrupted once the context is done.
+type contextConn struct {
+	net.Conn
+	ctx context.Context
+
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+func newContextConn(ctx context.Context, conn net.Conn) *contextConn {
+	c := &contextConn{
+		Conn: conn,
+		ctx:  ctx,
+		done: make(chan struct{}),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.Conn.SetDeadline(aLongTimeAgo)
+			c.mu.Unlock()
+		case <-c.done:
+		}
+	}()
+	return c
+}
+
+func (c *contextConn) deadline(t time.Time) time.Time {
+	if c.ctx.Err() != nil {
+		return aLongTimeAgo
+	}
+	if deadline, ok := c.ctx.Deadline(); ok && (t.IsZero() || deadline.Before(t)) {
+		return deadline
+	}
+	return t
+}
+
+// SetDeadline implements net.Conn.
+func (c *contextConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.SetDeadline(c.deadline(t))
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *contextConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.SetReadDeadline(c.deadline(t))
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *contextConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(c.deadline(t))
+}
+
+// Close implements net.Conn.
+func (c *contextConn) Close() error {
+	c.mu.Lock()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// sessionContext returns a context for a recon session, which is cancelled
+// when ctx is done or the peer is stopped.
+func (p *Peer) sessionContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-p.t.Dying():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// contextErr returns err with the context error as its cause, if the context
+// ended the session. The context deadline is also set on the connection,
+// which may expire before the context does, so errors once the deadline has
+// passed are attributed to the context.
+func contextErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		<-ctx.Done()
+	}
+	if ctx.Err() != nil {
+		return errgo.WithCausef(err, ctx.Err(), "recon session interrupted")
+	}
+	return err
+}
@@ -0,0 +1,243 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"errors"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+var ErrContentNotFound error = errors.New("content not found")
+
+// Record is the content of a record identified by a prefix tree element.
+type Record struct {
+	Element *cf.Zp
+	Content []byte
+}
+
+// ContentStore provides the record content identified by prefix tree
+// elements, so that peers may fetch the records they are missing over the
+// recon connection, rather than out of band.
+type ContentStore interface {
+	// Content returns the record content identified by element z. If the
+	// record is not known, an error with cause ErrContentNotFound is returned.
+	Content(z *cf.Zp) ([]byte, error)
+}
+
+// customContentFetch is the Config.Custom key used to advertise support for
+// the content fetch phase.
+const customContentFetch = "content fetch"
+
+// contentFetchBatch is the maximum number of elements requested in a single
+// DbRqst message.
+const contentFetchBatch = 16
+
+// maxContentReply is the maximum encoded size of the records in a DbRepl,
+// well within the maximum message length. Records which do not fit are left
+// for the remote peer to request again, and larger records are not served.
+var maxContentReply = maxReadLen / 2
+
+// maxContentRounds and maxContentElements bound the DbRqst messages, and
+// the elements requested in them, in the content fetch phase of a session.
+const (
+	maxContentRounds   = 4096
+	maxContentElements = 4 * maxRecoverSize
+)
+
+// recordSize returns the encoded size of a record in a DbRepl.
+func recordSize(content []byte) int {
+	return SksZpNbytes + 4 + len(content)
+}
+
+// SetContentStore sets the store used to answer remote requests for record
+// content. When set on both sides of a session, each peer requests the
+// content of its recovered elements after reconciliation, and delivers it in
+// Recover.RemoteRecords.
+func (p *Peer) SetContentStore(cs ContentStore) {
+	p.muHooks.Lock()
+	defer p.muHooks.Unlock()
+	p.contentStore = cs
+}
+
+func (p *Peer) getContentStore() ContentStore {
+	p.muHooks.RLock()
+	defer p.muHooks.RUnlock()
+	return p.contentStore
+}
+
+// config returns the recon protocol config message sent to remote peers
+// during the handshake.
+func (p *Peer) config(settings *Settings) (*Config, error) {
+	config, err := settings.Config()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	config.Custom = map[string]string{}
+	if p.getContentStore() != nil {
+		config.Custom[customContentFetch] = "true"
+	}
+	if settings.MembershipSecret != "" {
+		config.Custom[customMembership] = "true"
+	}
+	config.Custom[customDryRun] = dryRunSupported
+	if settings.Dataset != "" {
+		config.Custom[customDataset] = settings.Dataset
+	}
+	return config, nil
+}
+
+// contentFetchEnabled returns whether content is exchanged in the session,
+// as advertised in the configs of both peers.
+func (p *Peer) contentFetchEnabled(s *session, remoteConfig *Config) bool {
+	return s.config.Custom[customContentFetch] == "true" && remoteConfig.Custom[customContentFetch] == "true"
+}
+
+// fetchContent requests the content of elements from the remote peer, in
+// batches. A reply cut short by its size is followed by a request for the
+// remaining elements of the batch. Replies must hold records of requested
+// elements only, in the order requested. The phase is ended with an empty
+// DbRqst.
+func (p *Peer) fetchContent(role string, w *bufio.Writer, readMsg func() (ReconMsg, error), elements []*cf.Zp) ([]*Record, error) {
+	var records []*Record
+	var rounds, requested int
+	elements = sortedZp(append([]*cf.Zp(nil), elements...))
+	for len(elements) > 0 {
+		n := len(elements)
+		if n > contentFetchBatch {
+			n = contentFetchBatch
+		}
+		if rounds == maxContentRounds || requested+n > maxContentElements {
+			p.logFields(role, log.Fields{"remaining": len(elements)}).Warning("content fetch limit reached")
+			break
+		}
+		rounds++
+		requested += n
+		batch := elements[:n]
+		err := p.writeMsg(w, &DbRqst{Elements: batch})
+		if err != nil {
+			return records, errgo.Mask(err)
+		}
+		err = w.Flush()
+		if err != nil {
+			return records, errgo.Mask(err)
+		}
+		elements = elements[n:]
+
+		msg, err := readMsg()
+		if err != nil {
+			return records, errgo.Mask(err)
+		}
+		repl, ok := msg.(*DbRepl)
+		if !ok {
+			return records, errgo.Newf("expected DbRepl, got %v", msg)
+		}
+		next := 0
+		for _, record := range repl.Records {
+			for next < len(batch) && (record.Element == nil || batch[next].Cmp(record.Element) != 0) {
+				next++
+			}
+			if next == len(batch) {
+				return records, errgo.Newf("unrequested content for element %v", record.Element)
+			}
+			next++
+		}
+		records = append(records, repl.Records...)
+		if len(repl.Records) > 0 && next < len(batch) {
+			// Records are served in the order requested, so those after the
+			// last record may have been cut short.
+			elements = append(append([]*cf.Zp(nil), batch[next:]...), elements...)
+		}
+	}
+	err := p.writeMsg(w, &DbRqst{})
+	if err != nil {
+		return records, errgo.Mask(err)
+	}
+	err = w.Flush()
+	if err != nil {
+		return records, errgo.Mask(err)
+	}
+	p.logFields(role, log.Fields{"records": len(records)}).Debug("fetched content")
+	return records, nil
+}
+
+// serveContent replies to remote DbRqst messages with the content of the
+// requested elements, until an empty DbRqst ends the phase. Each reply holds
+// the records of the requested elements in order, up to maxContentReply
+// bytes.
+func (p *Peer) serveContent(role string, w *bufio.Writer, readMsg func() (ReconMsg, error)) error {
+	cs := p.getContentStore()
+	var rounds, requested int
+	for {
+		msg, err := readMsg()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		rqst, ok := msg.(*DbRqst)
+		if !ok {
+			return errgo.Newf("expected DbRqst, got %v", msg)
+		} else if len(rqst.Elements) == 0 {
+			return nil
+		}
+		rounds++
+		requested += len(rqst.Elements)
+		if rounds > maxContentRounds || requested > maxContentElements {
+			return errgo.Newf("content fetch exceeds %d requests or %d elements", maxContentRounds, maxContentElements)
+		}
+
+		repl := &DbRepl{}
+		var size int
+		for _, z := range rqst.Elements {
+			if cs == nil {
+				// Replayed sessions may exchange content without a store.
+				break
+			}
+			content, err := cs.Content(z)
+			if errgo.Cause(err) == ErrContentNotFound {
+				continue
+			} else if err != nil {
+				return errgo.Mask(err)
+			}
+			if recordSize(content) > maxContentReply {
+				p.logFields(role, log.Fields{"element": z, "size": len(content)}).Warning("record too large to serve")
+				continue
+			}
+			size += recordSize(content)
+			if size > maxContentReply {
+				break
+			}
+			repl.Records = append(repl.Records, &Record{Element: z, Content: content})
+		}
+		err = p.writeMsg(w, repl)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		err = w.Flush()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+
+	gc "gopkg.in/check.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type ContentSuite struct{}
+
+var _ = gc.Suite(&ContentSuite{})
+
+// sizedContentStore serves content of a given size for each element.
+type sizedContentStore map[string]int
+
+func (cs sizedContentStore) Content(z *cf.Zp) ([]byte, error) {
+	n, ok := cs[z.String()]
+	if !ok {
+		return nil, ErrContentNotFound
+	}
+	return bytes.Repeat([]byte{'x'}, n), nil
+}
+
+// testSamples returns n distinct elements.
+func testSamples(n int) []*cf.Zp {
+	var samples []*cf.Zp
+	for i := 0; i < n; i++ {
+		samples = append(samples, cf.Zi(cf.P_SKS, 65537+i))
+	}
+	return samples
+}
+
+// fetchFrom fetches the content of elements from a peer serving cs.
+func fetchFrom(c *gc.C, cs ContentStore, elements []*cf.Zp) ([]*Record, error) {
+	server, client := NewMemPeer(), NewMemPeer()
+	server.SetContentStore(cs)
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	served := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		served <- server.serveContent(SERVE, bufio.NewWriter(serverConn), func() (ReconMsg, error) {
+			return ReadMsg(serverConn)
+		})
+	}()
+	records, err := client.fetchContent(GOSSIP, bufio.NewWriter(clientConn), func() (ReconMsg, error) {
+		return ReadMsg(clientConn)
+	}, elements)
+	c.Assert(<-served, gc.IsNil)
+	return records, err
+}
+
+func (s *ContentSuite) TestReplySize(c *gc.C) {
+	defer func(n int) { maxContentReply = n }(maxContentReply)
+	maxContentReply = 1000
+
+	elements := testSamples(6)
+	cs := sizedContentStore{}
+	for i, z := range elements {
+		cs[z.String()] = 300
+		if i == 2 {
+			// Too large to serve.
+			cs[z.String()] = 2000
+		} else if i == 4 {
+			delete(cs, z.String())
+		}
+	}
+	records, err := fetchFrom(c, cs, elements)
+	c.Assert(err, gc.IsNil)
+	c.Assert(records, gc.HasLen, 4)
+	for _, record := range records {
+		c.Assert(record.Content, gc.HasLen, 300)
+	}
+}
+
+func (s *ContentSuite) TestUnrequestedRecords(c *gc.C) {
+	elements := testSamples(3)
+	unrequested := cf.Zi(cf.P_SKS, 99)
+	for i, records := range [][]*Record{
+		{{Element: unrequested, Content: []byte("x")}},
+		{{Element: elements[1]}, {Element: elements[0]}},
+		{{Element: elements[0]}, {Element: elements[0]}},
+		{{}},
+	} {
+		client := NewMemPeer()
+		var buf bytes.Buffer
+		_, err := client.fetchContent(GOSSIP, bufio.NewWriter(&buf), func() (ReconMsg, error) {
+			return &DbRepl{Records: records}, nil
+		}, elements)
+		c.Check(err, gc.ErrorMatches, "unrequested content for element .*", gc.Commentf("case %d", i))
+	}
+}
+
+func (s *ContentSuite) TestRequestLimit(c *gc.C) {
+	cs := sizedContentStore{}
+	elements := testSamples(maxContentElements + 10)
+	records, err := fetchFrom(c, cs, elements)
+	c.Assert(err, gc.IsNil)
+	c.Assert(records, gc.HasLen, 0)
+
+	// A remote peer exceeding the limits is cut off.
+	server := NewMemPeer()
+	server.SetContentStore(cs)
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	n := 0
+	err = server.serveContent(SERVE, w, func() (ReconMsg, error) {
+		n++
+		return &DbRqst{Elements: testSamples(1)}, nil
+	})
+	c.Assert(err, gc.ErrorMatches, "content fetch exceeds .*")
+	c.Assert(n, gc.Equals, maxContentRounds+1)
+}
@@ -0,0 +1,176 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// customDataset is the Custom config key naming the dataset a peer
+// reconciles. Peers without it reconcile the default dataset.
+const customDataset = "dataset"
+
+// AddDataset hosts a named dataset behind the listener of p, reconciling
+// tree with settings. The dataset is named by settings.Dataset, and remote
+// peers choose it in the config handshake. Its partners and other settings
+// apply to its sessions, except that access control and session limits on
+// accepted connections are applied by p, allowing the partners of every
+// dataset.
+//
+// The returned Peer delivers the dataset's recovered elements on its
+// RecoverChan, and gossips with the dataset's partners when started with
+// PeerModeGossipOnly. It is stopped along with p.
+func (p *Peer) AddDataset(settings *Settings, tree PrefixTree) (*Peer, error) {
+	name := settings.Dataset
+	if name == "" {
+		return nil, errgo.New("dataset name required")
+	} else if name == p.getSettings().Dataset {
+		return nil, errgo.Newf("dataset %q is already hosted", name)
+	}
+
+	dp := NewPeer(settings, tree)
+	// Connections for the dataset are matched against partner addresses
+	// resolved now, and refreshed while it is hosted, rather than on accept.
+	_, err := dp.getMatcher()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	p.muDie.Lock()
+	defer p.muDie.Unlock()
+	if p.isDying() {
+		return nil, errgo.Mask(ErrPeerStopped, errgo.Any)
+	}
+	p.muDatasets.Lock()
+	defer p.muDatasets.Unlock()
+	if _, ok := p.datasets[name]; ok {
+		return nil, errgo.Newf("dataset %q is already hosted", name)
+	}
+
+	dp.SetDialer(p.getDialer())
+	// Keep the dataset peer alive until p is stopped, as it does not serve.
+	dp.t.Go(func() error {
+		ctx, cancel := dp.sessionContext(context.Background())
+		defer cancel()
+		dp.resolvePartners(ctx)
+		return nil
+	})
+	p.t.Go(func() error {
+		<-p.t.Dying()
+		return dp.Stop()
+	})
+	if p.datasets == nil {
+		p.datasets = make(map[string]*Peer)
+	}
+	p.datasets[name] = dp
+	return dp, nil
+}
+
+// Dataset returns the peer hosting the named dataset, if any.
+func (p *Peer) Dataset(name string) (*Peer, bool) {
+	p.muDatasets.RLock()
+	defer p.muDatasets.RUnlock()
+	dp, ok := p.datasets[name]
+	return dp, ok
+}
+
+func (p *Peer) hasDatasets() bool {
+	p.muDatasets.RLock()
+	defer p.muDatasets.RUnlock()
+	return len(p.datasets) > 0
+}
+
+// datasetAllows returns whether ip is allowed to connect by the settings
+// of any hosted dataset.
+func (p *Peer) datasetAllows(ip net.IP) bool {
+	p.muDatasets.RLock()
+	defer p.muDatasets.RUnlock()
+	for _, dp := range p.datasets {
+		matcher, err := dp.getMatcher()
+		if err != nil {
+			p.logErr(SERVE, err).Error("cannot create dataset matcher")
+			continue
+		}
+		if allowed, _ := matchReason(matcher, ip); allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch reads the remote config from an accepted connection to choose
+// the peer hosting the dataset it requests. Unknown datasets are left to p,
+// which rejects them in the handshake. The returned connection replays the
+// remote config.
+func (p *Peer) dispatch(conn net.Conn) (*Peer, net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(p.getSettings().sessionTimeouts(conn.RemoteAddr(), p.partnerIPs()).read))
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	var buf bytes.Buffer
+	msg, _, err := readMsgSize(io.TeeReader(conn, &buf))
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "cannot read remote config")
+	}
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	conn = &peekedConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+
+	target := p
+	if config, ok := msg.(*Config); ok {
+		if dp, ok := p.Dataset(config.Custom[customDataset]); ok {
+			target = dp
+		}
+	}
+	// The connection was admitted if allowed by any dataset.
+	if ip, ok := remoteIP(conn.RemoteAddr()); ok {
+		matcher, err := target.getMatcher()
+		if err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		if allowed, reason := matchReason(matcher, ip); !allowed {
+			return nil, nil, errgo.Newf("connection from %v not allowed for dataset %q: %s",
+				conn.RemoteAddr(), target.getSettings().Dataset, reason)
+		}
+	}
+	return target, conn, nil
+}
+
+// peekedConn is a connection from which data has already been read, which
+// is read again before the rest of the connection.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// Read implements net.Conn.
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
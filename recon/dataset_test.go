@@ -0,0 +1,143 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type DatasetSuite struct{}
+
+var _ = gc.Suite(&DatasetSuite{})
+
+// addTestDataset hosts a dataset containing elements on p.
+func addTestDataset(c *gc.C, p *Peer, name string, elements ...*cf.Zp) *Peer {
+	settings := DefaultSettings()
+	settings.Dataset = name
+	tree := new(MemPrefixTree)
+	tree.Init()
+	for _, z := range elements {
+		c.Assert(tree.Insert(z), gc.IsNil)
+	}
+	dp, err := p.AddDataset(settings, tree)
+	c.Assert(err, gc.IsNil)
+	return dp
+}
+
+func (s *DatasetSuite) TestDispatch(c *gc.C) {
+	common := cf.Zi(cf.P_SKS, 65537)
+	onlyDefault := cf.Zi(cf.P_SKS, 65539)
+	onlyTenant := cf.Zi(cf.P_SKS, 65541)
+	server := newTestPeer(c, common, onlyDefault)
+	defer server.Stop()
+	tenant := addTestDataset(c, server, "tenant-a", common, onlyTenant)
+
+	// The default dataset is reconciled with the hosting peer.
+	client := newTestPeer(c, common)
+	defer client.Stop()
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+	r := <-client.RecoverChan
+	c.Assert(r.Dataset, gc.Equals, "")
+	c.Assert(r.RemoteElements, gc.HasLen, 1)
+	c.Assert(r.RemoteElements[0].Cmp(onlyDefault), gc.Equals, 0)
+
+	// A named dataset is reconciled with the peer hosting it.
+	client.settings.Dataset = "tenant-a"
+	clientErr, serverErr = pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+	r = <-client.RecoverChan
+	c.Assert(r.Dataset, gc.Equals, "tenant-a")
+	c.Assert(r.RemoteElements, gc.HasLen, 1)
+	c.Assert(r.RemoteElements[0].Cmp(onlyTenant), gc.Equals, 0)
+	status, err := tenant.Status()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status.RecentSessions, gc.HasLen, 1)
+	status, err = server.Status()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status.RecentSessions, gc.HasLen, 1)
+
+	// Unknown datasets are rejected in the handshake, by both sides.
+	client.settings.Dataset = "tenant-b"
+	clientErr, serverErr = pipeSession(c, client, server)
+	c.Assert(errgo.Cause(clientErr), gc.Equals, ErrIncompatiblePeer)
+	c.Assert(clientErr, gc.ErrorMatches, ".*mismatched dataset.*")
+	c.Assert(errgo.Cause(serverErr), gc.Equals, ErrIncompatiblePeer)
+}
+
+func (s *DatasetSuite) TestAddDataset(c *gc.C) {
+	p := newTestPeer(c)
+	addTestDataset(c, p, "tenant-a")
+
+	_, err := p.AddDataset(DefaultSettings(), new(MemPrefixTree))
+	c.Assert(err, gc.ErrorMatches, "dataset name required")
+	settings := DefaultSettings()
+	settings.Dataset = "tenant-a"
+	_, err = p.AddDataset(settings, new(MemPrefixTree))
+	c.Assert(err, gc.ErrorMatches, `dataset "tenant-a" is already hosted`)
+	settings = DefaultSettings()
+	settings.Dataset = "tenant-c"
+	settings.AllowCIDRs = []string{"not a cidr"}
+	_, err = p.AddDataset(settings, new(MemPrefixTree))
+	c.Assert(err, gc.NotNil)
+	_, ok := p.Dataset("tenant-c")
+	c.Assert(ok, gc.Equals, false)
+
+	// Partners are resolved when the dataset is added, not on accept.
+	dp, ok := p.Dataset("tenant-a")
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(dp.getSettings().Dataset, gc.Equals, "tenant-a")
+	dp.muSettings.RLock()
+	c.Assert(dp.matcher, gc.NotNil)
+	dp.muSettings.RUnlock()
+	err = dp.UpdateSettings(DefaultSettings())
+	c.Assert(err, gc.ErrorMatches, "cannot change dataset of a running peer")
+
+	// Dataset peers are stopped with the hosting peer.
+	c.Assert(p.Stop(), gc.IsNil)
+	c.Assert(dp.isDying(), gc.Equals, true)
+	settings = DefaultSettings()
+	settings.Dataset = "tenant-b"
+	_, err = p.AddDataset(settings, new(MemPrefixTree))
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPeerStopped)
+}
+
+func (s *DatasetSuite) TestDatasetAllows(c *gc.C) {
+	p := newTestPeer(c)
+	defer p.Stop()
+	p.settings.StrictLoopback = true
+	settings := DefaultSettings()
+	settings.Dataset = "tenant-a"
+	settings.AllowCIDRs = []string{"10.1.0.0/16"}
+	_, err := p.AddDataset(settings, new(MemPrefixTree))
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(p.datasetAllows(net.ParseIP("10.1.2.3")), gc.Equals, true)
+	c.Assert(p.datasetAllows(net.ParseIP("10.2.2.3")), gc.Equals, false)
+}
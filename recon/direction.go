@@ -0,0 +1,104 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+// Direction restricts the flow of elements in recon sessions.
+type Direction string
+
+const (
+	// DirectionBoth recovers elements from, and provides elements to, the
+	// remote peer.
+	DirectionBoth = Direction("")
+
+	// DirectionPull only recovers elements from the remote peer, never
+	// providing it with elements it is missing.
+	DirectionPull = Direction("pull")
+
+	// DirectionPush only provides elements to the remote peer, never
+	// recovering elements from it.
+	DirectionPush = Direction("push")
+)
+
+// directionBothExplicit overrides a partner direction with DirectionBoth.
+const directionBothExplicit = Direction("both")
+
+// customDirection is the Config.Custom key used to negotiate the direction
+// of a session.
+const customDirection = "direction"
+
+func (d Direction) valid() bool {
+	return d == DirectionBoth || d == DirectionPull || d == DirectionPush
+}
+
+func (d Direction) sends() bool {
+	return d != DirectionPull
+}
+
+func (d Direction) receives() bool {
+	return d != DirectionPush
+}
+
+// negotiateDirection returns whether the local peer sends elements to and
+// receives elements from the remote peer, given the directions of both.
+// Unknown remote directions are treated as DirectionBoth.
+func negotiateDirection(local, remote Direction) (send, receive bool) {
+	if !remote.valid() {
+		remote = DirectionBoth
+	}
+	return local.sends() && remote.receives(), local.receives() && remote.sends()
+}
+
+// provide returns the elements in zs which the session may provide to the
+// remote peer.
+func (s *session) provide(zs *cf.ZSet) *cf.ZSet {
+	if !s.send {
+		return cf.NewZSet()
+	}
+	return zs
+}
+
+// accept returns the elements in zs which the session may recover from the
+// remote peer.
+func (s *session) accept(zs *cf.ZSet) *cf.ZSet {
+	if !s.receive {
+		return cf.NewZSet()
+	}
+	return zs
+}
+
+// partnerDirection returns the direction configured for the partner at addr,
+// matched by its resolved IP address.
+func (s *Settings) partnerDirection(addr net.Addr, resolved partnerIPs) Direction {
+	partner, ok := s.matchPartner(addr, resolved, func(partner Partner) bool {
+		return partner.Direction != DirectionBoth
+	})
+	if !ok {
+		return DirectionBoth
+	}
+	return partner.Direction
+}
@@ -0,0 +1,134 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"context"
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type DirectionSuite struct{}
+
+var _ = gc.Suite(&DirectionSuite{})
+
+func (s *DirectionSuite) TestNegotiate(c *gc.C) {
+	for _, tc := range []struct {
+		local, remote Direction
+		send, receive bool
+	}{
+		{DirectionBoth, DirectionBoth, true, true},
+		{DirectionPull, DirectionBoth, false, true},
+		{DirectionPush, DirectionBoth, true, false},
+		{DirectionBoth, DirectionPull, true, false},
+		{DirectionBoth, DirectionPush, false, true},
+		{DirectionPull, DirectionPush, false, true},
+		{DirectionPull, DirectionPull, false, false},
+		{DirectionBoth, Direction("sideways"), true, true},
+	} {
+		send, receive := negotiateDirection(tc.local, tc.remote)
+		c.Check(send, gc.Equals, tc.send, gc.Commentf("%q %q", tc.local, tc.remote))
+		c.Check(receive, gc.Equals, tc.receive, gc.Commentf("%q %q", tc.local, tc.remote))
+	}
+}
+
+func (s *DirectionSuite) TestPartnerDirection(c *gc.C) {
+	settings := DefaultSettings()
+	settings.Partners["primary"] = Partner{ReconAddr: "10.1.2.3:11370", Direction: DirectionPull}
+	settings.Partners["other"] = Partner{ReconAddr: "10.1.2.4:11370"}
+	matcher, err := settings.Matcher()
+	c.Assert(err, gc.IsNil)
+	resolved := matcherPartnerIPs(matcher)
+	c.Assert(settings.partnerDirection(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370}, resolved), gc.Equals, DirectionPull)
+	c.Assert(settings.partnerDirection(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000}, resolved), gc.Equals, DirectionPull)
+	c.Assert(settings.partnerDirection(&net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 11370}, resolved), gc.Equals, DirectionBoth)
+
+	// Partners are only matched by the addresses resolved for the matcher.
+	c.Assert(settings.partnerDirection(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370}, nil), gc.Equals, DirectionBoth)
+
+	_, err = ParseSettings(`
+[conflux.recon.partner.bad]
+reconAddr = "10.1.2.3:11370"
+direction = "sideways"
+`)
+	c.Assert(err, gc.ErrorMatches, `invalid direction "sideways" for partner "bad"`)
+}
+
+// directionSession runs a session between a client and server holding
+// distinct elements, returning what each recovered.
+func directionSession(c *gc.C, clientDir, serverDir Direction) (clientRecovered, serverRecovered []*cf.Zp, err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+
+	common := []*cf.Zp{cf.Zi(cf.P_SKS, 65537), cf.Zi(cf.P_SKS, 65539)}
+	server := newTestPeer(c, append(common, cf.Zi(cf.P_SKS, 65541))...)
+	server.settings.Partners["client"] = Partner{ReconAddr: "127.0.0.1:11370", Direction: serverDir}
+	server.SetListener(fixedListener{ln})
+	server.t.Go(server.Serve)
+	defer server.Stop()
+
+	client := newTestPeer(c, append(common, cf.Zi(cf.P_SKS, 65543))...)
+	defer client.Stop()
+
+	err = client.InitiateReconDirection(context.Background(), ln.Addr(), clientDir)
+	for _, ch := range []struct {
+		p      *Peer
+		result *[]*cf.Zp
+	}{{client, &clientRecovered}, {server, &serverRecovered}} {
+		select {
+		case r := <-ch.p.RecoverChan:
+			*ch.result = r.RemoteElements
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	return clientRecovered, serverRecovered, err
+}
+
+func (s *DirectionSuite) TestSessions(c *gc.C) {
+	clientRecovered, serverRecovered, err := directionSession(c, DirectionBoth, DirectionBoth)
+	c.Assert(err, gc.IsNil)
+	c.Assert(clientRecovered, gc.HasLen, 1)
+	c.Assert(serverRecovered, gc.HasLen, 1)
+
+	clientRecovered, serverRecovered, err = directionSession(c, DirectionPull, DirectionBoth)
+	c.Assert(err, gc.IsNil)
+	c.Assert(clientRecovered, gc.HasLen, 1)
+	c.Assert(serverRecovered, gc.HasLen, 0)
+
+	clientRecovered, serverRecovered, err = directionSession(c, DirectionPush, DirectionBoth)
+	c.Assert(err, gc.IsNil)
+	c.Assert(clientRecovered, gc.HasLen, 0)
+	c.Assert(serverRecovered, gc.HasLen, 1)
+
+	clientRecovered, serverRecovered, err = directionSession(c, DirectionBoth, DirectionPull)
+	c.Assert(err, gc.IsNil)
+	c.Assert(clientRecovered, gc.HasLen, 0)
+	c.Assert(serverRecovered, gc.HasLen, 1)
+
+	_, _, err = directionSession(c, DirectionPull, DirectionPull)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrIncompatiblePeer)
+}
@@ -0,0 +1,163 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"context"
+	"net"
+	"sort"
+
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+// customDryRun is the Config.Custom key used to advertise support for dry
+// run sessions, and by the initiating peer to request one.
+const customDryRun = "dry run"
+
+const (
+	dryRunSupported = "supported"
+	dryRunRequested = "requested"
+)
+
+// DryRunResult reports the differences found in a dry run session.
+type DryRunResult struct {
+	RemoteAddr   net.Addr
+	RemoteConfig *Config
+
+	// LocalNeeds are the elements held by the remote peer but not the local
+	// peer.
+	LocalNeeds []*cf.Zp
+
+	// RemoteNeeds are the elements held by the local peer but not the remote
+	// peer.
+	RemoteNeeds []*cf.Zp
+
+	// Prefixes counts the differences under each prefix tree node at which
+	// they were reconciled.
+	Prefixes []PrefixDiff
+}
+
+// PrefixDiff counts the differences under a prefix tree node.
+type PrefixDiff struct {
+	Prefix      *cf.Bitstring
+	LocalNeeds  int
+	RemoteNeeds int
+}
+
+// dryRun collects the results of a dry run session.
+type dryRun struct {
+	remoteConfig *Config
+	prefixes     []*cf.Bitstring
+	localNeeds   []*cf.Zp
+	remoteNeeds  *cf.ZSet
+}
+
+func newDryRun() *dryRun {
+	return &dryRun{remoteNeeds: cf.NewZSet()}
+}
+
+// recordPrefix records a prefix reconciled in a dry run session.
+func (s *session) recordPrefix(prefix *cf.Bitstring) {
+	if s.dryRun != nil {
+		s.dryRun.prefixes = append(s.dryRun.prefixes, prefix)
+	}
+}
+
+// DryRun reconciles with the remote peer at addr, reporting the differences
+// found without recovering them. Neither peer delivers recovered elements,
+// fetches content or exchanges membership in a dry run session.
+func (p *Peer) DryRun(ctx context.Context, addr net.Addr) (*DryRunResult, error) {
+	// Hold the prefix tree stable for the session, as recon does, but
+	// without regard to the recovery queue, which a dry run does not use.
+	if !p.acquireReader(false) {
+		return nil, errgo.WithCausef(nil, ErrPeerBusy, "dry run not available, currently mutating")
+	}
+	defer p.readRelease()
+
+	dr := newDryRun()
+	err := p.initiateRecon(ctx, addr, sessionOptions{dryRun: dr})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	result := &DryRunResult{
+		RemoteAddr:   addr,
+		RemoteConfig: dr.remoteConfig,
+		LocalNeeds:   dr.localNeeds,
+		RemoteNeeds:  dr.remoteNeeds.Items(),
+	}
+	result.Prefixes = prefixDiffs(dr.prefixes, result.LocalNeeds, result.RemoteNeeds)
+	return result, nil
+}
+
+// prefixDiffs counts each element under the longest of prefixes which it
+// matches.
+func prefixDiffs(prefixes []*cf.Bitstring, localNeeds, remoteNeeds []*cf.Zp) []PrefixDiff {
+	diffs := make(map[string]*PrefixDiff)
+	var keys []string
+	count := func(z *cf.Zp, f func(*PrefixDiff)) {
+		bs := cf.NewZpBitstring(z)
+		var match *cf.Bitstring
+		for _, prefix := range prefixes {
+			if hasPrefix(bs, prefix) && (match == nil || prefix.BitLen() > match.BitLen()) {
+				match = prefix
+			}
+		}
+		if match == nil {
+			match = cf.NewBitstring(0)
+		}
+		key := match.String()
+		diff, ok := diffs[key]
+		if !ok {
+			diff = &PrefixDiff{Prefix: match}
+			diffs[key] = diff
+			keys = append(keys, key)
+		}
+		f(diff)
+	}
+	for _, z := range localNeeds {
+		count(z, func(d *PrefixDiff) { d.LocalNeeds++ })
+	}
+	for _, z := range remoteNeeds {
+		count(z, func(d *PrefixDiff) { d.RemoteNeeds++ })
+	}
+
+	sort.Strings(keys)
+	result := make([]PrefixDiff, len(keys))
+	for i, key := range keys {
+		result[i] = *diffs[key]
+	}
+	return result
+}
+
+func hasPrefix(bs, prefix *cf.Bitstring) bool {
+	if prefix.BitLen() > bs.BitLen() {
+		return false
+	}
+	for i := 0; i < prefix.BitLen(); i++ {
+		if bs.Get(i) != prefix.Get(i) {
+			return false
+		}
+	}
+	return true
+}
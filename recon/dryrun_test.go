@@ -0,0 +1,110 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"context"
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type DryRunSuite struct{}
+
+var _ = gc.Suite(&DryRunSuite{})
+
+func (s *DryRunSuite) TestDryRun(c *gc.C) {
+	var common, onlyClient, onlyServer []*cf.Zp
+	for i := 1; i < 100; i++ {
+		common = append(common, cf.Zi(cf.P_SKS, 65537*i))
+	}
+	for i := 1; i < 40; i++ {
+		onlyClient = append(onlyClient, cf.Zi(cf.P_SKS, 68111*i))
+	}
+	for i := 1; i < 20; i++ {
+		onlyServer = append(onlyServer, cf.Zi(cf.P_SKS, 70001*i))
+	}
+
+	network := newPipeNetwork()
+	server := newTestPeer(c, append(common, onlyServer...)...)
+	server.SetListener(network)
+	server.t.Go(server.Serve)
+	defer server.Stop()
+
+	client := newTestPeer(c, append(common, onlyClient...)...)
+	client.SetDialer(network)
+	defer client.Stop()
+
+	partnerAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370}
+	result, err := client.DryRun(context.Background(), partnerAddr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.RemoteAddr, gc.Equals, partnerAddr)
+	c.Assert(result.RemoteConfig, gc.NotNil)
+	c.Assert(cf.NewZSet(result.LocalNeeds...).Equal(cf.NewZSet(onlyServer...)), gc.Equals, true)
+	c.Assert(cf.NewZSet(result.RemoteNeeds...).Equal(cf.NewZSet(onlyClient...)), gc.Equals, true)
+
+	var localNeeds, remoteNeeds int
+	for _, diff := range result.Prefixes {
+		localNeeds += diff.LocalNeeds
+		remoteNeeds += diff.RemoteNeeds
+	}
+	c.Assert(localNeeds, gc.Equals, len(onlyServer))
+	c.Assert(remoteNeeds, gc.Equals, len(onlyClient))
+
+	// Nothing is delivered or queued on either side.
+	select {
+	case r := <-client.RecoverChan:
+		c.Fatalf("unexpected client recover %v", r)
+	case r := <-server.RecoverChan:
+		c.Fatalf("unexpected server recover %v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Assert(client.recoverQ.pending.Len(), gc.Equals, 0)
+	c.Assert(server.recoverQ.pending.Len(), gc.Equals, 0)
+
+	status, err := client.PartnerStatus()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status, gc.HasLen, 0)
+}
+
+func (s *DryRunSuite) TestPrefixDiffs(c *gc.C) {
+	z1, z2, z3 := cf.Zi(cf.P_SKS, 65537), cf.Zi(cf.P_SKS, 65539), cf.Zi(cf.P_SKS, 65541)
+	bs := cf.NewZpBitstring(z1)
+	prefix := cf.NewBitstring(2)
+	prefix.SetBytes(bs.Bytes())
+	var prefixes []*cf.Bitstring
+	prefixes = append(prefixes, cf.NewBitstring(0), prefix)
+
+	diffs := prefixDiffs(prefixes, []*cf.Zp{z1, z2}, []*cf.Zp{z3})
+	counts := make(map[string][2]int)
+	var total [2]int
+	for _, diff := range diffs {
+		counts[diff.Prefix.String()] = [2]int{diff.LocalNeeds, diff.RemoteNeeds}
+		total[0] += diff.LocalNeeds
+		total[1] += diff.RemoteNeeds
+	}
+	c.Assert(total, gc.Equals, [2]int{2, 1})
+	c.Assert(counts[prefix.String()][0] >= 1, gc.Equals, true)
+}
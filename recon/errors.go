@@ -0,0 +1,195 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ErrRateLimited is the cause of an error when a remote peer rejects a
+// session because connections are arriving too quickly.
+var ErrRateLimited error = errors.New("remote peer rate limited the connection")
+
+// ErrRemoteInternal is the cause of an error when a remote peer reports an
+// internal error.
+var ErrRemoteInternal error = errors.New("remote peer reported an internal error")
+
+// ErrorCode classifies an error reported to a remote peer, so that it need
+// not match on the text.
+type ErrorCode string
+
+const (
+	ErrorCodeBusy               = ErrorCode("busy")
+	ErrorCodeIncompatibleConfig = ErrorCode("incompatible-config")
+	ErrorCodeAuthFailed         = ErrorCode("auth-failed")
+	ErrorCodeRateLimited        = ErrorCode("rate-limited")
+	ErrorCodeInternal           = ErrorCode("internal")
+)
+
+// busyRetryAfter is the retry-after hint sent to peers while busy.
+var busyRetryAfter = 10 * time.Second
+
+// busyReason is the text with which peers reject sessions while mutating
+// their prefix tree. Rejections with this text but without a code, from peers
+// which do not send codes, are also busy.
+const busyReason = "sync not available, currently mutating"
+
+// cause returns the sentinel error for the code. Unknown codes, and errors
+// reported by peers which do not send codes, have no cause.
+func (c ErrorCode) cause() error {
+	switch c {
+	case ErrorCodeBusy:
+		return ErrPeerBusy
+	case ErrorCodeIncompatibleConfig:
+		return ErrRemoteRejectedConfig
+	case ErrorCodeAuthFailed:
+		return ErrMembershipAuth
+	case ErrorCodeRateLimited:
+		return ErrRateLimited
+	case ErrorCodeInternal:
+		return ErrRemoteInternal
+	}
+	return nil
+}
+
+// errorCode returns the code reported to a remote peer for err.
+func errorCode(err error) ErrorCode {
+	switch errgo.Cause(err) {
+	case ErrPeerBusy:
+		return ErrorCodeBusy
+	case ErrIncompatiblePeer, ErrRemoteRejectedConfig:
+		return ErrorCodeIncompatibleConfig
+	case ErrMembershipAuth:
+		return ErrorCodeAuthFailed
+	case ErrRateLimited:
+		return ErrorCodeRateLimited
+	}
+	return ErrorCodeInternal
+}
+
+// isBusy returns whether err reports a busy or rate limited peer, which is
+// otherwise healthy. Other errors, including rejections coded as
+// incompatible-config or auth-failed, count as failures of the peer.
+func isBusy(err error) bool {
+	switch errgo.Cause(err) {
+	case ErrPeerBusy, ErrRateLimited:
+		return true
+	}
+	return false
+}
+
+// RemoteError is an error reported by a remote peer, either rejecting the
+// config handshake or in an Error message.
+type RemoteError struct {
+	// Code classifies the error, if the remote peer sent a code.
+	Code ErrorCode
+
+	// Reason is the text of the error.
+	Reason string
+
+	// RetryAfter is how long the remote peer asked to wait before trying
+	// again, or zero.
+	RetryAfter time.Duration
+
+	// rejected is set if the error rejected the config handshake.
+	rejected bool
+}
+
+// Error implements error.
+func (e *RemoteError) Error() string {
+	cause := e.Cause()
+	switch {
+	case cause == nil:
+		return "remote error: " + e.Reason
+	case e.Reason == "":
+		return cause.Error()
+	}
+	return e.Reason + ": " + cause.Error()
+}
+
+// Cause implements errgo.Causer, returning the sentinel error for the code.
+// Config rejections without a known code are caused by
+// ErrRemoteRejectedConfig, unless the peer was busy.
+func (e *RemoteError) Cause() error {
+	if cause := e.Code.cause(); cause != nil {
+		return cause
+	}
+	if e.rejected && e.Code == "" && e.Reason == busyReason {
+		return ErrPeerBusy
+	}
+	if e.rejected {
+		return ErrRemoteRejectedConfig
+	}
+	return nil
+}
+
+// RetryAfter returns the retry-after hint in a remote peer's error, or zero.
+func RetryAfter(err error) time.Duration {
+	for err != nil {
+		if e, ok := err.(*RemoteError); ok {
+			return e.RetryAfter
+		}
+		w, ok := err.(errgo.Wrapper)
+		if !ok {
+			return 0
+		}
+		err = w.Underlying()
+	}
+	return 0
+}
+
+// errorTag matches the code and retry-after hint appended to the text of an
+// error. Peers which do not understand the tag treat it as part of the text.
+var errorTag = regexp.MustCompile(`^((?s).*) \[recon:([a-z][a-z-]*)(?: retry-after=([1-9][0-9]{0,8}))?\]$`)
+
+// formatReason appends the code and retry-after hint to the text of an
+// error.
+func formatReason(text string, code ErrorCode, retryAfter time.Duration) string {
+	if code == "" {
+		return text
+	}
+	if retryAfter <= 0 {
+		return fmt.Sprintf("%s [recon:%s]", text, code)
+	}
+	secs := int64((retryAfter + time.Second - 1) / time.Second)
+	return fmt.Sprintf("%s [recon:%s retry-after=%d]", text, code, secs)
+}
+
+// parseReason splits the code and retry-after hint from the text of an
+// error.
+func parseReason(s string) (text string, code ErrorCode, retryAfter time.Duration) {
+	m := errorTag.FindStringSubmatch(s)
+	if m == nil {
+		return s, "", 0
+	}
+	if m[3] != "" {
+		secs, _ := strconv.Atoi(m[3])
+		retryAfter = time.Duration(secs) * time.Second
+	}
+	return m[1], ErrorCode(m[2]), retryAfter
+}
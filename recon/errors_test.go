@@ -0,0 +1,151 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+)
+
+type ErrorsSuite struct{}
+
+var _ = gc.Suite(&ErrorsSuite{})
+
+func (s *ErrorsSuite) TestReason(c *gc.C) {
+	for i, tc := range []struct {
+		text       string
+		code       ErrorCode
+		retryAfter time.Duration
+		wire       string
+	}{
+		{"mismatched mbar", "", 0, "mismatched mbar"},
+		{"mismatched mbar", ErrorCodeIncompatibleConfig, 0, "mismatched mbar [recon:incompatible-config]"},
+		{"too many sessions", ErrorCodeBusy, 10 * time.Second, "too many sessions [recon:busy retry-after=10]"},
+		{"slow down", ErrorCodeRateLimited, 1500 * time.Millisecond, "slow down [recon:rate-limited retry-after=2]"},
+		{"", ErrorCodeInternal, 0, " [recon:internal]"},
+	} {
+		wire := formatReason(tc.text, tc.code, tc.retryAfter)
+		c.Check(wire, gc.Equals, tc.wire, gc.Commentf("case %d", i))
+		text, code, retryAfter := parseReason(wire)
+		c.Check(text, gc.Equals, tc.text, gc.Commentf("case %d", i))
+		c.Check(code, gc.Equals, tc.code, gc.Commentf("case %d", i))
+		c.Check(retryAfter, gc.Equals, tc.retryAfter.Round(time.Second), gc.Commentf("case %d", i))
+	}
+
+	// Text which merely resembles a tag is left alone.
+	for _, wire := range []string{"[recon:busy]", "x [recon:Busy]", "x [recon:busy retry-after=0]", "x [recon:busy] "} {
+		text, code, _ := parseReason(wire)
+		c.Check(text, gc.Equals, wire)
+		c.Check(code, gc.Equals, ErrorCode(""))
+	}
+}
+
+func (s *ErrorsSuite) TestRemoteError(c *gc.C) {
+	for i, tc := range []struct {
+		err   *RemoteError
+		cause error
+		msg   string
+	}{
+		{&RemoteError{Code: ErrorCodeBusy, Reason: "mutating", rejected: true},
+			ErrPeerBusy, "mutating: peer is busy handling another request"},
+		{&RemoteError{Code: ErrorCodeIncompatibleConfig, Reason: "mismatched mbar", rejected: true},
+			ErrRemoteRejectedConfig, "mismatched mbar: remote rejected configuration"},
+		{&RemoteError{Reason: "mismatched mbar", rejected: true},
+			ErrRemoteRejectedConfig, "mismatched mbar: remote rejected configuration"},
+		{&RemoteError{Reason: busyReason, rejected: true},
+			ErrPeerBusy, busyReason + ": peer is busy handling another request"},
+		{&RemoteError{Code: ErrorCodeRateLimited, rejected: true},
+			ErrRateLimited, "remote peer rate limited the connection"},
+		{&RemoteError{Code: ErrorCodeAuthFailed}, ErrMembershipAuth, "membership authentication failed"},
+		{&RemoteError{Code: ErrorCodeInternal, Reason: "oops"}, ErrRemoteInternal, "oops: remote peer reported an internal error"},
+	} {
+		err := errgo.Mask(tc.err, errgo.Any)
+		c.Check(errgo.Cause(err), gc.Equals, tc.cause, gc.Commentf("case %d", i))
+		c.Check(err.Error(), gc.Equals, tc.msg, gc.Commentf("case %d", i))
+	}
+
+	// Errors without a code keep their own identity.
+	err := &RemoteError{Code: "teapot", Reason: "short and stout"}
+	c.Assert(errgo.Cause(err), gc.Equals, error(err))
+	c.Assert(err, gc.ErrorMatches, "remote error: short and stout")
+
+	c.Assert(RetryAfter(errgo.Notef(&RemoteError{RetryAfter: time.Minute}, "recon")), gc.Equals, time.Minute)
+	c.Assert(RetryAfter(errgo.New("other")), gc.Equals, time.Duration(0))
+}
+
+func (s *ErrorsSuite) TestBusyHandshake(c *gc.C) {
+	server := newTestPeer(c)
+	defer server.Stop()
+	server.mutating = true
+	client := newTestPeer(c)
+	defer client.Stop()
+
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(errgo.Cause(serverErr), gc.Equals, ErrPeerBusy)
+	c.Assert(errgo.Cause(clientErr), gc.Equals, ErrPeerBusy)
+	c.Assert(clientErr, gc.ErrorMatches, ".*sync not available, currently mutating: peer is busy.*")
+	c.Assert(RetryAfter(clientErr), gc.Equals, busyRetryAfter)
+}
+
+func (s *ErrorsSuite) TestCodedBackoff(c *gc.C) {
+	for i, tc := range []struct {
+		code     ErrorCode
+		failures int
+	}{
+		{ErrorCodeBusy, 0},
+		{ErrorCodeRateLimited, 0},
+		{ErrorCodeIncompatibleConfig, 1},
+		{ErrorCodeAuthFailed, 1},
+		{ErrorCodeInternal, 1},
+		{"", 1},
+	} {
+		pt := newPartnerTable()
+		err := errgo.Mask(&RemoteError{Code: tc.code, Reason: "no", rejected: true}, errgo.Any)
+		pt.record(partnerA, nil, err, time.Minute)
+		status := pt.status([]net.Addr{partnerA})
+		c.Check(status[0].ConsecutiveFailures, gc.Equals, tc.failures, gc.Commentf("case %d", i))
+		c.Check(status[0].BackoffUntil.IsZero(), gc.Equals, tc.failures == 0, gc.Commentf("case %d", i))
+	}
+}
+
+func (s *ErrorsSuite) TestUntaggedBusyBackoff(c *gc.C) {
+	// Peers which do not send codes are busy while mutating.
+	pt := newPartnerTable()
+	err := errgo.Mask(&RemoteError{Reason: busyReason, rejected: true}, errgo.Any)
+	pt.record(partnerA, nil, err, time.Minute)
+	status := pt.status([]net.Addr{partnerA})
+	c.Assert(status[0].ConsecutiveFailures, gc.Equals, 0)
+	c.Assert(status[0].BackoffUntil.IsZero(), gc.Equals, true)
+}
+
+func (s *ErrorsSuite) TestRetryAfterBackoff(c *gc.C) {
+	pt := newPartnerTable()
+	err := errgo.Mask(&RemoteError{Code: ErrorCodeBusy, RetryAfter: time.Minute}, errgo.Any)
+	pt.record(partnerA, nil, err, time.Second)
+	status := pt.status([]net.Addr{partnerA})
+	c.Assert(status[0].ConsecutiveFailures, gc.Equals, 0)
+	backoffLeft := status[0].BackoffUntil.Sub(time.Now())
+	c.Assert(backoffLeft > 50*time.Second && backoffLeft <= time.Minute, gc.Equals, true)
+}
@@ -0,0 +1,91 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"sort"
+	"strings"
+)
+
+// FilterPolicy determines how peers with filters differing from the local
+// filters are handled. Filters such as key deduplication and merging change
+// the elements a peer holds, so peers with different filters never converge.
+type FilterPolicy string
+
+const (
+	// FilterPolicyReject rejects peers with different filters, unless they
+	// are listed as equivalent. It is the default policy.
+	FilterPolicyReject = FilterPolicy("reject")
+
+	// FilterPolicyWarn logs a warning for peers with different filters, and
+	// reconciles with them anyway.
+	FilterPolicyWarn = FilterPolicy("warn")
+)
+
+func (fp FilterPolicy) valid() bool {
+	return fp == "" || fp == FilterPolicyReject || fp == FilterPolicyWarn
+}
+
+// parseFilters returns the set of filters in a comma-separated list, sorted
+// and without duplicates or empty entries.
+func parseFilters(filters string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, filter := range strings.Split(filters, ",") {
+		filter = strings.TrimSpace(filter)
+		if filter == "" || seen[filter] {
+			continue
+		}
+		seen[filter] = true
+		result = append(result, filter)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// filterSetKey returns a canonical form of a comma-separated filter list,
+// which is equal for the same set of filters in any order.
+func filterSetKey(filters string) string {
+	return strings.Join(parseFilters(filters), ",")
+}
+
+// filtersCompatible returns whether a remote peer's comma-separated filters
+// are the same set as the local filters, or are listed as equivalent.
+func (s *Settings) filtersCompatible(remote string) bool {
+	localKey := filterSetKey(strings.Join(s.Filters, ","))
+	remoteKey := filterSetKey(remote)
+	if localKey == remoteKey {
+		return true
+	}
+	for _, group := range s.FilterEquivalences {
+		var hasLocal, hasRemote bool
+		for _, filters := range group {
+			key := filterSetKey(filters)
+			hasLocal = hasLocal || key == localKey
+			hasRemote = hasRemote || key == remoteKey
+		}
+		if hasLocal && hasRemote {
+			return true
+		}
+	}
+	return false
+}
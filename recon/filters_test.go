@@ -0,0 +1,85 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+)
+
+type FiltersSuite struct{}
+
+var _ = gc.Suite(&FiltersSuite{})
+
+func (s *FiltersSuite) TestParseFilters(c *gc.C) {
+	c.Assert(parseFilters(""), gc.HasLen, 0)
+	c.Assert(parseFilters(" yminsky.merge, yminsky.dedup,,yminsky.merge"), gc.DeepEquals,
+		[]string{"yminsky.dedup", "yminsky.merge"})
+	c.Assert(filterSetKey("b,a"), gc.Equals, filterSetKey("a,b"))
+}
+
+func (s *FiltersSuite) TestCompatible(c *gc.C) {
+	settings := DefaultSettings()
+	settings.Filters = []string{"yminsky.dedup", "yminsky.merge"}
+	c.Assert(settings.filtersCompatible("yminsky.merge,yminsky.dedup"), gc.Equals, true)
+	c.Assert(settings.filtersCompatible("yminsky.dedup"), gc.Equals, false)
+	c.Assert(settings.filtersCompatible(""), gc.Equals, false)
+
+	settings.FilterEquivalences = [][]string{{"yminsky.merge,yminsky.dedup", "yminsky.dedup"}}
+	c.Assert(settings.filtersCompatible("yminsky.dedup"), gc.Equals, true)
+	c.Assert(settings.filtersCompatible(""), gc.Equals, false)
+
+	_, err := ParseSettings(`
+[conflux.recon]
+filterPolicy = "ignore"
+`)
+	c.Assert(err, gc.ErrorMatches, `invalid filterPolicy "ignore"`)
+}
+
+func (s *FiltersSuite) TestSessionFilters(c *gc.C) {
+	server := newTestPeer(c)
+	defer server.Stop()
+	server.settings.Filters = []string{"yminsky.dedup", "yminsky.merge"}
+	client := newTestPeer(c)
+	defer client.Stop()
+	client.settings.Filters = []string{"yminsky.merge", "yminsky.dedup"}
+
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+
+	client.settings.Filters = []string{"yminsky.dedup"}
+	clientErr, serverErr = pipeSession(c, client, server)
+	c.Assert(errgo.Cause(clientErr), gc.Equals, ErrIncompatiblePeer)
+	c.Assert(errgo.Cause(serverErr), gc.Equals, ErrIncompatiblePeer)
+
+	client.settings.FilterPolicy = FilterPolicyWarn
+	clientErr, serverErr = pipeSession(c, client, server)
+	c.Assert(errgo.Cause(clientErr), gc.Equals, ErrRemoteRejectedConfig)
+	c.Assert(clientErr, gc.ErrorMatches, ".*mismatched filters.*")
+	c.Assert(errgo.Cause(serverErr), gc.Equals, ErrIncompatiblePeer)
+
+	server.settings.FilterPolicy = FilterPolicyWarn
+	clientErr, serverErr = pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+}
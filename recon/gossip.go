@@ -23,10 +23,12 @@ package recon
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"gopkg.in/errgo.v1"
@@ -39,35 +41,29 @@ const GOSSIP = "gossip"
 
 // Gossip with remote servers, acting as a client.
 func (p *Peer) Gossip() error {
+	return p.GossipContext(context.Background())
+}
+
+// GossipContext is like Gossip, but also stops when ctx is done. ctx is
+// passed on to each recon session initiated.
+func (p *Peer) GossipContext(ctx context.Context) error {
+	ctx, cancel := p.sessionContext(ctx)
+	defer cancel()
+
 	rand.Seed(time.Now().UnixNano())
-	timer := time.NewTimer(time.Second * time.Duration(rand.Intn(p.settings.GossipIntervalSecs)))
+	timer := time.NewTimer(time.Second * time.Duration(rand.Intn(p.getSettings().GossipIntervalSecs)))
 	for {
 		select {
-		case <-p.t.Dying():
+		case <-ctx.Done():
 			return nil
 		case <-timer.C:
 
 			if p.readAcquire() {
-				peer, err := p.choosePartner()
-				if err != nil {
-					if errgo.Cause(err) == ErrNoPartners {
-						p.log(GOSSIP).Debug("no partners to gossip with")
-					} else {
-						p.logErr(GOSSIP, err).Error("choosePartner")
-					}
-				} else {
-					err = p.InitiateRecon(peer)
-					if errgo.Cause(err) == ErrPeerBusy {
-						p.logErr(GOSSIP, err).Debug()
-					} else if err != nil {
-						p.logErr(GOSSIP, err).Errorf("recon with %v failed", peer)
-					}
-				}
-
-				p.wg.Done()
+				p.gossipRound(ctx)
+				p.readRelease()
 			}
 
-			delay := time.Second * time.Duration(rand.Intn(p.settings.GossipIntervalSecs))
+			delay := time.Second * time.Duration(rand.Intn(p.getSettings().GossipIntervalSecs))
 			p.log(GOSSIP).Infof("waiting %s for next gossip attempt", delay)
 			timer.Reset(delay)
 		}
@@ -87,36 +83,223 @@ func IsGossipBlocked(err error) bool {
 		return true
 	case ErrPeerBusy:
 		return true
+	case ErrRateLimited:
+		return true
+	case ErrPartnersBackingOff:
+		return true
 	}
 	return false
 }
 
-func (p *Peer) choosePartner() (net.Addr, error) {
-	partners, err := p.settings.PartnerAddrs()
+// choosePartners chooses up to n distinct partners to gossip with.
+func (p *Peer) choosePartners(n int) ([]net.Addr, error) {
+	partners, err := p.gossipPartners()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	if len(partners) == 0 {
 		return nil, errgo.Mask(ErrNoPartners, IsGossipBlocked)
 	}
-	return partners[rand.Intn(len(partners))], nil
+	return p.partners.choose(partners, n)
+}
+
+// gossipRound initiates recon with up to MaxConcurrentGossip partners
+// concurrently. Elements recovered in concurrent sessions are merged and
+// deduplicated once all sessions have ended, before delivery.
+func (p *Peer) gossipRound(ctx context.Context) {
+	n := p.getSettings().MaxConcurrentGossip
+	if n < 1 {
+		n = 1
+	}
+	peers, err := p.choosePartners(n)
+	if err != nil {
+		if errgo.Cause(err) == ErrNoPartners {
+			p.log(GOSSIP).Debug("no partners to gossip with")
+		} else if errgo.Cause(err) == ErrPartnersBackingOff {
+			p.log(GOSSIP).Debug("all partners are backing off")
+		} else {
+			p.logErr(GOSSIP, err).Error("choosePartners")
+		}
+		return
+	}
+
+	if len(peers) == 1 {
+		p.logGossipErr(peers[0], p.InitiateReconContext(ctx, peers[0]))
+		return
+	}
+
+	round := &gossipRound{}
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer net.Addr) {
+			defer wg.Done()
+			p.logGossipErr(peer, p.initiateRecon(ctx, peer, sessionOptions{round: round}))
+		}(peer)
+	}
+	wg.Wait()
+	p.deliverRound(round)
 }
 
+func (p *Peer) logGossipErr(peer net.Addr, err error) {
+	if isBusy(err) {
+		p.logErr(GOSSIP, err).Debug()
+	} else if err != nil {
+		p.logErr(GOSSIP, err).Errorf("recon with %v failed", peer)
+	}
+}
+
+// gossipRound collects the elements recovered in concurrent recon sessions.
+type gossipRound struct {
+	mu      sync.Mutex
+	results []*roundResult
+}
+
+type roundResult struct {
+	session *session
+	items   []*cf.Zp
+	records []*Record
+}
+
+func (r *gossipRound) add(s *session, items []*cf.Zp, records []*Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, &roundResult{session: s, items: items, records: records})
+}
+
+// deliverRound delivers the elements recovered in a gossip round. An element
+// recovered from several partners is delivered once, attributed to the
+// first session which recovered it.
+func (p *Peer) deliverRound(r *gossipRound) {
+	seen := cf.NewZSet()
+	for _, result := range r.results {
+		var items []*cf.Zp
+		for _, z := range result.items {
+			if !seen.Has(z) {
+				seen.Add(z)
+				items = append(items, z)
+			}
+		}
+		err := p.recoverItems(result.session, items, recordsOf(items, result.records))
+		if err != nil {
+			p.logErr(GOSSIP, err).Error("cannot deliver recovered elements")
+			return
+		}
+	}
+}
+
+// InitiateRecon connects to the remote peer at addr and reconciles with it,
+// acting as the client.
 func (p *Peer) InitiateRecon(addr net.Addr) error {
+	return p.InitiateReconContext(context.Background(), addr)
+}
+
+// InitiateReconContext is like InitiateRecon, but the session is abandoned
+// when ctx is done. A deadline on ctx bounds dialing and all reads and writes
+// in the session.
+func (p *Peer) InitiateReconContext(ctx context.Context, addr net.Addr) error {
+	return p.initiateRecon(ctx, addr, sessionOptions{})
+}
+
+// sessionOptions modify how a recon session is initiated.
+type sessionOptions struct {
+	// round collects recovered elements, rather than delivering them.
+	round *gossipRound
+
+	// dryRun collects the differences found, rather than recovering them.
+	dryRun *dryRun
+
+	// direction overrides the direction configured for the partner.
+	direction Direction
+
+	// conn is used for the session, rather than dialing the remote peer.
+	conn net.Conn
+
+	// replay sends the recorded messages of a replayed session, and
+	// does not deliver recovered elements.
+	replay *replayedLocal
+}
+
+// InitiateReconDirection is like InitiateReconContext, but restricts the
+// flow of elements in the session to direction, rather than the direction
+// configured for the partner.
+func (p *Peer) InitiateReconDirection(ctx context.Context, addr net.Addr, direction Direction) error {
+	if !direction.valid() {
+		return errgo.Newf("invalid direction %q", direction)
+	}
+	if direction == DirectionBoth {
+		// Distinguish an explicit DirectionBoth from no override.
+		direction = directionBothExplicit
+	}
+	return p.initiateRecon(ctx, addr, sessionOptions{direction: direction})
+}
+
+// initiateRecon initiates a recon session with the remote peer at addr.
+func (p *Peer) initiateRecon(ctx context.Context, addr net.Addr, opts sessionOptions) (_err error) {
+	ctx, cancel := p.sessionContext(ctx)
+	defer cancel()
+	var s *session
+	defer func() {
+		if opts.dryRun == nil && opts.conn == nil {
+			p.partners.record(addr, s, _err, time.Duration(p.getSettings().GossipIntervalSecs)*time.Second)
+		}
+	}()
+	defer p.recordSession(GOSSIP)(&_err)
+	defer func() {
+		_err = contextErr(ctx, _err)
+	}()
+
 	p.log(GOSSIP).Debugf("initiating recon with peer %v", addr)
-	conn, err := net.DialTimeout(addr.Network(), addr.String(), 30*time.Second)
-	if err != nil {
-		return errgo.Mask(err)
+	conn := opts.conn
+	if conn == nil {
+		timeouts := p.getSettings().sessionTimeouts(addr, p.partnerIPs())
+		dialCtx, cancelDial := context.WithTimeout(ctx, timeouts.dial)
+		var err error
+		conn, err = p.getDialer().DialContext(dialCtx, addr.Network(), addr.String())
+		cancelDial()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		setKeepAlive(conn, timeouts.keepAlive)
 	}
+	// Identify the remote peer by the address dialed, which may differ from
+	// the remote address of the connection provided by a custom Dialer.
+	conn = newContextConn(ctx, &addrConn{Conn: conn, remoteAddr: addr})
 	defer conn.Close()
+	s, conn = p.newSession(GOSSIP, conn)
+	s.round = opts.round
+	s.dryRun = opts.dryRun
+	s.replay = opts.replay
+	s.direction = opts.direction
+	if s.dryRun != nil {
+		s.direction = DirectionBoth
+	} else if s.direction == "" {
+		s.direction = s.settings.partnerDirection(addr, p.partnerIPs())
+	} else if s.direction == directionBothExplicit {
+		s.direction = DirectionBoth
+	}
+	defer func() {
+		p.endSession(s, _err)
+	}()
+
+	remoteConfig, err := p.handleConfig(s, conn, "")
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if s.dryRun != nil {
+		if remoteConfig.Custom[customDryRun] == "" {
+			return errgo.WithCausef(nil, ErrIncompatiblePeer, "remote peer does not support dry run")
+		}
+		s.dryRun.remoteConfig = remoteConfig
+	}
 
-	remoteConfig, err := p.handleConfig(conn, GOSSIP, "")
+	err = p.exchangeMembership(s, conn, remoteConfig)
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Any)
 	}
 
 	// Interact with peer
-	return p.clientRecon(conn, remoteConfig)
+	return p.clientRecon(s, conn, remoteConfig)
 }
 
 type msgProgress struct {
@@ -144,23 +327,32 @@ func msgTypes(messages []ReconMsg) []string {
 
 type msgProgressChan chan *msgProgress
 
-func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config) error {
+func (p *Peer) clientRecon(s *session, conn net.Conn, remoteConfig *Config) error {
 	w := bufio.NewWriter(conn)
 	respSet := cf.NewZSet()
+	var records []*Record
 	defer func() {
-		p.sendItems(respSet.Items(), conn, remoteConfig)
+		p.sendItems(s, respSet.Items(), records)
 	}()
 
 	var pendingMessages []ReconMsg
-	for step := range p.interactWithServer(conn) {
+	var done bool
+	for step := range p.interactWithServer(s, conn) {
 		if step.err != nil {
 			if step.err == ErrReconDone {
 				p.log(GOSSIP).Info("reconcilation done")
+				done = true
 				break
 			} else {
-				err := WriteMsg(w, &Error{&textMsg{Text: step.err.Error()}})
-				if err != nil {
-					p.logErr(GOSSIP, err).Error()
+				// Errors reported by the remote peer are not echoed back.
+				if _, ok := step.err.(*RemoteError); !ok {
+					err := p.writeMsg(w, &Error{
+						textMsg: &textMsg{Text: step.err.Error()},
+						Code:    errorCode(step.err),
+					})
+					if err != nil {
+						p.logErr(GOSSIP, err).Error()
+					}
 				}
 				p.logErr(GOSSIP, step.err).Error("step error")
 				break
@@ -169,7 +361,7 @@ func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config) error {
 			pendingMessages = append(pendingMessages, step.messages...)
 			if step.flush {
 				for _, msg := range pendingMessages {
-					err := WriteMsg(w, msg)
+					err := p.writeMsg(w, msg)
 					if err != nil {
 						return errgo.Mask(err)
 					}
@@ -186,10 +378,39 @@ func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config) error {
 		respSet.AddAll(step.elements)
 		p.log(GOSSIP).Infof("recover set now %d elements", respSet.Len())
 	}
+
+	if done && s.dryRun != nil {
+		// The remote peer reports the elements it needs.
+		p.setReadDeadline(conn, s.timeouts.read)
+		msg, err := p.readMsg(s, conn)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		elements, ok := msg.(*Elements)
+		if !ok {
+			return errgo.Newf("expected Elements, got %v", msg)
+		}
+		s.dryRun.remoteNeeds = elements.ZSet
+		return nil
+	}
+	if done && p.contentFetchEnabled(s, remoteConfig) {
+		readMsg := func() (ReconMsg, error) {
+			p.setReadDeadline(conn, s.timeouts.read)
+			return p.readMsg(s, conn)
+		}
+		err := p.serveContent(GOSSIP, w, readMsg)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		records, err = p.fetchContent(GOSSIP, w, readMsg, s.accept(respSet).Items())
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
 	return nil
 }
 
-func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
+func (p *Peer) interactWithServer(s *session, conn net.Conn) msgProgressChan {
 	out := make(msgProgressChan)
 	go func() {
 		defer close(out)
@@ -197,8 +418,8 @@ func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
 		var resp *msgProgress
 		var n int
 		for (resp == nil || resp.err == nil) && n < maxRecoverSize {
-			p.setReadDeadline(conn, defaultTimeout)
-			msg, err := ReadMsg(conn)
+			p.setReadDeadline(conn, s.timeouts.read)
+			msg, err := p.readMsg(s, conn)
 			if err != nil {
 				p.logErr(GOSSIP, err).Error("interact: read msg")
 				out <- &msgProgress{err: err}
@@ -207,9 +428,9 @@ func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
 			p.logFields(GOSSIP, log.Fields{"msg": msg}).Debug("interact")
 			switch m := msg.(type) {
 			case *ReconRqstPoly:
-				resp = p.handleReconRqstPoly(m)
+				resp = p.handleReconRqstPoly(s, m)
 			case *ReconRqstFull:
-				resp = p.handleReconRqstFull(m)
+				resp = p.handleReconRqstFull(s, m)
 			case *Elements:
 				p.logFields(GOSSIP, log.Fields{"nelements": m.ZSet.Len()}).Debug()
 				resp = &msgProgress{elements: m.ZSet}
@@ -217,6 +438,8 @@ func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
 				resp = &msgProgress{err: ErrReconDone}
 			case *Flush:
 				resp = &msgProgress{elements: cf.NewZSet(), flush: true}
+			case *Error:
+				resp = &msgProgress{err: m.Err()}
 			default:
 				resp = &msgProgress{err: errgo.Newf("unexpected message: %v", m)}
 			}
@@ -230,7 +453,7 @@ func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
 var ErrReconRqstPolyNotFound = errors.New(
 	"peer should not receive a request for a non-existant node in ReconRqstPoly")
 
-func (p *Peer) handleReconRqstPoly(rp *ReconRqstPoly) *msgProgress {
+func (p *Peer) handleReconRqstPoly(s *session, rp *ReconRqstPoly) *msgProgress {
 	remoteSize := rp.Size
 	points := p.ptree.Points()
 	remoteSamples := rp.Samples
@@ -244,7 +467,8 @@ func (p *Peer) handleReconRqstPoly(rp *ReconRqstPoly) *msgProgress {
 		remoteSamples, localSamples, remoteSize, localSize, points)
 	if errgo.Cause(err) == cf.ErrLowMBar {
 		p.log(GOSSIP).Info("ReconRqstPoly: low MBar")
-		if node.IsLeaf() || node.Size() < (p.settings.ThreshMult*p.settings.MBar) {
+		p.getMetrics().LowMBar()
+		if node.IsLeaf() || node.Size() < s.settings.SplitThreshold() {
 			p.logFields(GOSSIP, log.Fields{
 				"node": node.Key(),
 			}).Info("sending full elements")
@@ -252,6 +476,7 @@ func (p *Peer) handleReconRqstPoly(rp *ReconRqstPoly) *msgProgress {
 			if err != nil {
 				return &msgProgress{err: errgo.Mask(err)}
 			}
+			s.recordPrefix(rp.Prefix)
 			return &msgProgress{elements: cf.NewZSet(), messages: []ReconMsg{
 				&FullElements{ZSet: cf.NewZSet(elements...)}}}
 		} else {
@@ -260,10 +485,14 @@ func (p *Peer) handleReconRqstPoly(rp *ReconRqstPoly) *msgProgress {
 	}
 	if err != nil {
 		p.logErr(GOSSIP, err).Info("ReconRqstPoly: sending SyncFail")
+		p.getMetrics().SyncFail(rp.Prefix.BitLen() / s.settings.BitQuantum)
+		p.observe(func(o PeerObserver) { o.SyncFailed(&s.SessionInfo, rp.Prefix) })
 		return &msgProgress{elements: cf.NewZSet(), messages: []ReconMsg{&SyncFail{}}}
 	}
 	p.logFields(GOSSIP, log.Fields{"localSet": localSet, "remoteSet": remoteSet}).Info("ReconRqstPoly: solved")
-	return &msgProgress{elements: remoteSet, messages: []ReconMsg{&Elements{ZSet: localSet}}}
+	p.observe(func(o PeerObserver) { o.Solved(&s.SessionInfo, rp.Prefix, remoteSet.Len(), localSet.Len()) })
+	s.recordPrefix(rp.Prefix)
+	return &msgProgress{elements: remoteSet, messages: []ReconMsg{&Elements{ZSet: s.provide(localSet)}}}
 }
 
 func (p *Peer) solve(remoteSamples, localSamples []*cf.Zp, remoteSize, localSize int, points []*cf.Zp) (*cf.ZSet, *cf.ZSet, error) {
@@ -279,7 +508,7 @@ func (p *Peer) solve(remoteSamples, localSamples []*cf.Zp, remoteSize, localSize
 	return cf.Reconcile(values, points, remoteSize-localSize)
 }
 
-func (p *Peer) handleReconRqstFull(rf *ReconRqstFull) *msgProgress {
+func (p *Peer) handleReconRqstFull(s *session, rf *ReconRqstFull) *msgProgress {
 	var localset *cf.ZSet
 	node, err := p.ptree.Node(rf.Prefix)
 	if err == ErrNodeNotFound {
@@ -295,9 +524,10 @@ func (p *Peer) handleReconRqstFull(rf *ReconRqstFull) *msgProgress {
 	}
 	localNeeds := cf.ZSetDiff(rf.Elements, localset)
 	remoteNeeds := cf.ZSetDiff(localset, rf.Elements)
+	s.recordPrefix(rf.Prefix)
 	p.logFields(GOSSIP, log.Fields{
 		"localNeeds":  localNeeds.Len(),
 		"remoteNeeds": remoteNeeds.Len(),
 	}).Info("ReconRqstFull")
-	return &msgProgress{elements: localNeeds, messages: []ReconMsg{&Elements{ZSet: remoteNeeds}}}
+	return &msgProgress{elements: localNeeds, messages: []ReconMsg{&Elements{ZSet: s.provide(remoteNeeds)}}}
 }
@@ -0,0 +1,121 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// RecoverJournal durably records recovered elements from the time they are
+// recovered until the consumer of RecoverChan has processed them, so that
+// they are not lost if the process exits in between. Elements are removed
+// from the journal once acknowledged with Peer.Ack.
+type RecoverJournal interface {
+	// Append records the elements in r, along with the remote peer they
+	// were recovered from.
+	Append(r *Recover) error
+
+	// Remove removes the elements in r from the journal.
+	Remove(r *Recover) error
+
+	// Replay returns the recoveries recorded in the journal which have not
+	// been removed.
+	Replay() ([]*Recover, error)
+}
+
+const JOURNAL = "journal"
+
+// SetJournal sets the journal of recovered elements. Recoveries left in the
+// journal are delivered again on RecoverChan when the peer is started. With a
+// journal, each Recover must be acknowledged with Ack, as if the RecoverAck
+// setting were enabled.
+func (p *Peer) SetJournal(j RecoverJournal) {
+	p.muHooks.Lock()
+	defer p.muHooks.Unlock()
+	p.recoverJournal = j
+}
+
+func (p *Peer) getJournal() RecoverJournal {
+	p.muHooks.RLock()
+	defer p.muHooks.RUnlock()
+	return p.recoverJournal
+}
+
+// journal appends r to the journal, if there is one. Failure to journal is
+// logged, but does not prevent delivery.
+func (p *Peer) journal(role string, r *Recover) {
+	j := p.getJournal()
+	if j == nil {
+		return
+	}
+	err := j.Append(r)
+	if err != nil {
+		p.logErr(role, err).Error("cannot journal recovered elements")
+	}
+}
+
+// unjournal removes r from the journal, if there is one.
+func (p *Peer) unjournal(r *Recover) {
+	j := p.getJournal()
+	if j == nil {
+		return
+	}
+	err := j.Remove(r)
+	if err != nil {
+		p.logErr(JOURNAL, err).Error("cannot remove recovered elements from journal")
+	}
+}
+
+// replayJournal delivers the recoveries left in the journal on RecoverChan.
+func (p *Peer) replayJournal() error {
+	j := p.getJournal()
+	if j == nil {
+		return nil
+	}
+	recovers, err := j.Replay()
+	if err != nil {
+		p.logErr(JOURNAL, err).Error("cannot replay journal")
+		return nil
+	}
+	for _, r := range recovers {
+		r.Dataset = p.getSettings().Dataset
+		fresh, err := p.recoverQ.reserve(r.RemoteElements, p.t.Dying())
+		if err != nil {
+			return nil
+		} else if len(fresh) == 0 {
+			continue
+		}
+		if len(fresh) < len(r.RemoteElements) {
+			r.RemoteRecords = recordsOf(fresh, r.RemoteRecords)
+			r.RemoteElements = fresh
+		}
+		p.logFields(JOURNAL, log.Fields{
+			"remoteAddr": r.RemoteAddr,
+			"elements":   len(r.RemoteElements),
+		}).Info("replaying recovered elements")
+		err = p.deliver(JOURNAL, r)
+		if err != nil {
+			return nil
+		}
+	}
+	return nil
+}
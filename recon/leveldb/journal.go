@@ -0,0 +1,173 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package leveldb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+)
+
+// syncWrite makes journal writes durable before they return.
+var syncWrite = &opt.WriteOptions{Sync: true}
+
+// Journal is a recon.RecoverJournal stored in a leveldb database. Each
+// journaled element is stored under its own key, so that coalesced and
+// partially acknowledged recoveries are tracked accurately.
+type Journal struct {
+	db *leveldb.DB
+}
+
+var _ recon.RecoverJournal = (*Journal)(nil)
+
+type journalEntry struct {
+	Network string
+	Addr    string
+	Config  *recon.Config
+
+	HasContent bool
+	Content    []byte
+}
+
+// OpenJournal opens the journal database at path, creating it if necessary.
+func OpenJournal(path string) (*Journal, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &Journal{db: db}, nil
+}
+
+// Close closes the journal database.
+func (j *Journal) Close() error {
+	return j.db.Close()
+}
+
+func journalKey(z *cf.Zp) []byte {
+	var buf bytes.Buffer
+	err := recon.WriteZp(&buf, z)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Append implements recon.RecoverJournal.
+func (j *Journal) Append(r *recon.Recover) error {
+	content := make(map[string][]byte)
+	for _, record := range r.RemoteRecords {
+		content[record.Element.String()] = record.Content
+	}
+
+	batch := new(leveldb.Batch)
+	for _, z := range r.RemoteElements {
+		entry := journalEntry{Config: r.RemoteConfig}
+		if r.RemoteAddr != nil {
+			entry.Network = r.RemoteAddr.Network()
+			entry.Addr = r.RemoteAddr.String()
+		}
+		entry.Content, entry.HasContent = content[z.String()]
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(&entry)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		batch.Put(journalKey(z), buf.Bytes())
+	}
+	return errgo.Mask(j.db.Write(batch, syncWrite))
+}
+
+// Remove implements recon.RecoverJournal.
+func (j *Journal) Remove(r *recon.Recover) error {
+	batch := new(leveldb.Batch)
+	for _, z := range r.RemoteElements {
+		batch.Delete(journalKey(z))
+	}
+	return errgo.Mask(j.db.Write(batch, syncWrite))
+}
+
+// Replay implements recon.RecoverJournal. Journaled elements are grouped
+// into a recovery for each remote peer.
+func (j *Journal) Replay() ([]*recon.Recover, error) {
+	var result []*recon.Recover
+	byAddr := make(map[string]*recon.Recover)
+
+	iter := j.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		z, err := recon.ReadZp(bytes.NewBuffer(iter.Key()))
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid journal key")
+		}
+		var entry journalEntry
+		err = gob.NewDecoder(bytes.NewBuffer(iter.Value())).Decode(&entry)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid journal entry for %v", z)
+		}
+
+		key := entry.Network + " " + entry.Addr
+		r, ok := byAddr[key]
+		if !ok {
+			r = &recon.Recover{
+				RemoteAddr:   journalAddr(entry.Network, entry.Addr),
+				RemoteConfig: entry.Config,
+			}
+			byAddr[key] = r
+			result = append(result, r)
+		}
+		r.RemoteElements = append(r.RemoteElements, z)
+		if entry.HasContent {
+			r.RemoteRecords = append(r.RemoteRecords, &recon.Record{Element: z, Content: entry.Content})
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// addr is a network address restored from the journal.
+type addr struct {
+	network, address string
+}
+
+func (a *addr) Network() string { return a.network }
+func (a *addr) String() string  { return a.address }
+
+func journalAddr(network, address string) net.Addr {
+	switch network {
+	case "":
+		return nil
+	case "tcp", "tcp4", "tcp6":
+		if tcpAddr, err := net.ResolveTCPAddr(network, address); err == nil {
+			return tcpAddr
+		}
+	}
+	return &addr{network: network, address: address}
+}
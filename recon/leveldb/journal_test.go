@@ -0,0 +1,139 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package leveldb
+
+import (
+	"net"
+	"path/filepath"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+	"gopkg.in/hockeypuck/conflux.v2/recon"
+)
+
+type JournalSuite struct{}
+
+var _ = gc.Suite(&JournalSuite{})
+
+func (s *JournalSuite) openJournal(c *gc.C) *Journal {
+	j, err := OpenJournal(filepath.Join(c.MkDir(), "journal"))
+	c.Assert(err, gc.IsNil)
+	return j
+}
+
+func (s *JournalSuite) TestReplay(c *gc.C) {
+	j := s.openJournal(c)
+	defer j.Close()
+
+	addr1 := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370}
+	addr2 := &net.TCPAddr{IP: net.ParseIP("10.4.5.6"), Port: 11370}
+	config := &recon.Config{Version: "1.1.3", HTTPPort: 11371, BitQuantum: 2, MBar: 5}
+	z1, z2, z3 := cf.Zi(cf.P_SKS, 65537), cf.Zi(cf.P_SKS, 65539), cf.Zi(cf.P_SKS, 65541)
+
+	c.Assert(j.Append(&recon.Recover{
+		RemoteAddr:     addr1,
+		RemoteConfig:   config,
+		RemoteElements: []*cf.Zp{z1, z2},
+		RemoteRecords:  []*recon.Record{{Element: z2, Content: []byte("two")}},
+	}), gc.IsNil)
+	c.Assert(j.Append(&recon.Recover{
+		RemoteAddr:     addr2,
+		RemoteConfig:   config,
+		RemoteElements: []*cf.Zp{z3},
+	}), gc.IsNil)
+	c.Assert(j.Remove(&recon.Recover{RemoteElements: []*cf.Zp{z1}}), gc.IsNil)
+
+	recovers, err := j.Replay()
+	c.Assert(err, gc.IsNil)
+	c.Assert(recovers, gc.HasLen, 2)
+	byAddr := make(map[string]*recon.Recover)
+	for _, r := range recovers {
+		byAddr[r.RemoteAddr.String()] = r
+		c.Assert(r.RemoteConfig, gc.DeepEquals, config)
+	}
+
+	r1 := byAddr[addr1.String()]
+	c.Assert(r1.RemoteElements, gc.HasLen, 1)
+	c.Assert(r1.RemoteElements[0].Cmp(z2), gc.Equals, 0)
+	c.Assert(r1.RemoteRecords, gc.HasLen, 1)
+	c.Assert(string(r1.RemoteRecords[0].Content), gc.Equals, "two")
+	hkpAddr, err := r1.HkpAddr()
+	c.Assert(err, gc.IsNil)
+	c.Assert(hkpAddr, gc.Equals, "10.1.2.3:11371")
+
+	r2 := byAddr[addr2.String()]
+	c.Assert(r2.RemoteElements, gc.HasLen, 1)
+	c.Assert(r2.RemoteElements[0].Cmp(z3), gc.Equals, 0)
+	c.Assert(r2.RemoteRecords, gc.HasLen, 0)
+}
+
+func (s *JournalSuite) TestPeerReplay(c *gc.C) {
+	s.testPeerReplay(c, true)
+}
+
+func (s *JournalSuite) TestPeerReplayImpliesAck(c *gc.C) {
+	// A journal holds recoveries until acknowledged, even without
+	// RecoverAck.
+	s.testPeerReplay(c, false)
+}
+
+func (s *JournalSuite) testPeerReplay(c *gc.C, recoverAck bool) {
+	j := s.openJournal(c)
+	defer j.Close()
+	z := cf.Zi(cf.P_SKS, 65537)
+	c.Assert(j.Append(&recon.Recover{
+		RemoteAddr:     &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370},
+		RemoteConfig:   &recon.Config{HTTPPort: 11371},
+		RemoteElements: []*cf.Zp{z},
+	}), gc.IsNil)
+
+	settings := recon.DefaultSettings()
+	settings.RecoverAck = recoverAck
+	settings.GossipIntervalSecs = 3600
+	tree := new(recon.MemPrefixTree)
+	tree.Init()
+	peer := recon.NewPeer(settings, tree)
+	peer.SetJournal(j)
+	peer.StartMode(recon.PeerModeGossipOnly)
+	defer peer.Stop()
+
+	var r *recon.Recover
+	select {
+	case r = <-peer.RecoverChan:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for journal replay")
+	}
+	c.Assert(r.RemoteElements, gc.HasLen, 1)
+	c.Assert(r.RemoteElements[0].Cmp(z), gc.Equals, 0)
+
+	// Unacknowledged recoveries remain in the journal.
+	recovers, err := j.Replay()
+	c.Assert(err, gc.IsNil)
+	c.Assert(recovers, gc.HasLen, 1)
+
+	peer.Ack(r)
+	recovers, err = j.Replay()
+	c.Assert(err, gc.IsNil)
+	c.Assert(recovers, gc.HasLen, 0)
+}
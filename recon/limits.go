@@ -0,0 +1,218 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+const (
+	rejectTooManySessions      = "too many sessions"
+	rejectTooManySessionsForIP = "too many sessions from your address"
+	rejectRateLimited          = "connection rate limit exceeded"
+)
+
+// maxPendingRejects bounds the number of connections being rejected
+// concurrently. Connections rejected beyond this are closed without a reply.
+var maxPendingRejects = 64
+
+// maxPendingProxyHeaders bounds the number of PROXY headers read
+// concurrently from trusted proxies. Connections beyond this are closed.
+var maxPendingProxyHeaders = 64
+
+// sessionLimiter limits the sessions accepted by a peer, globally, per
+// remote IP address, and by the rate at which connections are accepted.
+type sessionLimiter struct {
+	mu        sync.Mutex
+	active    int
+	perIP     map[string]int
+	tokens    float64
+	last      time.Time
+	rejecting int
+	proxying  int
+}
+
+func newSessionLimiter() *sessionLimiter {
+	return &sessionLimiter{perIP: make(map[string]int)}
+}
+
+// acquire admits a session from ip, if not nil, within the limits in
+// settings. If admitted, release must be called when the session ends.
+// Otherwise, the reason the session was not admitted is returned.
+func (l *sessionLimiter) acquire(settings *Settings, ip net.IP, now time.Time) (release func(), reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if settings.AcceptRate > 0 {
+		burst := float64(settings.AcceptBurst)
+		if burst < 1 {
+			burst = settings.AcceptRate
+			if burst < 1 {
+				burst = 1
+			}
+		}
+		if l.last.IsZero() {
+			l.tokens = burst
+		} else {
+			l.tokens += now.Sub(l.last).Seconds() * settings.AcceptRate
+			if l.tokens > burst {
+				l.tokens = burst
+			}
+		}
+		l.last = now
+		if l.tokens < 1 {
+			return nil, rejectRateLimited
+		}
+		l.tokens--
+	}
+
+	if settings.MaxConcurrentSessions > 0 && l.active >= settings.MaxConcurrentSessions {
+		return nil, rejectTooManySessions
+	}
+	var key string
+	if ip != nil {
+		key = ip.String()
+		if settings.MaxSessionsPerIP > 0 && l.perIP[key] >= settings.MaxSessionsPerIP {
+			return nil, rejectTooManySessionsForIP
+		}
+		l.perIP[key]++
+	}
+	l.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.active--
+			if ip != nil {
+				l.perIP[key]--
+				if l.perIP[key] == 0 {
+					delete(l.perIP, key)
+				}
+			}
+		})
+	}, ""
+}
+
+// startReject returns whether a rejection may be sent, within
+// maxPendingRejects. If so, endReject must be called once it is done.
+func (l *sessionLimiter) startReject() bool {
+	return l.startPending(&l.rejecting, maxPendingRejects)
+}
+
+func (l *sessionLimiter) endReject() {
+	l.endPending(&l.rejecting)
+}
+
+// startProxyRead returns whether a PROXY header may be read, within
+// maxPendingProxyHeaders. If so, endProxyRead must be called once it is read.
+func (l *sessionLimiter) startProxyRead() bool {
+	return l.startPending(&l.proxying, maxPendingProxyHeaders)
+}
+
+func (l *sessionLimiter) endProxyRead() {
+	l.endPending(&l.proxying)
+}
+
+func (l *sessionLimiter) startPending(n *int, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if *n >= max {
+		return false
+	}
+	*n++
+	return true
+}
+
+func (l *sessionLimiter) endPending(n *int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*n--
+}
+
+// rejectEarly rejects a connection before a session is started, without
+// waiting for the remote config. The local config is sent so that the
+// remote peer can complete its side of the handshake, followed by
+// RemoteConfigFailed and reason, with a code and retry-after hint.
+func (p *Peer) rejectEarly(conn net.Conn, reason string) {
+	defer conn.Close()
+	p.logFields(SERVE, log.Fields{
+		"remoteAddr": conn.RemoteAddr(),
+		"reason":     reason,
+	}).Warning("connection rejected")
+	info := &SessionInfo{Role: SERVE, RemoteAddr: conn.RemoteAddr(), Start: time.Now()}
+	p.observe(func(o PeerObserver) { o.HandshakeRejected(info, reason, false) })
+
+	settings := p.getSettings()
+	config, err := p.config(settings)
+	if err != nil {
+		p.logErr(SERVE, err).Error()
+		return
+	}
+	err = conn.SetDeadline(time.Now().Add(settings.sessionTimeouts(conn.RemoteAddr(), p.partnerIPs()).reject))
+	if err != nil {
+		p.logErr(SERVE, err).Debug()
+	}
+	// Drain what the remote peer sends while rejecting, so that neither side
+	// blocks on writing, and the rejection is not lost to a connection reset.
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		io.Copy(ioutil.Discard, io.LimitReader(conn, 64*1024))
+	}()
+	defer func() { <-drained }()
+
+	code, retryAfter := ErrorCodeBusy, busyRetryAfter
+	if reason == rejectRateLimited {
+		// A token is available to the remote peer after this long.
+		code, retryAfter = ErrorCodeRateLimited, time.Duration(float64(time.Second)/settings.AcceptRate)
+	}
+
+	w := bufio.NewWriter(conn)
+	err = p.writeMsg(w, config)
+	if err == nil {
+		err = WriteString(w, RemoteConfigFailed)
+	}
+	if err == nil {
+		err = WriteString(w, formatReason(reason, code, retryAfter))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		p.logErr(SERVE, err).Debug("cannot reject connection")
+		return
+	}
+	if cw, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+	}
+}
@@ -0,0 +1,123 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type LimitsSuite struct{}
+
+var _ = gc.Suite(&LimitsSuite{})
+
+func (s *LimitsSuite) TestSessionLimits(c *gc.C) {
+	settings := DefaultSettings()
+	settings.MaxConcurrentSessions = 3
+	settings.MaxSessionsPerIP = 2
+	l := newSessionLimiter()
+	now := time.Now()
+	ipA, ipB := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	releaseA1, reason := l.acquire(settings, ipA, now)
+	c.Assert(reason, gc.Equals, "")
+	_, reason = l.acquire(settings, ipA, now)
+	c.Assert(reason, gc.Equals, "")
+	_, reason = l.acquire(settings, ipA, now)
+	c.Assert(reason, gc.Equals, rejectTooManySessionsForIP)
+	_, reason = l.acquire(settings, ipB, now)
+	c.Assert(reason, gc.Equals, "")
+	_, reason = l.acquire(settings, nil, now)
+	c.Assert(reason, gc.Equals, rejectTooManySessions)
+
+	releaseA1()
+	releaseA1()
+	_, reason = l.acquire(settings, ipA, now)
+	c.Assert(reason, gc.Equals, "")
+	_, reason = l.acquire(settings, ipB, now)
+	c.Assert(reason, gc.Equals, rejectTooManySessions)
+}
+
+func (s *LimitsSuite) TestAcceptRate(c *gc.C) {
+	settings := DefaultSettings()
+	settings.AcceptRate = 2
+	settings.AcceptBurst = 3
+	l := newSessionLimiter()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		release, reason := l.acquire(settings, nil, now)
+		c.Assert(reason, gc.Equals, "")
+		release()
+	}
+	_, reason := l.acquire(settings, nil, now)
+	c.Assert(reason, gc.Equals, rejectRateLimited)
+
+	now = now.Add(500 * time.Millisecond)
+	_, reason = l.acquire(settings, nil, now)
+	c.Assert(reason, gc.Equals, "")
+	_, reason = l.acquire(settings, nil, now)
+	c.Assert(reason, gc.Equals, rejectRateLimited)
+}
+
+func (s *LimitsSuite) TestPendingRejects(c *gc.C) {
+	defer func(n int) { maxPendingRejects = n }(maxPendingRejects)
+	maxPendingRejects = 2
+	l := newSessionLimiter()
+	c.Assert(l.startReject(), gc.Equals, true)
+	c.Assert(l.startReject(), gc.Equals, true)
+	c.Assert(l.startReject(), gc.Equals, false)
+	l.endReject()
+	c.Assert(l.startReject(), gc.Equals, true)
+	c.Assert(l.startReject(), gc.Equals, false)
+}
+
+func (s *LimitsSuite) TestRejectEarly(c *gc.C) {
+	network := newPipeNetwork()
+	server := newTestPeer(c, cf.Zi(cf.P_SKS, 65537))
+	server.settings.AcceptRate = 1
+	server.settings.AcceptBurst = 1
+	server.SetListener(network)
+	server.t.Go(server.Serve)
+	defer server.Stop()
+
+	client := newTestPeer(c)
+	client.SetDialer(network)
+	defer client.Stop()
+	var obs recordingObserver
+	client.AddObserver(&obs)
+
+	partnerAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370}
+	err := client.InitiateRecon(partnerAddr)
+	c.Assert(err, gc.IsNil)
+	<-client.RecoverChan
+
+	err = client.InitiateRecon(partnerAddr)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrRateLimited)
+	c.Assert(RetryAfter(err), gc.Equals, time.Second)
+	c.Assert(err, gc.ErrorMatches, ".*"+rejectRateLimited+".*")
+	c.Assert(obs.rejected, gc.Equals, rejectRateLimited)
+}
@@ -0,0 +1,330 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+var ErrMembershipAuth error = errors.New("membership authentication failed")
+
+// customMembership is the Config.Custom key used to advertise support for
+// membership exchange.
+const customMembership = "membership"
+
+// customMembershipNonce is the Config.Custom key used to send a nonce, to
+// which Membership messages in the session are bound.
+const customMembershipNonce = "membershipNonce"
+
+// membershipMaxSkew is the maximum age, or clock skew, of an acceptable
+// Membership message.
+const membershipMaxSkew = 5 * time.Minute
+
+// DiscoveredPeer is a peer learned from the partner list of a remote peer.
+type DiscoveredPeer struct {
+	Addr      net.Addr
+	Source    net.Addr
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// membershipView is a bounded set of discovered peers. When full, the peer
+// least recently advertised is evicted.
+type membershipView struct {
+	mu    sync.Mutex
+	peers map[string]*DiscoveredPeer
+}
+
+func newMembershipView() *membershipView {
+	return &membershipView{peers: make(map[string]*DiscoveredPeer)}
+}
+
+func (v *membershipView) add(addr, source net.Addr, capacity int, now time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key := addr.String()
+	if peer, ok := v.peers[key]; ok {
+		peer.Source = source
+		peer.LastSeen = now
+		return
+	}
+	if capacity <= 0 {
+		return
+	}
+	for len(v.peers) >= capacity {
+		var oldest *DiscoveredPeer
+		for _, peer := range v.peers {
+			if oldest == nil || peer.LastSeen.Before(oldest.LastSeen) {
+				oldest = peer
+			}
+		}
+		delete(v.peers, oldest.Addr.String())
+	}
+	v.peers[key] = &DiscoveredPeer{Addr: addr, Source: source, FirstSeen: now, LastSeen: now}
+}
+
+// list returns the discovered peers, sorted by address.
+func (v *membershipView) list() []DiscoveredPeer {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	result := make([]DiscoveredPeer, 0, len(v.peers))
+	for _, peer := range v.peers {
+		result = append(result, *peer)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Addr.String() < result[j].Addr.String()
+	})
+	return result
+}
+
+// DiscoveredPeers returns the peers discovered through membership exchange.
+func (p *Peer) DiscoveredPeers() []DiscoveredPeer {
+	return p.membership.list()
+}
+
+// gossipPartners returns the addresses of configured partners, followed by
+// discovered peers which are not also configured.
+func (p *Peer) gossipPartners() ([]net.Addr, error) {
+	settings := p.getSettings()
+	partners, err := settings.PartnerAddrs()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if settings.MembershipSecret == "" {
+		return partners, nil
+	}
+	known := make(map[string]bool)
+	for _, addr := range partners {
+		known[addr.String()] = true
+	}
+	for _, peer := range p.membership.list() {
+		if !known[peer.Addr.String()] {
+			partners = append(partners, peer.Addr)
+		}
+	}
+	return partners, nil
+}
+
+// newMembershipNonce returns a random nonce identifying one side of a
+// session.
+func newMembershipNonce() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// membershipMAC authenticates msg as sent in a session between peers which
+// sent the nonces sender and receiver, so that it cannot be replayed in
+// another session, or reflected back to its sender.
+func membershipMAC(secret string, msg *Membership, sender, receiver string) []byte {
+	var buf bytes.Buffer
+	msg.marshalBody(&buf)
+	WriteString(&buf, sender)
+	WriteString(&buf, receiver)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(buf.Bytes())
+	return mac.Sum(nil)
+}
+
+// newMembership returns an unsigned Membership message advertising the
+// configured TCP partners in settings, at the addresses in resolved. Only IP
+// addresses are admitted by the remote peer.
+func newMembership(settings *Settings, resolved partnerIPs, now time.Time) *Membership {
+	msg := &Membership{Timestamp: now.Unix()}
+	seen := make(map[string]bool)
+	for name, partner := range settings.Partners {
+		if partner.ReconNet != NetworkDefault && partner.ReconNet != NetworkTCP {
+			continue
+		}
+		_, port, err := net.SplitHostPort(partner.ReconAddr)
+		if err != nil {
+			continue
+		}
+		for _, ip := range resolved[name] {
+			hostPort := net.JoinHostPort(ip.String(), port)
+			if !seen[hostPort] {
+				seen[hostPort] = true
+				msg.Peers = append(msg.Peers, hostPort)
+			}
+		}
+	}
+	sort.Strings(msg.Peers)
+	return msg
+}
+
+func verifyMembership(secret string, msg *Membership, sender, receiver string, now time.Time) error {
+	if !hmac.Equal(msg.MAC, membershipMAC(secret, msg, sender, receiver)) {
+		return errgo.WithCausef(nil, ErrMembershipAuth, "invalid MAC")
+	}
+	skew := now.Sub(time.Unix(msg.Timestamp, 0))
+	if skew > membershipMaxSkew || skew < -membershipMaxSkew {
+		return errgo.WithCausef(nil, ErrMembershipAuth, "timestamp out of range")
+	}
+	return nil
+}
+
+// admitDiscovered returns the address of a discovered peer, or the reason it
+// is not admitted. Only IP addresses are admitted, so that remote peers
+// cannot cause name lookups, and only if allowed by the IP matcher and not
+// denied by the discovery policy.
+func admitDiscovered(settings *Settings, matcher IPMatcher, hostPort string) (net.Addr, string) {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, "invalid address"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, "not an IP address"
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() {
+		return nil, "not a unicast address"
+	}
+	for _, cidr := range settings.DiscoveryDenyCIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err == nil && ipnet.Contains(ip) {
+			return nil, "denied"
+		}
+	}
+	if allowed, reason := matchReason(matcher, ip); !allowed {
+		return nil, reason
+	}
+	addr, err := net.ResolveTCPAddr("tcp", hostPort)
+	if err != nil {
+		return nil, "invalid address"
+	}
+	return addr, ""
+}
+
+// exchangeMembership exchanges partner lists with the remote peer, if
+// enabled on both sides. The initiating peer sends first. A message which
+// fails authentication ends the session, and is answered with an Error coded
+// auth-failed in place of the reply.
+func (p *Peer) exchangeMembership(s *session, conn net.Conn, remoteConfig *Config) error {
+	if s.dryRun != nil || s.config.Custom[customMembership] != "true" || remoteConfig.Custom[customMembership] != "true" {
+		return nil
+	}
+	remoteNonce := remoteConfig.Custom[customMembershipNonce]
+	if s.nonce == "" || remoteNonce == "" {
+		return nil
+	}
+	if s.Role == GOSSIP {
+		err := p.sendMembership(s, conn, remoteNonce)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return p.receiveMembership(s, conn, remoteNonce)
+	}
+	err := p.receiveMembership(s, conn, remoteNonce)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return p.sendMembership(s, conn, remoteNonce)
+}
+
+func (p *Peer) sendMembership(s *session, conn net.Conn, remoteNonce string) error {
+	var msg *Membership
+	if s.replay != nil && s.replay.membership != nil {
+		msg = s.replay.membership
+	} else {
+		msg = newMembership(s.settings, p.partnerIPs(), time.Now())
+		msg.MAC = membershipMAC(s.settings.MembershipSecret, msg, s.nonce, remoteNonce)
+	}
+	w := bufio.NewWriter(conn)
+	err := p.writeMsg(w, msg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(w.Flush())
+}
+
+func (p *Peer) receiveMembership(s *session, conn net.Conn, remoteNonce string) error {
+	p.setReadDeadline(conn, s.timeouts.read)
+	msg, err := p.readMsg(s, conn)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var membership *Membership
+	switch m := msg.(type) {
+	case *Membership:
+		membership = m
+	case *Error:
+		return errgo.Mask(m.Err(), errgo.Any)
+	default:
+		return errgo.Newf("expected Membership, got %v", msg)
+	}
+	if s.replay != nil {
+		return nil
+	}
+	now := time.Now()
+	err = verifyMembership(s.settings.MembershipSecret, membership, remoteNonce, s.nonce, now)
+	if err != nil {
+		w := bufio.NewWriter(conn)
+		werr := p.writeMsg(w, &Error{
+			textMsg: &textMsg{Text: err.Error()},
+			Code:    errorCode(err),
+		})
+		if werr == nil {
+			werr = w.Flush()
+		}
+		if werr != nil {
+			p.logErr(s.Role, werr).Error()
+		}
+		return errgo.Mask(err, errgo.Any)
+	}
+
+	matcher, err := p.getMatcher()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var n int
+	for _, hostPort := range membership.Peers {
+		addr, reason := admitDiscovered(s.settings, matcher, hostPort)
+		if addr == nil {
+			p.logFields(s.Role, log.Fields{
+				"peer":   hostPort,
+				"source": s.RemoteAddr,
+				"reason": reason,
+			}).Debug("discovered peer not admitted")
+			continue
+		}
+		p.membership.add(addr, s.RemoteAddr, s.settings.MaxDiscoveredPeers, now)
+		n++
+	}
+	p.logFields(s.Role, log.Fields{"peers": n, "source": s.RemoteAddr}).Debug("membership received")
+	return nil
+}
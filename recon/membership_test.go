@@ -0,0 +1,151 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type MembershipSuite struct{}
+
+var _ = gc.Suite(&MembershipSuite{})
+
+func (s *MembershipSuite) TestViewBounded(c *gc.C) {
+	v := newMembershipView()
+	source := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 11370}
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 1, byte(i)), Port: 11370}
+		v.add(addr, source, 2, now.Add(time.Duration(i)*time.Second))
+	}
+	peers := v.list()
+	c.Assert(peers, gc.HasLen, 2)
+	c.Assert(peers[0].Addr.String(), gc.Equals, "10.0.1.2:11370")
+	c.Assert(peers[1].Addr.String(), gc.Equals, "10.0.1.3:11370")
+}
+
+func (s *MembershipSuite) TestVerify(c *gc.C) {
+	settings := DefaultSettings()
+	settings.MembershipSecret = "sekrit"
+	settings.Partners["a"] = Partner{ReconAddr: "10.1.2.3:11370"}
+	settings.Partners["b"] = Partner{ReconAddr: "partner.example.com:11370"}
+	settings.Partners["c"] = Partner{ReconAddr: "unresolved.example.com:11370"}
+	resolved := partnerIPs{
+		"a": {net.ParseIP("10.1.2.3")},
+		"b": {net.ParseIP("10.4.5.6"), net.ParseIP("2001:db8::1")},
+	}
+	now := time.Now()
+	msg := newMembership(settings, resolved, now)
+	c.Assert(msg.Peers, gc.DeepEquals, []string{"10.1.2.3:11370", "10.4.5.6:11370", "[2001:db8::1]:11370"})
+	msg.MAC = membershipMAC("sekrit", msg, "sender", "receiver")
+
+	c.Assert(verifyMembership("sekrit", msg, "sender", "receiver", now), gc.IsNil)
+	err := verifyMembership("other", msg, "sender", "receiver", now)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrMembershipAuth)
+	err = verifyMembership("sekrit", msg, "sender", "receiver", now.Add(time.Hour))
+	c.Assert(errgo.Cause(err), gc.Equals, ErrMembershipAuth)
+
+	// Messages are bound to the session in which they were sent.
+	err = verifyMembership("sekrit", msg, "sender", "other", now)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrMembershipAuth)
+	err = verifyMembership("sekrit", msg, "receiver", "sender", now)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrMembershipAuth)
+
+	msg.Peers = append(msg.Peers, "10.6.6.6:11370")
+	err = verifyMembership("sekrit", msg, "sender", "receiver", now)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrMembershipAuth)
+}
+
+func (s *MembershipSuite) TestAdmitDiscovered(c *gc.C) {
+	settings := DefaultSettings()
+	settings.AllowCIDRs = []string{"10.0.0.0/8"}
+	settings.DiscoveryDenyCIDRs = []string{"10.9.0.0/16"}
+	matcher, err := settings.Matcher()
+	c.Assert(err, gc.IsNil)
+	for hostPort, reason := range map[string]string{
+		"10.1.2.3:11370":    "",
+		"10.9.1.1:11370":    "denied",
+		"192.168.1.1:11370": "not allowed",
+		"127.0.0.1:11370":   "not a unicast address",
+		"example.com:11370": "not an IP address",
+		"10.1.2.3":          "invalid address",
+	} {
+		addr, why := admitDiscovered(settings, matcher, hostPort)
+		c.Check(why, gc.Equals, reason, gc.Commentf("%s", hostPort))
+		c.Check(addr != nil, gc.Equals, reason == "", gc.Commentf("%s", hostPort))
+	}
+}
+
+func (s *MembershipSuite) TestExchange(c *gc.C) {
+	server := newTestPeer(c, cf.Zi(cf.P_SKS, 65537))
+	defer server.Stop()
+	server.settings.MembershipSecret = "sekrit"
+	server.settings.Partners["a"] = Partner{ReconAddr: "10.4.5.6:11370"}
+	server.settings.Partners["b"] = Partner{ReconAddr: "192.168.1.1:11370"}
+
+	client := newTestPeer(c)
+	defer client.Stop()
+	client.settings.MembershipSecret = "sekrit"
+	client.settings.AllowCIDRs = []string{"10.0.0.0/8"}
+
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+	r := <-client.RecoverChan
+	c.Assert(r.RemoteElements, gc.HasLen, 1)
+
+	peers := client.DiscoveredPeers()
+	c.Assert(peers, gc.HasLen, 1)
+	c.Assert(peers[0].Addr.String(), gc.Equals, "10.4.5.6:11370")
+	c.Assert(peers[0].Source.String(), gc.Equals, "10.1.2.3:11370")
+	partners, err := client.gossipPartners()
+	c.Assert(err, gc.IsNil)
+	c.Assert(partners, gc.HasLen, 1)
+	c.Assert(partners[0].String(), gc.Equals, "10.4.5.6:11370")
+	c.Assert(server.DiscoveredPeers(), gc.HasLen, 0)
+}
+
+func (s *MembershipSuite) TestExchangeSecretMismatch(c *gc.C) {
+	server := newTestPeer(c, cf.Zi(cf.P_SKS, 65537))
+	defer server.Stop()
+	server.settings.MembershipSecret = "sekrit"
+	server.settings.Partners["a"] = Partner{ReconAddr: "10.4.5.6:11370"}
+
+	client := newTestPeer(c)
+	defer client.Stop()
+	client.settings.MembershipSecret = "other"
+	client.settings.AllowCIDRs = []string{"10.0.0.0/8"}
+
+	// The server rejects the membership of the client, and tells it why.
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(errgo.Cause(serverErr), gc.Equals, ErrMembershipAuth)
+	c.Assert(errgo.Cause(clientErr), gc.Equals, ErrMembershipAuth)
+	c.Assert(clientErr, gc.ErrorMatches, ".*invalid MAC: membership authentication failed")
+	c.Assert(client.RecoverChan, gc.HasLen, 0)
+	c.Assert(client.DiscoveredPeers(), gc.HasLen, 0)
+}
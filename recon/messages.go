@@ -25,9 +25,11 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"sort"
+	"time"
 
 	"gopkg.in/errgo.v1"
 
@@ -40,6 +42,9 @@ var (
 	maxReadLen = 1 << 24
 )
 
+// readChunkLen is the largest read allocated before the data is received.
+const readChunkLen = 1 << 16
+
 func init() {
 	SksZpNbytes = cf.P_SKS.BitLen() / 8
 	if cf.P_SKS.BitLen()%8 != 0 {
@@ -68,6 +73,7 @@ const (
 	MsgTypeDbRqst        = MsgType(8)
 	MsgTypeDbRepl        = MsgType(9)
 	MsgTypeConfig        = MsgType(10)
+	MsgTypeMembership    = MsgType(11)
 )
 
 func (mt MsgType) String() string {
@@ -94,40 +100,45 @@ func (mt MsgType) String() string {
 		return "DbRepl"
 	case MsgTypeConfig:
 		return "Config"
+	case MsgTypeMembership:
+		return "Membership"
+	}
+	if isCustomMsgType(mt) {
+		return fmt.Sprintf("Custom(%d)", uint8(mt))
 	}
 	return "Unknown"
 }
 
 type ReconMsg interface {
 	MsgType() MsgType
-	unmarshal(r io.Reader) error
-	marshal(w io.Writer) error
+	Unmarshal(r io.Reader) error
+	Marshal(w io.Writer) error
 }
 
 type emptyMsg struct{}
 
-func (msg *emptyMsg) unmarshal(r io.Reader) error { return nil }
+func (msg *emptyMsg) Unmarshal(r io.Reader) error { return nil }
 
-func (msg *emptyMsg) marshal(w io.Writer) error { return nil }
+func (msg *emptyMsg) Marshal(w io.Writer) error { return nil }
 
 type textMsg struct{ Text string }
 
-func (msg *textMsg) unmarshal(r io.Reader) (err error) {
+func (msg *textMsg) Unmarshal(r io.Reader) (err error) {
 	msg.Text, err = ReadString(r)
 	return
 }
 
-func (msg *textMsg) marshal(w io.Writer) error {
+func (msg *textMsg) Marshal(w io.Writer) error {
 	return WriteString(w, msg.Text)
 }
 
 type notImplMsg struct{}
 
-func (msg *notImplMsg) unmarshal(r io.Reader) error {
+func (msg *notImplMsg) Unmarshal(r io.Reader) error {
 	panic("not implemented")
 }
 
-func (msg *notImplMsg) marshal(w io.Writer) error {
+func (msg *notImplMsg) Marshal(w io.Writer) error {
 	panic("not implemented")
 }
 
@@ -141,10 +152,46 @@ func ReadInt(r io.Reader) (n int, err error) {
 func ReadLen(r io.Reader) (int, error) {
 	n, err := ReadInt(r)
 	if err != nil {
-		return n, errgo.Mask(err)
+		return n, errgo.Mask(err, errgo.Is(io.EOF))
 	}
 	if n > maxReadLen {
-		return 0, errgo.Newf("read length %d exceeds maximum limit", n)
+		return 0, decodeErrorf("read length %d exceeds maximum limit", n)
+	}
+	return n, nil
+}
+
+// readBytes reads n bytes from r. Large reads are buffered as the data
+// arrives, rather than trusting n for the allocation.
+func readBytes(r io.Reader, n int) ([]byte, error) {
+	if lr, ok := r.(interface {
+		Len() int
+	}); ok && n > lr.Len() {
+		return nil, decodeErrorf("length %d exceeds remaining %d bytes", n, lr.Len())
+	}
+	if n <= readChunkLen {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, r, int64(n))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// readCount reads the number of items which follow, each occupying at least
+// minSize bytes.
+func readCount(r io.Reader, minSize int) (int, error) {
+	n, err := ReadLen(r)
+	if err != nil {
+		return 0, err
+	}
+	if lr, ok := r.(interface {
+		Len() int
+	}); ok && n > lr.Len()/minSize {
+		return 0, decodeErrorf("count %d exceeds remaining %d bytes", n, lr.Len())
 	}
 	return n, nil
 }
@@ -162,8 +209,7 @@ func ReadString(r io.Reader) (string, error) {
 	if err != nil || n == 0 {
 		return "", err
 	}
-	buf := make([]byte, n)
-	_, err = io.ReadFull(r, buf)
+	buf, err := readBytes(r, n)
 	return string(buf), err
 }
 
@@ -181,18 +227,20 @@ func ReadBitstring(r io.Reader) (*cf.Bitstring, error) {
 	if err != nil {
 		return nil, err
 	}
-	bs := cf.NewBitstring(nbits)
 	nbytes, err := ReadLen(r)
 	if err != nil {
 		return nil, err
 	}
-	if nbits == 0 {
-		return bs, nil
+	if nbytes != (nbits+7)/8 {
+		return nil, decodeErrorf("bitstring of %d bits has %d bytes", nbits, nbytes)
 	}
-	buf := make([]byte, nbytes)
-	_, err = io.ReadFull(r, buf)
+	buf, err := readBytes(r, nbytes)
+	if err != nil {
+		return nil, err
+	}
+	bs := cf.NewBitstring(nbits)
 	bs.SetBytes(buf)
-	return bs, err
+	return bs, nil
 }
 
 func WriteBitstring(w io.Writer, bs *cf.Bitstring) (err error) {
@@ -209,16 +257,17 @@ func WriteBitstring(w io.Writer, bs *cf.Bitstring) (err error) {
 }
 
 func ReadZZarray(r io.Reader) ([]*cf.Zp, error) {
-	n, err := ReadLen(r)
+	n, err := readCount(r, SksZpNbytes)
 	if err != nil {
 		return nil, err
 	}
-	arr := make([]*cf.Zp, n)
+	var arr []*cf.Zp
 	for i := 0; i < n; i++ {
-		arr[i], err = ReadZp(r)
+		z, err := ReadZp(r)
 		if err != nil {
 			return nil, err
 		}
+		arr = append(arr, z)
 	}
 	return arr, nil
 }
@@ -247,8 +296,16 @@ func ReadZSet(r io.Reader) (*cf.ZSet, error) {
 	return zset, nil
 }
 
+// WriteZSet writes the elements of zset in sorted order, so that sessions
+// are reproducible.
 func WriteZSet(w io.Writer, zset *cf.ZSet) error {
-	return WriteZZarray(w, zset.Items())
+	return WriteZZarray(w, sortedZp(zset.Items()))
+}
+
+// sortedZp sorts items in place, and returns them.
+func sortedZp(items []*cf.Zp) []*cf.Zp {
+	sort.Slice(items, func(i, j int) bool { return items[i].Cmp(items[j]) < 0 })
+	return items
 }
 
 func ReadZp(r io.Reader) (*cf.Zp, error) {
@@ -257,9 +314,15 @@ func ReadZp(r io.Reader) (*cf.Zp, error) {
 	if err != nil {
 		return nil, err
 	}
-	z := cf.Zb(cf.P_SKS, buf)
-	z.Norm()
-	return z, nil
+	// Elements are little-endian.
+	be := make([]byte, len(buf))
+	for i := range buf {
+		be[len(buf)-1-i] = buf[i]
+	}
+	if new(big.Int).SetBytes(be).Cmp(cf.P_SKS) >= 0 {
+		return nil, decodeErrorf("element %x out of range", buf)
+	}
+	return cf.Zb(cf.P_SKS, buf), nil
 }
 
 func WriteZp(w io.Writer, z *cf.Zp) (err error) {
@@ -290,7 +353,7 @@ func (msg *ReconRqstPoly) String() string {
 		msg.MsgType(), msg.Prefix, msg.Size, msg.Samples)
 }
 
-func (msg *ReconRqstPoly) marshal(w io.Writer) (err error) {
+func (msg *ReconRqstPoly) Marshal(w io.Writer) (err error) {
 	err = WriteBitstring(w, msg.Prefix)
 	if err != nil {
 		return
@@ -303,7 +366,7 @@ func (msg *ReconRqstPoly) marshal(w io.Writer) (err error) {
 	return
 }
 
-func (msg *ReconRqstPoly) unmarshal(r io.Reader) (err error) {
+func (msg *ReconRqstPoly) Unmarshal(r io.Reader) (err error) {
 	msg.Prefix, err = ReadBitstring(r)
 	if err != nil {
 		return
@@ -330,7 +393,7 @@ func (msg *ReconRqstFull) MsgType() MsgType {
 	return MsgTypeReconRqstFull
 }
 
-func (msg *ReconRqstFull) marshal(w io.Writer) (err error) {
+func (msg *ReconRqstFull) Marshal(w io.Writer) (err error) {
 	err = WriteBitstring(w, msg.Prefix)
 	if err != nil {
 		return
@@ -339,7 +402,7 @@ func (msg *ReconRqstFull) marshal(w io.Writer) (err error) {
 	return
 }
 
-func (msg *ReconRqstFull) unmarshal(r io.Reader) (err error) {
+func (msg *ReconRqstFull) Unmarshal(r io.Reader) (err error) {
 	msg.Prefix, err = ReadBitstring(r)
 	if err != nil {
 		return
@@ -360,12 +423,12 @@ func (msg *Elements) MsgType() MsgType {
 	return MsgTypeElements
 }
 
-func (msg *Elements) marshal(w io.Writer) (err error) {
+func (msg *Elements) Marshal(w io.Writer) (err error) {
 	err = WriteZSet(w, msg.ZSet)
 	return
 }
 
-func (msg *Elements) unmarshal(r io.Reader) (err error) {
+func (msg *Elements) Unmarshal(r io.Reader) (err error) {
 	msg.ZSet, err = ReadZSet(r)
 	return
 }
@@ -382,12 +445,12 @@ func (msg *FullElements) MsgType() MsgType {
 	return MsgTypeFullElements
 }
 
-func (msg *FullElements) marshal(w io.Writer) (err error) {
+func (msg *FullElements) Marshal(w io.Writer) (err error) {
 	err = WriteZSet(w, msg.ZSet)
 	return
 }
 
-func (msg *FullElements) unmarshal(r io.Reader) (err error) {
+func (msg *FullElements) Unmarshal(r io.Reader) (err error) {
 	msg.ZSet, err = ReadZSet(r)
 	return
 }
@@ -428,42 +491,218 @@ func (msg *Flush) MsgType() MsgType {
 	return MsgTypeFlush
 }
 
+// Error reports an error to the remote peer, ending the session. The code
+// and retry-after hint are carried in the text, so that peers which do not
+// understand them see the text alone.
 type Error struct {
 	*textMsg
+
+	// Code classifies the error.
+	Code ErrorCode
+
+	// RetryAfter is how long the remote peer should wait before trying
+	// again, or zero.
+	RetryAfter time.Duration
 }
 
 func (msg *Error) String() string {
+	if msg.Code != "" {
+		return fmt.Sprintf("%v: %v [%v]", msg.MsgType(), msg.Text, msg.Code)
+	}
 	return fmt.Sprintf("%v: %v", msg.MsgType(), msg.Text)
 }
 
+func (msg *Error) Unmarshal(r io.Reader) error {
+	var tm textMsg
+	err := tm.Unmarshal(r)
+	if err != nil {
+		return err
+	}
+	text, code, retryAfter := parseReason(tm.Text)
+	msg.textMsg = &textMsg{Text: text}
+	msg.Code, msg.RetryAfter = code, retryAfter
+	return nil
+}
+
+func (msg *Error) Marshal(w io.Writer) error {
+	return WriteString(w, formatReason(msg.Text, msg.Code, msg.RetryAfter))
+}
+
+// Err returns the error reported by the remote peer.
+func (msg *Error) Err() error {
+	return &RemoteError{Code: msg.Code, Reason: msg.Text, RetryAfter: msg.RetryAfter}
+}
+
 func (msg *Error) MsgType() MsgType {
 	return MsgTypeError
 }
 
+// DbRqst requests the record content of the given elements from the remote
+// peer. An empty request ends the content fetch phase of a session.
 type DbRqst struct {
-	*textMsg
+	Elements []*cf.Zp
 }
 
 func (msg *DbRqst) String() string {
-	return fmt.Sprintf("%v: %v", msg.MsgType(), msg.Text)
+	return fmt.Sprintf("%v: (%d elements)", msg.MsgType(), len(msg.Elements))
 }
 
 func (msg *DbRqst) MsgType() MsgType {
 	return MsgTypeDbRqst
 }
 
+func (msg *DbRqst) Marshal(w io.Writer) error {
+	return WriteZZarray(w, msg.Elements)
+}
+
+func (msg *DbRqst) Unmarshal(r io.Reader) (err error) {
+	msg.Elements, err = ReadZZarray(r)
+	return
+}
+
+// DbRepl replies to a DbRqst with the content of requested elements. Elements
+// unknown to the replying peer are omitted.
 type DbRepl struct {
-	*textMsg
+	Records []*Record
 }
 
 func (msg *DbRepl) String() string {
-	return fmt.Sprintf("%v: %v", msg.MsgType(), msg.Text)
+	return fmt.Sprintf("%v: (%d records)", msg.MsgType(), len(msg.Records))
 }
 
 func (msg *DbRepl) MsgType() MsgType {
 	return MsgTypeDbRepl
 }
 
+func (msg *DbRepl) Marshal(w io.Writer) (err error) {
+	err = WriteInt(w, len(msg.Records))
+	if err != nil {
+		return
+	}
+	for _, record := range msg.Records {
+		err = WriteZp(w, record.Element)
+		if err != nil {
+			return
+		}
+		err = WriteInt(w, len(record.Content))
+		if err != nil {
+			return
+		}
+		_, err = w.Write(record.Content)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (msg *DbRepl) Unmarshal(r io.Reader) error {
+	n, err := readCount(r, SksZpNbytes+4)
+	if err != nil {
+		return err
+	}
+	msg.Records = nil
+	for i := 0; i < n; i++ {
+		record := &Record{}
+		record.Element, err = ReadZp(r)
+		if err != nil {
+			return err
+		}
+		nbytes, err := ReadLen(r)
+		if err != nil {
+			return err
+		}
+		record.Content, err = readBytes(r, nbytes)
+		if err != nil {
+			return err
+		}
+		msg.Records = append(msg.Records, record)
+	}
+	return nil
+}
+
+// maxMembershipPeers is the maximum number of peers in a Membership message.
+const maxMembershipPeers = 256
+
+// Membership advertises the recon addresses of a peer's partners. It is
+// authenticated with an HMAC over the timestamp and peers, keyed with a
+// secret shared among peers.
+type Membership struct {
+	Timestamp int64
+	Peers     []string
+	MAC       []byte
+}
+
+func (msg *Membership) String() string {
+	return fmt.Sprintf("%v: (%d peers)", msg.MsgType(), len(msg.Peers))
+}
+
+func (msg *Membership) MsgType() MsgType {
+	return MsgTypeMembership
+}
+
+func (msg *Membership) marshalBody(w io.Writer) (err error) {
+	err = binary.Write(w, binary.BigEndian, msg.Timestamp)
+	if err != nil {
+		return
+	}
+	err = WriteInt(w, len(msg.Peers))
+	if err != nil {
+		return
+	}
+	for _, peer := range msg.Peers {
+		err = WriteString(w, peer)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (msg *Membership) Marshal(w io.Writer) (err error) {
+	err = msg.marshalBody(w)
+	if err != nil {
+		return
+	}
+	err = WriteInt(w, len(msg.MAC))
+	if err != nil {
+		return
+	}
+	_, err = w.Write(msg.MAC)
+	return
+}
+
+func (msg *Membership) Unmarshal(r io.Reader) error {
+	err := binary.Read(r, binary.BigEndian, &msg.Timestamp)
+	if err != nil {
+		return err
+	}
+	n, err := readCount(r, 4)
+	if err != nil {
+		return err
+	}
+	if n > maxMembershipPeers {
+		return decodeErrorf("too many peers: %d", n)
+	}
+	msg.Peers = nil
+	for i := 0; i < n; i++ {
+		peer, err := ReadString(r)
+		if err != nil {
+			return err
+		}
+		msg.Peers = append(msg.Peers, peer)
+	}
+	n, err = ReadLen(r)
+	if err != nil {
+		return err
+	}
+	msg.MAC, err = readBytes(r, n)
+	return err
+}
+
+// maxConfigEntries is the maximum number of entries in a Config message.
+const maxConfigEntries = 256
+
 var RemoteConfigPassed string = "passed"
 var RemoteConfigFailed string = "failed"
 
@@ -485,7 +724,7 @@ func (msg *Config) MsgType() MsgType {
 	return MsgTypeConfig
 }
 
-func (msg *Config) marshal(w io.Writer) (err error) {
+func (msg *Config) Marshal(w io.Writer) (err error) {
 	if err = WriteInt(w, 5+len(msg.Custom)); err != nil {
 		return
 	}
@@ -528,24 +767,31 @@ func (msg *Config) marshal(w io.Writer) (err error) {
 	if err = WriteString(w, msg.Filters); err != nil {
 		return
 	}
-	if msg.Custom != nil {
-		for k, v := range msg.Custom {
-			if err = WriteString(w, k); err != nil {
-				return
-			}
-			if err = WriteString(w, v); err != nil {
-				return
-			}
+	// Custom keys are sorted so that sessions are reproducible.
+	keys := make([]string, 0, len(msg.Custom))
+	for k := range msg.Custom {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err = WriteString(w, k); err != nil {
+			return
+		}
+		if err = WriteString(w, msg.Custom[k]); err != nil {
+			return
 		}
 	}
 	return
 }
 
-func (msg *Config) unmarshal(r io.Reader) (err error) {
+func (msg *Config) Unmarshal(r io.Reader) (err error) {
 	var n int
-	if n, err = ReadLen(r); err != nil {
+	if n, err = readCount(r, 8); err != nil {
 		return err
 	}
+	if n > maxConfigEntries {
+		return decodeErrorf("too many config entries: %d", n)
+	}
 	msg.Custom = make(map[string]string)
 	var ival int
 	var k, v string
@@ -564,7 +810,7 @@ func (msg *Config) unmarshal(r io.Reader) (err error) {
 			if ival, err = ReadLen(r); err != nil {
 				return err
 			} else if ival != 4 {
-				return errors.New(fmt.Sprintf("Invalid length=%d for integer config value %s", ival, k))
+				return decodeErrorf("invalid length %d for integer config value %q", ival, k)
 			}
 			// Read the int
 			if ival, err = ReadInt(r); err != nil {
@@ -594,72 +840,79 @@ func (msg *Config) unmarshal(r io.Reader) (err error) {
 	return nil
 }
 
-func ReadMsg(r io.Reader) (msg ReconMsg, err error) {
+func ReadMsg(r io.Reader) (ReconMsg, error) {
+	msg, _, err := readMsgSize(r)
+	return msg, err
+}
+
+// readMsgSize reads a message from r, also returning the number of bytes it
+// occupied on the wire.
+func readMsgSize(r io.Reader) (msg ReconMsg, n int, err error) {
 	var msgSize int
 	msgSize, err = ReadLen(r)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	msgBuf := make([]byte, msgSize)
-	_, err = io.ReadFull(r, msgBuf)
-	if err != nil {
-		return nil, err
+	if lr, ok := r.(interface {
+		Len() int
+	}); ok && msgSize > lr.Len() {
+		return nil, 0, decodeErrorf("length %d exceeds remaining %d bytes", msgSize, lr.Len())
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	_, err = io.CopyN(buf, r, int64(msgSize))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-	br := bytes.NewBuffer(msgBuf)
-	buf := make([]byte, 1)
-	_, err = io.ReadFull(br, buf[:1])
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	msgType := MsgType(buf[0])
-	switch msgType {
-	case MsgTypeReconRqstPoly:
-		msg = &ReconRqstPoly{}
-	case MsgTypeReconRqstFull:
-		msg = &ReconRqstFull{}
-	case MsgTypeElements:
-		msg = &Elements{}
-	case MsgTypeFullElements:
-		msg = &FullElements{}
-	case MsgTypeSyncFail:
-		msg = &SyncFail{}
-	case MsgTypeDone:
-		msg = &Done{}
-	case MsgTypeFlush:
-		msg = &Flush{}
-	case MsgTypeError:
-		msg = &Error{&textMsg{}}
-	case MsgTypeDbRqst:
-		msg = &DbRqst{&textMsg{}}
-	case MsgTypeDbRepl:
-		msg = &DbRepl{&textMsg{}}
-	case MsgTypeConfig:
-		msg = &Config{}
-	default:
-		return nil, errors.New(fmt.Sprintf("Unexpected message code: %d", msgType))
+	n = 4 + msgSize
+	if msgSize == 0 {
+		return nil, n, decodeErrorf("empty message")
 	}
-	err = msg.unmarshal(br)
-	return
-}
-
-func WriteMsgDirect(w io.Writer, msg ReconMsg) (err error) {
-	data := bytes.NewBuffer(nil)
-	buf := make([]byte, 1)
-	buf[0] = byte(msg.MsgType())
-	_, err = data.Write(buf)
-	if err != nil {
-		return
+	msgBuf := buf.Bytes()
+	br := bytes.NewReader(msgBuf[1:])
+	msgType := MsgType(msgBuf[0])
+	msg = newMsg(msgType)
+	if msg == nil {
+		return nil, n, decodeErrorf("unexpected message type %d", msgType)
+	}
+	err = msg.Unmarshal(br)
+	if err == nil && br.Len() > 0 {
+		err = decodeErrorf("%d trailing bytes", br.Len())
 	}
-	err = msg.marshal(data)
 	if err != nil {
-		return
+		decodeErr, ok := err.(*DecodeError)
+		if !ok {
+			// The message is buffered, so any other error is a short read.
+			decodeErr = decodeErrorf("truncated")
+		}
+		decodeErr.MsgType = msgType
+		return nil, n, decodeErr
 	}
-	err = WriteInt(w, data.Len())
+	return msg, n, nil
+}
+
+func WriteMsgDirect(w io.Writer, msg ReconMsg) error {
+	_, err := writeMsgSize(w, msg)
+	return err
+}
+
+// writeMsgSize writes a message to w, returning the number of bytes it
+// occupies on the wire.
+func writeMsgSize(w io.Writer, msg ReconMsg) (n int, err error) {
+	data := getBuffer()
+	defer putBuffer(data)
+	// Reserve the length prefix, so that the message is written in one call.
+	data.Write([]byte{0, 0, 0, 0, byte(msg.MsgType())})
+	err = msg.Marshal(data)
 	if err != nil {
 		return
 	}
-	_, err = w.Write(data.Bytes())
-	return err
+	frame := data.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	return w.Write(frame)
 }
 
 func WriteMsg(w io.Writer, msgs ...ReconMsg) (err error) {
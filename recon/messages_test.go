@@ -25,6 +25,8 @@ import (
 	"bytes"
 
 	gc "gopkg.in/check.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
 )
 
 type MessagesSuite struct{}
@@ -38,11 +40,11 @@ func (s *MessagesSuite) TestConfigRoundTrip(c *gc.C) {
 		BitQuantum: 2,
 		MBar:       5}
 	var buf bytes.Buffer
-	err := conf.marshal(&buf)
+	err := conf.Marshal(&buf)
 	c.Assert(err, gc.IsNil)
 	c.Logf("config=%x", &buf)
 	conf2 := &Config{}
-	err = conf2.unmarshal(bytes.NewBuffer(buf.Bytes()))
+	err = conf2.Unmarshal(bytes.NewBuffer(buf.Bytes()))
 	c.Assert(err, gc.IsNil)
 	c.Assert(conf.Version, gc.Equals, conf2.Version)
 	c.Assert(conf.HTTPPort, gc.Equals, conf2.HTTPPort)
@@ -67,3 +69,49 @@ func (s *MessagesSuite) TestConfigMsgRoundTrip(c *gc.C) {
 	c.Assert(conf.BitQuantum, gc.Equals, conf2.BitQuantum)
 	c.Assert(conf.MBar, gc.Equals, conf2.MBar)
 }
+
+func (s *MessagesSuite) TestDbRqstReplRoundTrip(c *gc.C) {
+	rqst := &DbRqst{Elements: []*cf.Zp{cf.Zi(cf.P_SKS, 65537), cf.Zi(cf.P_SKS, 65539)}}
+	repl := &DbRepl{Records: []*Record{
+		{Element: cf.Zi(cf.P_SKS, 65537), Content: []byte("foo")},
+		{Element: cf.Zi(cf.P_SKS, 65539), Content: []byte{}},
+	}}
+	buf := bytes.NewBuffer(nil)
+	err := WriteMsg(buf, rqst, repl, &DbRqst{})
+	c.Assert(err, gc.IsNil)
+
+	msg, err := ReadMsg(buf)
+	c.Assert(err, gc.IsNil)
+	rqst2 := msg.(*DbRqst)
+	c.Assert(rqst2.Elements, gc.HasLen, 2)
+	for i := range rqst.Elements {
+		c.Assert(rqst2.Elements[i].Cmp(rqst.Elements[i]), gc.Equals, 0)
+	}
+
+	msg, err = ReadMsg(buf)
+	c.Assert(err, gc.IsNil)
+	repl2 := msg.(*DbRepl)
+	c.Assert(repl2.Records, gc.HasLen, 2)
+	for i := range repl.Records {
+		c.Assert(repl2.Records[i].Element.Cmp(repl.Records[i].Element), gc.Equals, 0)
+		c.Assert(repl2.Records[i].Content, gc.DeepEquals, repl.Records[i].Content)
+	}
+
+	msg, err = ReadMsg(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(msg.(*DbRqst).Elements, gc.HasLen, 0)
+}
+
+func (s *MessagesSuite) TestMembershipRoundTrip(c *gc.C) {
+	membership := &Membership{
+		Timestamp: 1500000000,
+		Peers:     []string{"10.1.2.3:11370", "[fe80::1]:11370"},
+		MAC:       []byte{1, 2, 3},
+	}
+	buf := bytes.NewBuffer(nil)
+	err := WriteMsg(buf, membership)
+	c.Assert(err, gc.IsNil)
+	msg, err := ReadMsg(bytes.NewBuffer(buf.Bytes()))
+	c.Assert(err, gc.IsNil)
+	c.Assert(msg, gc.DeepEquals, membership)
+}
@@ -0,0 +1,442 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Session outcomes reported to Metrics.
+const (
+	OutcomeSuccess      = "success"
+	OutcomeBusy         = "busy"
+	OutcomeIncompatible = "incompatible"
+	OutcomeRejected     = "rejected"
+	OutcomeCancelled    = "cancelled"
+	OutcomeError        = "error"
+)
+
+// Metrics receives instrumentation events from a Peer. Implementations must
+// be safe for concurrent use.
+type Metrics interface {
+	// SessionStarted is called when a recon session starts in the given
+	// role, GOSSIP or SERVE.
+	SessionStarted(role string)
+
+	// SessionEnded is called when a recon session ends, with its outcome and
+	// duration.
+	SessionEnded(role string, outcome string, d time.Duration)
+
+	// MessageSent is called for each message written to a remote peer.
+	MessageSent(msgType MsgType, nbytes int)
+
+	// MessageReceived is called for each message read from a remote peer.
+	MessageReceived(msgType MsgType, nbytes int)
+
+	// SyncFail is called when reconciliation of a prefix tree node at the
+	// given depth fails, and its children must be reconciled instead.
+	SyncFail(depth int)
+
+	// LowMBar is called when interpolation fails because the difference
+	// between peers exceeds MBar.
+	LowMBar()
+
+	// ElementsRecovered is called when recovered elements are delivered to
+	// RecoverChan.
+	ElementsRecovered(n int)
+
+	// RecoverDropped is called when recovered elements cannot be delivered
+	// to RecoverChan because the peer was stopped.
+	RecoverDropped(n int)
+
+	// PendingMutations is called when the number of elements queued for
+	// insertion into or removal from the prefix tree changes.
+	PendingMutations(inserts, removes int)
+
+	// TreeMutated is called after queued elements are flushed into the prefix
+	// tree, with the number of elements mutated and the time taken.
+	TreeMutated(n int, d time.Duration)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) SessionStarted(role string)                                {}
+func (nopMetrics) SessionEnded(role string, outcome string, d time.Duration) {}
+func (nopMetrics) MessageSent(msgType MsgType, nbytes int)                   {}
+func (nopMetrics) MessageReceived(msgType MsgType, nbytes int)               {}
+func (nopMetrics) SyncFail(depth int)                                        {}
+func (nopMetrics) LowMBar()                                                  {}
+func (nopMetrics) ElementsRecovered(n int)                                   {}
+func (nopMetrics) RecoverDropped(n int)                                      {}
+func (nopMetrics) PendingMutations(inserts, removes int)                     {}
+func (nopMetrics) TreeMutated(n int, d time.Duration)                        {}
+
+// SetMetrics sets the Metrics instrumenting this peer.
+func (p *Peer) SetMetrics(m Metrics) {
+	p.muHooks.Lock()
+	defer p.muHooks.Unlock()
+	p.metrics = m
+}
+
+func (p *Peer) getMetrics() Metrics {
+	p.muHooks.RLock()
+	defer p.muHooks.RUnlock()
+	if p.metrics == nil {
+		return nopMetrics{}
+	}
+	return p.metrics
+}
+
+// readMsg reads a message in session s from r, recording it in the peer's
+// metrics and validating it against the session's limits.
+func (p *Peer) readMsg(s *session, r io.Reader) (ReconMsg, error) {
+	msg, n, err := readMsgSize(r)
+	if err != nil {
+		return nil, err
+	}
+	p.getMetrics().MessageReceived(msg.MsgType(), n)
+	err = s.limits.check(msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeMsg writes messages to w, recording them in the peer's metrics.
+func (p *Peer) writeMsg(w io.Writer, msgs ...ReconMsg) error {
+	m := p.getMetrics()
+	bufw := bufio.NewWriter(w)
+	for _, msg := range msgs {
+		n, err := writeMsgSize(bufw, msg)
+		if err != nil {
+			return err
+		}
+		m.MessageSent(msg.MsgType(), n)
+	}
+	return bufw.Flush()
+}
+
+// sessionOutcome classifies the error ending a recon session.
+func sessionOutcome(err error) string {
+	switch errgo.Cause(err) {
+	case nil:
+		return OutcomeSuccess
+	case ErrPeerBusy, ErrRateLimited:
+		return OutcomeBusy
+	case ErrIncompatiblePeer:
+		return OutcomeIncompatible
+	case ErrRemoteRejectedConfig:
+		return OutcomeRejected
+	case context.Canceled, context.DeadlineExceeded:
+		return OutcomeCancelled
+	}
+	return OutcomeError
+}
+
+// recordSession records the start of a recon session in the peer's metrics.
+// The returned function records its end, given the error which ended the
+// session, and is intended to be deferred:
+//
+//	defer p.recordSession(role)(&err)
+func (p *Peer) recordSession(role string) func(errp *error) {
+	m := p.getMetrics()
+	m.SessionStarted(role)
+	start := time.Now()
+	return func(errp *error) {
+		m.SessionEnded(role, sessionOutcome(*errp), time.Since(start))
+	}
+}
+
+var defaultDurationBuckets = []float64{.001, .01, .1, .5, 1, 5, 10, 30, 60, 300}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// PrometheusMetrics is a Metrics implementation which exposes the collected
+// metrics in the Prometheus text exposition format.
+type PrometheusMetrics struct {
+	namespace string
+
+	mu                sync.Mutex
+	sessionsStarted   map[string]float64
+	sessionsEnded     map[string]float64
+	sessionDuration   map[string]*histogram
+	messages          map[string]float64
+	messageBytes      map[string]float64
+	syncFails         map[string]float64
+	lowMBar           float64
+	elementsRecovered float64
+	recoverDropped    float64
+	pendingInserts    float64
+	pendingRemoves    float64
+	mutationDuration  *histogram
+	elementsMutated   float64
+}
+
+// NewPrometheusMetrics returns a new PrometheusMetrics, with metric names
+// prefixed by namespace, which defaults to "conflux".
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	if namespace == "" {
+		namespace = "conflux"
+	}
+	return &PrometheusMetrics{
+		namespace:        namespace,
+		sessionsStarted:  make(map[string]float64),
+		sessionsEnded:    make(map[string]float64),
+		sessionDuration:  make(map[string]*histogram),
+		messages:         make(map[string]float64),
+		messageBytes:     make(map[string]float64),
+		syncFails:        make(map[string]float64),
+		mutationDuration: newHistogram(defaultDurationBuckets),
+	}
+}
+
+func labels(kv ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(kv); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", kv[i], kv[i+1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// SessionStarted implements Metrics.
+func (m *PrometheusMetrics) SessionStarted(role string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessionsStarted[labels("role", role)]++
+}
+
+// SessionEnded implements Metrics.
+func (m *PrometheusMetrics) SessionEnded(role string, outcome string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessionsEnded[labels("role", role, "outcome", outcome)]++
+	key := labels("role", role)
+	h, ok := m.sessionDuration[key]
+	if !ok {
+		h = newHistogram(defaultDurationBuckets)
+		m.sessionDuration[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// MessageSent implements Metrics.
+func (m *PrometheusMetrics) MessageSent(msgType MsgType, nbytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := labels("direction", "sent", "type", msgType.String())
+	m.messages[key]++
+	m.messageBytes[key] += float64(nbytes)
+}
+
+// MessageReceived implements Metrics.
+func (m *PrometheusMetrics) MessageReceived(msgType MsgType, nbytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := labels("direction", "received", "type", msgType.String())
+	m.messages[key]++
+	m.messageBytes[key] += float64(nbytes)
+}
+
+// SyncFail implements Metrics.
+func (m *PrometheusMetrics) SyncFail(depth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.syncFails[labels("depth", fmt.Sprintf("%d", depth))]++
+}
+
+// LowMBar implements Metrics.
+func (m *PrometheusMetrics) LowMBar() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lowMBar++
+}
+
+// ElementsRecovered implements Metrics.
+func (m *PrometheusMetrics) ElementsRecovered(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.elementsRecovered += float64(n)
+}
+
+// RecoverDropped implements Metrics.
+func (m *PrometheusMetrics) RecoverDropped(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recoverDropped += float64(n)
+}
+
+// PendingMutations implements Metrics.
+func (m *PrometheusMetrics) PendingMutations(inserts, removes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pendingInserts = float64(inserts)
+	m.pendingRemoves = float64(removes)
+}
+
+// TreeMutated implements Metrics.
+func (m *PrometheusMetrics) TreeMutated(n int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.elementsMutated += float64(n)
+	m.mutationDuration.observe(d.Seconds())
+}
+
+type metricWriter struct {
+	w         io.Writer
+	namespace string
+	n         int64
+	err       error
+}
+
+func (mw *metricWriter) printf(format string, args ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(mw.w, format, args...)
+	mw.n += int64(n)
+	mw.err = err
+}
+
+func (mw *metricWriter) header(name, typ, help string) string {
+	name = mw.namespace + "_" + name
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	return name
+}
+
+func (mw *metricWriter) sample(name, labels string, v float64) {
+	if labels == "" {
+		mw.printf("%s %v\n", name, v)
+	} else {
+		mw.printf("%s{%s} %v\n", name, labels, v)
+	}
+}
+
+func (mw *metricWriter) scalar(name, typ, help string, v float64) {
+	mw.sample(mw.header(name, typ, help), "", v)
+}
+
+func (mw *metricWriter) vector(name, typ, help string, values map[string]float64) {
+	name = mw.header(name, typ, help)
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mw.sample(name, k, values[k])
+	}
+}
+
+func (mw *metricWriter) histograms(name, help string, values map[string]*histogram) {
+	name = mw.header(name, "histogram", help)
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := values[k]
+		prefix := k
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, le := range h.buckets {
+			mw.sample(name+"_bucket", prefix+labels("le", fmt.Sprintf("%v", le)), float64(h.counts[i]))
+		}
+		mw.sample(name+"_bucket", prefix+labels("le", "+Inf"), float64(h.count))
+		mw.sample(name+"_sum", k, h.sum)
+		mw.sample(name+"_count", k, float64(h.count))
+	}
+}
+
+// WriteTo writes the collected metrics to w in the Prometheus text exposition
+// format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mw := &metricWriter{w: w, namespace: m.namespace}
+	mw.vector("recon_sessions_started_total", "counter",
+		"Recon sessions started, by role.", m.sessionsStarted)
+	mw.vector("recon_sessions_total", "counter",
+		"Recon sessions ended, by role and outcome.", m.sessionsEnded)
+	mw.histograms("recon_session_duration_seconds",
+		"Duration of recon sessions, by role.", m.sessionDuration)
+	mw.vector("recon_messages_total", "counter",
+		"Recon protocol messages, by direction and message type.", m.messages)
+	mw.vector("recon_message_bytes_total", "counter",
+		"Recon protocol message bytes, by direction and message type.", m.messageBytes)
+	mw.vector("recon_sync_fail_total", "counter",
+		"Prefix tree nodes which failed to reconcile, by depth.", m.syncFails)
+	mw.scalar("recon_low_mbar_total", "counter",
+		"Interpolations which failed because the difference exceeded MBar.", m.lowMBar)
+	mw.scalar("recon_elements_recovered_total", "counter",
+		"Elements recovered from remote peers.", m.elementsRecovered)
+	mw.scalar("recon_recover_dropped_total", "counter",
+		"Recovered elements dropped because the peer stopped before delivery.", m.recoverDropped)
+	mw.scalar("recon_pending_inserts", "gauge",
+		"Elements queued for insertion into the prefix tree.", m.pendingInserts)
+	mw.scalar("recon_pending_removes", "gauge",
+		"Elements queued for removal from the prefix tree.", m.pendingRemoves)
+	mw.scalar("recon_elements_mutated_total", "counter",
+		"Elements inserted into or removed from the prefix tree.", m.elementsMutated)
+	mw.histograms("recon_tree_mutation_duration_seconds",
+		"Time taken to flush queued mutations into the prefix tree.",
+		map[string]*histogram{"": m.mutationDuration})
+	return mw.n, mw.err
+}
+
+// ServeHTTP implements http.Handler, serving the collected metrics in the
+// Prometheus text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
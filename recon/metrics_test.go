@@ -0,0 +1,137 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type MetricsSuite struct{}
+
+var _ = gc.Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestExposition(c *gc.C) {
+	m := NewPrometheusMetrics("")
+	m.SessionStarted(SERVE)
+	m.SessionEnded(SERVE, OutcomeSuccess, 2*time.Second)
+	m.MessageSent(MsgTypeConfig, 42)
+	m.SyncFail(3)
+	m.RecoverDropped(5)
+	m.PendingMutations(7, 1)
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, int64(buf.Len()))
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE conflux_recon_sessions_total counter",
+		`conflux_recon_sessions_started_total{role="serve"} 1`,
+		`conflux_recon_sessions_total{role="serve",outcome="success"} 1`,
+		`conflux_recon_session_duration_seconds_bucket{role="serve",le="1"} 0`,
+		`conflux_recon_session_duration_seconds_bucket{role="serve",le="5"} 1`,
+		`conflux_recon_session_duration_seconds_bucket{role="serve",le="+Inf"} 1`,
+		`conflux_recon_session_duration_seconds_sum{role="serve"} 2`,
+		`conflux_recon_messages_total{direction="sent",type="Config"} 1`,
+		`conflux_recon_message_bytes_total{direction="sent",type="Config"} 42`,
+		`conflux_recon_sync_fail_total{depth="3"} 1`,
+		"conflux_recon_recover_dropped_total 5",
+		"conflux_recon_pending_inserts 7",
+		"conflux_recon_pending_removes 1",
+		`conflux_recon_tree_mutation_duration_seconds_count 0`,
+	} {
+		c.Check(strings.Contains(out, line+"\n"), gc.Equals, true, gc.Commentf("missing %q", line))
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(rec.Body.String(), gc.Equals, out)
+}
+
+func (s *MetricsSuite) TestSessionMetrics(c *gc.C) {
+	common := []*cf.Zp{cf.Zi(cf.P_SKS, 65537), cf.Zi(cf.P_SKS, 65539)}
+	server := newTestPeer(c, append(common, cf.Zi(cf.P_SKS, 65541))...)
+	defer server.Stop()
+	serverMetrics := NewPrometheusMetrics("")
+	server.SetMetrics(serverMetrics)
+	client := newTestPeer(c, append(common, cf.Zi(cf.P_SKS, 65543))...)
+	defer client.Stop()
+	clientMetrics := NewPrometheusMetrics("")
+	client.SetMetrics(clientMetrics)
+
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+
+	<-client.RecoverChan
+	<-server.RecoverChan
+
+	var buf bytes.Buffer
+	_, err := serverMetrics.WriteTo(&buf)
+	c.Assert(err, gc.IsNil)
+	out := buf.String()
+	c.Check(strings.Contains(out, `conflux_recon_sessions_total{role="serve",outcome="success"} 1`+"\n"), gc.Equals, true)
+	c.Check(strings.Contains(out, `conflux_recon_messages_total{direction="received",type="Config"} 1`+"\n"), gc.Equals, true)
+	c.Check(strings.Contains(out, `conflux_recon_messages_total{direction="sent",type="Done"} 1`+"\n"), gc.Equals, true)
+	c.Check(strings.Contains(out, "conflux_recon_elements_recovered_total 1\n"), gc.Equals, true)
+
+	buf.Reset()
+	_, err = clientMetrics.WriteTo(&buf)
+	c.Assert(err, gc.IsNil)
+	out = buf.String()
+	c.Check(strings.Contains(out, `conflux_recon_sessions_total{role="gossip",outcome="success"} 1`+"\n"), gc.Equals, true)
+	c.Check(strings.Contains(out, `conflux_recon_messages_total{direction="received",type="Done"} 1`+"\n"), gc.Equals, true)
+	c.Check(strings.Contains(out, "conflux_recon_elements_recovered_total 1\n"), gc.Equals, true)
+}
+
+func (s *MetricsSuite) TestBusySessionMetrics(c *gc.C) {
+	server := newTestPeer(c)
+	defer server.Stop()
+	serverMetrics := NewPrometheusMetrics("")
+	server.SetMetrics(serverMetrics)
+	server.mutating = true
+	client := newTestPeer(c)
+	defer client.Stop()
+	clientMetrics := NewPrometheusMetrics("")
+	client.SetMetrics(clientMetrics)
+
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.NotNil)
+	c.Assert(serverErr, gc.NotNil)
+
+	var buf bytes.Buffer
+	_, err := serverMetrics.WriteTo(&buf)
+	c.Assert(err, gc.IsNil)
+	c.Check(strings.Contains(buf.String(), `conflux_recon_sessions_total{role="serve",outcome="busy"} 1`+"\n"), gc.Equals, true)
+
+	buf.Reset()
+	_, err = clientMetrics.WriteTo(&buf)
+	c.Assert(err, gc.IsNil)
+	c.Check(strings.Contains(buf.String(), `conflux_recon_sessions_total{role="gossip",outcome="busy"} 1`+"\n"), gc.Equals, true)
+}
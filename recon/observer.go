@@ -0,0 +1,375 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+// SessionInfo describes a recon session with a remote peer.
+type SessionInfo struct {
+	// Role is GOSSIP if the session was initiated by this peer, or SERVE if
+	// it was accepted from the remote peer.
+	Role string
+
+	// RemoteAddr is the address of the remote peer.
+	RemoteAddr net.Addr
+
+	// RemoteConfig is the config sent by the remote peer in the handshake.
+	// It is nil until the handshake has been received.
+	RemoteConfig *Config
+
+	// Start is the time the session started.
+	Start time.Time
+}
+
+// SessionStats summarizes a completed recon session.
+type SessionStats struct {
+	Duration      time.Duration
+	BytesSent     int64
+	BytesReceived int64
+
+	// ElementsRecovered is the number of elements recovered from the remote
+	// peer.
+	ElementsRecovered int
+
+	// RecordsFetched is the number of records fetched from the remote peer,
+	// if content fetch was negotiated.
+	RecordsFetched int
+
+	// Err is the error which ended the session, if any.
+	Err error
+}
+
+// MutationBatch describes a batch of elements flushed into the prefix tree.
+type MutationBatch struct {
+	Inserted []*cf.Zp
+	Removed  []*cf.Zp
+	Duration time.Duration
+}
+
+// PeerObserver receives notification of events in recon sessions and prefix
+// tree mutations. Callbacks are made synchronously from the goroutines
+// handling sessions and mutations, so implementations must be safe for
+// concurrent use and should return promptly.
+type PeerObserver interface {
+	// SessionStarted is called once the config handshake with a remote peer
+	// has completed successfully.
+	SessionStarted(s *SessionInfo)
+
+	// SessionEnded is called when a started session ends.
+	SessionEnded(s *SessionInfo, stats *SessionStats)
+
+	// HandshakeRejected is called when the config handshake is rejected,
+	// either by this peer or, if remote is true, by the remote peer.
+	HandshakeRejected(s *SessionInfo, reason string, remote bool)
+
+	// SyncFailed is called when the prefix tree node at prefix could not be
+	// reconciled, and its children must be reconciled instead.
+	SyncFailed(s *SessionInfo, prefix *cf.Bitstring)
+
+	// Solved is called when the difference at the prefix tree node at prefix
+	// has been solved by interpolation, with the number of elements needed
+	// by each side.
+	Solved(s *SessionInfo, prefix *cf.Bitstring, localNeeds, remoteNeeds int)
+
+	// ElementsRecovered is called when a session has recovered elements from
+	// the remote peer, before they are delivered to RecoverChan.
+	ElementsRecovered(s *SessionInfo, r *Recover)
+
+	// Mutated is called after a batch of elements has been flushed into the
+	// prefix tree.
+	Mutated(batch *MutationBatch)
+}
+
+// AddObserver registers o to receive peer events. Observers should be
+// pointers, so that they may be removed with RemoveObserver.
+func (p *Peer) AddObserver(o PeerObserver) {
+	p.muHooks.Lock()
+	defer p.muHooks.Unlock()
+	p.observers = append(p.observers, o)
+}
+
+// RemoveObserver unregisters o. Observers of uncomparable types, such as
+// structs holding slices or maps, cannot be told apart and are not removed.
+func (p *Peer) RemoveObserver(o PeerObserver) {
+	if o == nil || !reflect.TypeOf(o).Comparable() {
+		return
+	}
+	p.muHooks.Lock()
+	defer p.muHooks.Unlock()
+	var observers []PeerObserver
+	for _, other := range p.observers {
+		if other != o {
+			observers = append(observers, other)
+		}
+	}
+	p.observers = observers
+}
+
+// observe calls f with each registered observer.
+func (p *Peer) observe(f func(PeerObserver)) {
+	p.muHooks.RLock()
+	observers := p.observers
+	p.muHooks.RUnlock()
+	for _, o := range observers {
+		f(o)
+	}
+}
+
+// session tracks the state of a recon session reported to observers.
+type session struct {
+	SessionInfo
+	conn *countingConn
+
+	settings   *Settings
+	started    bool
+	round      *gossipRound
+	dryRun     *dryRun
+	replay     *replayedLocal
+	config     *Config
+	direction  Direction
+	nonce      string
+	send       bool
+	receive    bool
+	rtt        time.Duration
+	timeouts   sessionTimeouts
+	limits     *msgLimits
+	transcript *transcriptWriter
+	recovered  int
+	records    int
+}
+
+// newSession starts tracking a session on conn, with a snapshot of the
+// current settings. The returned connection should be used for all session
+// traffic, so that it is counted.
+func (p *Peer) newSession(role string, conn net.Conn) (*session, net.Conn) {
+	settings := p.getSettings()
+	timeouts := settings.sessionTimeouts(conn.RemoteAddr(), p.partnerIPs())
+	s := &session{
+		SessionInfo: SessionInfo{
+			Role:       role,
+			RemoteAddr: conn.RemoteAddr(),
+			Start:      time.Now(),
+		},
+		settings: settings,
+		timeouts: timeouts,
+		limits:   newMsgLimits(&settings.PTreeConfig),
+		send:     true,
+		receive:  true,
+	}
+	if settings.TranscriptDir != "" {
+		t, err := createTranscript(settings.TranscriptDir, &s.SessionInfo)
+		if err != nil {
+			p.logErr(role, err).Warning("cannot record transcript")
+		} else {
+			s.transcript = t
+			conn = &transcriptConn{Conn: conn, t: t}
+		}
+	}
+	s.conn = &countingConn{Conn: &timeoutConn{Conn: conn, writeTimeout: timeouts.write}}
+	return s, s.conn
+}
+
+func (s *session) stats(err error) *SessionStats {
+	return &SessionStats{
+		Duration:          time.Since(s.Start),
+		BytesSent:         atomic.LoadInt64(&s.conn.sent),
+		BytesReceived:     atomic.LoadInt64(&s.conn.received),
+		ElementsRecovered: s.recovered,
+		RecordsFetched:    s.records,
+		Err:               err,
+	}
+}
+
+// startSession notifies observers that the session has started.
+func (p *Peer) startSession(s *session) {
+	s.started = true
+	p.status.sessionStarted(s)
+	p.observe(func(o PeerObserver) { o.SessionStarted(&s.SessionInfo) })
+}
+
+// endSession records the result of the session, and notifies observers that
+// the session has ended, if it started.
+func (p *Peer) endSession(s *session, err error) {
+	if s.transcript != nil {
+		s.transcript.close(err)
+	}
+	stats := s.stats(err)
+	p.status.sessionEnded(s, stats)
+	if !s.started {
+		return
+	}
+	p.observe(func(o PeerObserver) { o.SessionEnded(&s.SessionInfo, stats) })
+}
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	sent, received int64
+}
+
+// Read implements net.Conn.
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.received, int64(n))
+	return n, err
+}
+
+// Write implements net.Conn.
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
+}
+
+// JSONObserver is a PeerObserver which writes each event as a JSON object on
+// its own line, suitable for audit logging.
+type JSONObserver struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	now func() time.Time
+}
+
+// NewJSONObserver returns a new JSONObserver writing events to w.
+func NewJSONObserver(w io.Writer) *JSONObserver {
+	return &JSONObserver{enc: json.NewEncoder(w), now: time.Now}
+}
+
+type jsonEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Role       string    `json:"role,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Config     *Config   `json:"config,omitempty"`
+
+	Reason string `json:"reason,omitempty"`
+	Remote bool   `json:"remote,omitempty"`
+
+	Prefix      string `json:"prefix,omitempty"`
+	LocalNeeds  *int   `json:"localNeeds,omitempty"`
+	RemoteNeeds *int   `json:"remoteNeeds,omitempty"`
+
+	DurationSecs  *float64 `json:"durationSecs,omitempty"`
+	BytesSent     *int64   `json:"bytesSent,omitempty"`
+	BytesReceived *int64   `json:"bytesReceived,omitempty"`
+	Error         string   `json:"error,omitempty"`
+
+	Recovered *int     `json:"recovered,omitempty"`
+	Elements  []string `json:"elements,omitempty"`
+	Inserted  []string `json:"inserted,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+	Records   *int     `json:"records,omitempty"`
+}
+
+func (o *JSONObserver) write(ev *jsonEvent, s *SessionInfo) {
+	ev.Time = o.now().UTC()
+	if s != nil {
+		ev.Role = s.Role
+		if s.RemoteAddr != nil {
+			ev.RemoteAddr = s.RemoteAddr.String()
+		}
+		ev.Config = s.RemoteConfig
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.enc.Encode(ev)
+}
+
+func zpStrings(zs []*cf.Zp) []string {
+	var result []string
+	for _, z := range zs {
+		result = append(result, z.String())
+	}
+	return result
+}
+
+// SessionStarted implements PeerObserver.
+func (o *JSONObserver) SessionStarted(s *SessionInfo) {
+	o.write(&jsonEvent{Event: "session-start"}, s)
+}
+
+// SessionEnded implements PeerObserver.
+func (o *JSONObserver) SessionEnded(s *SessionInfo, stats *SessionStats) {
+	d := stats.Duration.Seconds()
+	ev := &jsonEvent{
+		Event:         "session-end",
+		DurationSecs:  &d,
+		BytesSent:     &stats.BytesSent,
+		BytesReceived: &stats.BytesReceived,
+		Recovered:     &stats.ElementsRecovered,
+		Records:       &stats.RecordsFetched,
+	}
+	if stats.Err != nil {
+		ev.Error = stats.Err.Error()
+	}
+	o.write(ev, s)
+}
+
+// HandshakeRejected implements PeerObserver.
+func (o *JSONObserver) HandshakeRejected(s *SessionInfo, reason string, remote bool) {
+	o.write(&jsonEvent{Event: "handshake-rejected", Reason: reason, Remote: remote}, s)
+}
+
+// SyncFailed implements PeerObserver.
+func (o *JSONObserver) SyncFailed(s *SessionInfo, prefix *cf.Bitstring) {
+	o.write(&jsonEvent{Event: "sync-fail", Prefix: prefix.String()}, s)
+}
+
+// Solved implements PeerObserver.
+func (o *JSONObserver) Solved(s *SessionInfo, prefix *cf.Bitstring, localNeeds, remoteNeeds int) {
+	o.write(&jsonEvent{
+		Event:       "solved",
+		Prefix:      prefix.String(),
+		LocalNeeds:  &localNeeds,
+		RemoteNeeds: &remoteNeeds,
+	}, s)
+}
+
+// ElementsRecovered implements PeerObserver.
+func (o *JSONObserver) ElementsRecovered(s *SessionInfo, r *Recover) {
+	n := len(r.RemoteRecords)
+	o.write(&jsonEvent{
+		Event:    "recovered",
+		Elements: zpStrings(r.RemoteElements),
+		Records:  &n,
+	}, s)
+}
+
+// Mutated implements PeerObserver.
+func (o *JSONObserver) Mutated(batch *MutationBatch) {
+	d := batch.Duration.Seconds()
+	o.write(&jsonEvent{
+		Event:        "mutated",
+		Inserted:     zpStrings(batch.Inserted),
+		Removed:      zpStrings(batch.Removed),
+		DurationSecs: &d,
+	}, nil)
+}
@@ -0,0 +1,210 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"sync"
+
+	gc "gopkg.in/check.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type ObserverSuite struct{}
+
+var _ = gc.Suite(&ObserverSuite{})
+
+type recordingObserver struct {
+	mu        sync.Mutex
+	events    []string
+	started   *SessionInfo
+	stats     *SessionStats
+	rejected  string
+	recovered *Recover
+	batches   []*MutationBatch
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) SessionStarted(s *SessionInfo) {
+	o.record("start")
+	o.started = s
+}
+
+func (o *recordingObserver) SessionEnded(s *SessionInfo, stats *SessionStats) {
+	o.record("end")
+	o.stats = stats
+}
+
+func (o *recordingObserver) HandshakeRejected(s *SessionInfo, reason string, remote bool) {
+	o.record("rejected")
+	o.rejected = reason
+}
+
+func (o *recordingObserver) SyncFailed(s *SessionInfo, prefix *cf.Bitstring) {
+	o.record("syncfail")
+}
+
+func (o *recordingObserver) Solved(s *SessionInfo, prefix *cf.Bitstring, localNeeds, remoteNeeds int) {
+	o.record("solved")
+}
+
+func (o *recordingObserver) ElementsRecovered(s *SessionInfo, r *Recover) {
+	o.record("recovered")
+	o.recovered = r
+}
+
+func (o *recordingObserver) Mutated(batch *MutationBatch) {
+	o.record("mutated")
+	o.batches = append(o.batches, batch)
+}
+
+// pipeSession runs a recon session between client and server over a pipe,
+// returning the errors from each side.
+func pipeSession(c *gc.C, client, server *Peer) (clientErr, serverErr error) {
+	network := newPipeNetwork()
+	client.SetDialer(network)
+	serverErrs := make(chan error, 1)
+	go func() {
+		conn, err := network.Accept()
+		if err != nil {
+			serverErrs <- err
+			return
+		}
+		serverErrs <- server.Accept(conn)
+	}()
+	clientErr = client.InitiateRecon(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370})
+	return clientErr, <-serverErrs
+}
+
+func (s *ObserverSuite) TestSessionEvents(c *gc.C) {
+	common := []*cf.Zp{cf.Zi(cf.P_SKS, 65537), cf.Zi(cf.P_SKS, 65539)}
+	onlyServer := cf.Zi(cf.P_SKS, 65541)
+	server := newTestPeer(c, append(common, onlyServer)...)
+	defer server.Stop()
+	client := newTestPeer(c, append(common, cf.Zi(cf.P_SKS, 65543))...)
+	defer client.Stop()
+
+	var clientObs, otherObs, serverObs recordingObserver
+	client.AddObserver(&clientObs)
+	client.AddObserver(&otherObs)
+	server.AddObserver(&serverObs)
+
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+	<-client.RecoverChan
+	<-server.RecoverChan
+
+	for _, o := range []*recordingObserver{&clientObs, &otherObs} {
+		c.Assert(o.events, gc.DeepEquals, []string{"start", "recovered", "end"})
+		c.Assert(o.started.Role, gc.Equals, GOSSIP)
+		c.Assert(o.started.RemoteAddr.String(), gc.Equals, "10.1.2.3:11370")
+		c.Assert(o.started.RemoteConfig, gc.NotNil)
+		c.Assert(o.recovered.RemoteElements, gc.HasLen, 1)
+		c.Assert(o.recovered.RemoteElements[0].Cmp(onlyServer), gc.Equals, 0)
+		c.Assert(o.stats.Err, gc.IsNil)
+		c.Assert(o.stats.ElementsRecovered, gc.Equals, 1)
+		c.Assert(o.stats.BytesSent > 0, gc.Equals, true)
+		c.Assert(o.stats.BytesReceived > 0, gc.Equals, true)
+	}
+	c.Assert(serverObs.events, gc.DeepEquals, []string{"start", "recovered", "end"})
+	c.Assert(serverObs.started.Role, gc.Equals, SERVE)
+
+	client.RemoveObserver(&otherObs)
+	client.Insert(onlyServer)
+	client.Flush()
+	c.Assert(clientObs.batches, gc.HasLen, 1)
+	c.Assert(clientObs.batches[0].Inserted, gc.HasLen, 1)
+	c.Assert(otherObs.batches, gc.HasLen, 0)
+}
+
+// taggedObserver is an observer of an uncomparable type.
+type taggedObserver struct {
+	*recordingObserver
+	tags []string
+}
+
+func (s *ObserverSuite) TestRemoveUncomparable(c *gc.C) {
+	p := NewMemPeer()
+	var obs recordingObserver
+	tagged := taggedObserver{recordingObserver: &recordingObserver{}, tags: []string{"a"}}
+	p.AddObserver(tagged)
+	p.AddObserver(&obs)
+
+	p.RemoveObserver(taggedObserver{recordingObserver: tagged.recordingObserver})
+	p.RemoveObserver(&obs)
+	c.Assert(p.observers, gc.HasLen, 1)
+}
+
+func (s *ObserverSuite) TestHandshakeRejected(c *gc.C) {
+	server := newTestPeer(c)
+	defer server.Stop()
+	server.mutating = true
+	client := newTestPeer(c)
+	defer client.Stop()
+
+	var clientObs, serverObs recordingObserver
+	client.AddObserver(&clientObs)
+	server.AddObserver(&serverObs)
+
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.NotNil)
+	c.Assert(serverErr, gc.NotNil)
+
+	c.Assert(serverObs.events, gc.DeepEquals, []string{"rejected"})
+	c.Assert(serverObs.rejected, gc.Equals, "sync not available, currently mutating")
+	c.Assert(clientObs.events, gc.DeepEquals, []string{"rejected"})
+	c.Assert(clientObs.rejected, gc.Equals, "sync not available, currently mutating")
+}
+
+func (s *ObserverSuite) TestJSONObserver(c *gc.C) {
+	server := newTestPeer(c, cf.Zi(cf.P_SKS, 65537))
+	defer server.Stop()
+	client := newTestPeer(c, cf.Zi(cf.P_SKS, 65539))
+	defer client.Stop()
+
+	var buf bytes.Buffer
+	client.AddObserver(NewJSONObserver(&buf))
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+
+	var events []string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var ev map[string]interface{}
+		c.Assert(json.Unmarshal(scanner.Bytes(), &ev), gc.IsNil)
+		c.Assert(ev["role"], gc.Equals, GOSSIP)
+		c.Assert(ev["remoteAddr"], gc.Equals, "10.1.2.3:11370")
+		events = append(events, ev["event"].(string))
+	}
+	c.Assert(events, gc.DeepEquals, []string{"session-start", "recovered", "session-end"})
+}
@@ -0,0 +1,249 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+var ErrPartnersBackingOff error = errors.New("all recon partners are backing off")
+
+var partnerBackoffMax = time.Hour
+
+// PartnerStatus describes the health of a recon partner, as observed in recon
+// sessions initiated with it.
+type PartnerStatus struct {
+	Addr net.Addr
+
+	// Sessions is the number of recon sessions attempted with the partner.
+	Sessions int
+
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   string
+
+	// ConsecutiveFailures is the number of sessions which have failed since
+	// the last successful session.
+	ConsecutiveFailures int
+
+	// BackoffUntil is the time before which the partner will not be chosen
+	// for gossip, following failures.
+	BackoffUntil time.Time
+
+	// RTT is the round-trip time of the config handshake in the last
+	// successful session.
+	RTT time.Duration
+
+	// ElementsRecovered is the total number of elements recovered from the
+	// partner.
+	ElementsRecovered int
+
+	// Weight is the relative likelihood of the partner being chosen for
+	// gossip, favoring partners which have recently been productive.
+	Weight float64
+}
+
+// partnerState tracks the health of a partner between sessions.
+type partnerState struct {
+	PartnerStatus
+
+	// productivity is a moving average of elements recovered per session.
+	productivity float64
+}
+
+func (ps *partnerState) weight() float64 {
+	if ps == nil {
+		return 1
+	}
+	return 1 + math.Log1p(ps.productivity)
+}
+
+// partnerTable holds the state of recon partners, keyed by address.
+type partnerTable struct {
+	mu     sync.Mutex
+	states map[string]*partnerState
+}
+
+func newPartnerTable() *partnerTable {
+	return &partnerTable{states: make(map[string]*partnerState)}
+}
+
+// backoff returns the time to wait before choosing a partner again after
+// consecutive failures, doubling from base with each failure.
+func backoff(base time.Duration, failures int) time.Duration {
+	d := base
+	for i := 1; i < failures && d < partnerBackoffMax; i++ {
+		d *= 2
+	}
+	if d > partnerBackoffMax {
+		d = partnerBackoffMax
+	}
+	return d
+}
+
+// record updates the state of the partner at addr following a session.
+// Failing partners back off starting from base.
+func (pt *partnerTable) record(addr net.Addr, s *session, err error, base time.Duration) {
+	switch errgo.Cause(err) {
+	case context.Canceled, context.DeadlineExceeded:
+		// Sessions interrupted locally say nothing about the partner.
+		return
+	}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	ps, ok := pt.states[addr.String()]
+	if !ok {
+		ps = &partnerState{PartnerStatus: PartnerStatus{Addr: addr}}
+		pt.states[addr.String()] = ps
+	}
+
+	now := time.Now()
+	ps.Sessions++
+	ps.LastAttempt = now
+	if err != nil {
+		ps.LastError = err.Error()
+		if isBusy(err) {
+			// The partner is busy, but otherwise healthy. It may ask to be
+			// left alone for a while.
+			if d := RetryAfter(err); d > 0 {
+				if d > partnerBackoffMax {
+					d = partnerBackoffMax
+				}
+				ps.BackoffUntil = now.Add(d)
+			}
+			return
+		}
+		ps.ConsecutiveFailures++
+		ps.BackoffUntil = now.Add(backoff(base, ps.ConsecutiveFailures))
+		ps.productivity /= 2
+		return
+	}
+
+	ps.LastSuccess = now
+	ps.LastError = ""
+	ps.ConsecutiveFailures = 0
+	ps.BackoffUntil = time.Time{}
+	if s != nil {
+		ps.RTT = s.rtt
+		ps.ElementsRecovered += s.recovered
+		ps.productivity = (ps.productivity + float64(s.recovered)) / 2
+	}
+}
+
+// choose chooses up to n distinct partners at random, weighted toward
+// productive partners, and excluding those backing off. The state of
+// addresses no longer among partners, such as removed partners and evicted
+// discovered peers, is forgotten.
+func (pt *partnerTable) choose(partners []net.Addr, n int) ([]net.Addr, error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	current := make(map[string]bool, len(partners))
+	for _, addr := range partners {
+		current[addr.String()] = true
+	}
+	for key := range pt.states {
+		if !current[key] {
+			delete(pt.states, key)
+		}
+	}
+
+	now := time.Now()
+	var candidates []net.Addr
+	var weights []float64
+	var total float64
+	for _, addr := range partners {
+		ps := pt.states[addr.String()]
+		if ps != nil && now.Before(ps.BackoffUntil) {
+			continue
+		}
+		w := ps.weight()
+		candidates = append(candidates, addr)
+		weights = append(weights, w)
+		total += w
+	}
+	if len(candidates) == 0 {
+		return nil, errgo.Mask(ErrPartnersBackingOff, IsGossipBlocked)
+	}
+
+	var chosen []net.Addr
+	for len(chosen) < n && len(candidates) > 0 {
+		i := weightedIndex(weights, total)
+		chosen = append(chosen, candidates[i])
+		total -= weights[i]
+		candidates = append(candidates[:i], candidates[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return chosen, nil
+}
+
+func weightedIndex(weights []float64, total float64) int {
+	x := rand.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return i
+		}
+		x -= w
+	}
+	return len(weights) - 1
+}
+
+// status returns the status of partners.
+func (pt *partnerTable) status(partners []net.Addr) []PartnerStatus {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	var result []PartnerStatus
+	for _, addr := range partners {
+		status := PartnerStatus{Addr: addr}
+		ps := pt.states[addr.String()]
+		if ps != nil {
+			status = ps.PartnerStatus
+		}
+		status.Weight = ps.weight()
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Addr.String() < result[j].Addr.String()
+	})
+	return result
+}
+
+// PartnerStatus returns the health of each configured or discovered recon
+// partner, for use in status reporting.
+func (p *Peer) PartnerStatus() ([]PartnerStatus, error) {
+	partners, err := p.gossipPartners()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return p.partners.status(partners), nil
+}
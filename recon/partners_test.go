@@ -0,0 +1,170 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type PartnersSuite struct{}
+
+var _ = gc.Suite(&PartnersSuite{})
+
+var (
+	partnerA = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 11370}
+	partnerB = &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 11370}
+)
+
+func (s *PartnersSuite) TestBackoff(c *gc.C) {
+	pt := newPartnerTable()
+	partners := []net.Addr{partnerA, partnerB}
+
+	pt.record(partnerA, nil, errors.New("connection refused"), time.Minute)
+	pt.record(partnerA, nil, errors.New("connection refused"), time.Minute)
+	status := pt.status(partners)
+	c.Assert(status, gc.HasLen, 2)
+	c.Assert(status[0].Addr, gc.Equals, partnerA)
+	c.Assert(status[0].ConsecutiveFailures, gc.Equals, 2)
+	c.Assert(status[0].LastError, gc.Equals, "connection refused")
+	backoffLeft := status[0].BackoffUntil.Sub(time.Now())
+	c.Assert(backoffLeft > time.Minute && backoffLeft <= 2*time.Minute, gc.Equals, true)
+	c.Assert(status[1].Sessions, gc.Equals, 0)
+
+	for i := 0; i < 10; i++ {
+		chosen, err := pt.choose(partners, 2)
+		c.Assert(err, gc.IsNil)
+		c.Assert(chosen, gc.DeepEquals, []net.Addr{partnerB})
+	}
+
+	_, err := pt.choose([]net.Addr{partnerA}, 1)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPartnersBackingOff)
+
+	pt.record(partnerA, &session{recovered: 3}, nil, time.Minute)
+	status = pt.status(partners)
+	c.Assert(status[0].ConsecutiveFailures, gc.Equals, 0)
+	c.Assert(status[0].BackoffUntil.IsZero(), gc.Equals, true)
+	c.Assert(status[0].ElementsRecovered, gc.Equals, 3)
+}
+
+func (s *PartnersSuite) TestBackoffRejected(c *gc.C) {
+	pt := newPartnerTable()
+	partners := []net.Addr{partnerA, partnerB}
+
+	// A busy partner is not penalised, but an incompatible one is.
+	pt.record(partnerA, nil, errgo.WithCausef(nil, ErrPeerBusy, "busy"), time.Minute)
+	pt.record(partnerB, nil, errgo.NoteMask(ErrRemoteRejectedConfig, "mismatched filters", errgo.Any), time.Minute)
+	pt.record(partnerB, nil, errgo.NoteMask(ErrRemoteRejectedConfig, "mismatched filters", errgo.Any), time.Minute)
+	status := pt.status(partners)
+	c.Assert(status[0].ConsecutiveFailures, gc.Equals, 0)
+	c.Assert(status[0].BackoffUntil.IsZero(), gc.Equals, true)
+	c.Assert(status[1].ConsecutiveFailures, gc.Equals, 2)
+	backoffLeft := status[1].BackoffUntil.Sub(time.Now())
+	c.Assert(backoffLeft > time.Minute && backoffLeft <= 2*time.Minute, gc.Equals, true)
+}
+
+func (s *PartnersSuite) TestBackoffLimit(c *gc.C) {
+	c.Assert(backoff(time.Minute, 1), gc.Equals, time.Minute)
+	c.Assert(backoff(time.Minute, 3), gc.Equals, 4*time.Minute)
+	c.Assert(backoff(time.Minute, 100), gc.Equals, partnerBackoffMax)
+}
+
+func (s *PartnersSuite) TestPrune(c *gc.C) {
+	pt := newPartnerTable()
+	pt.record(partnerA, nil, nil, time.Minute)
+	pt.record(partnerB, nil, errors.New("connection refused"), time.Minute)
+	c.Assert(pt.states, gc.HasLen, 2)
+
+	chosen, err := pt.choose([]net.Addr{partnerA}, 2)
+	c.Assert(err, gc.IsNil)
+	c.Assert(chosen, gc.DeepEquals, []net.Addr{partnerA})
+	c.Assert(pt.states, gc.HasLen, 1)
+	c.Assert(pt.states[partnerA.String()], gc.NotNil)
+}
+
+func (s *PartnersSuite) TestWeighted(c *gc.C) {
+	pt := newPartnerTable()
+	partners := []net.Addr{partnerA, partnerB}
+	pt.record(partnerA, &session{recovered: 1000}, nil, time.Minute)
+	pt.record(partnerB, &session{}, nil, time.Minute)
+
+	status := pt.status(partners)
+	c.Assert(status[0].Weight > status[1].Weight, gc.Equals, true)
+
+	counts := make(map[net.Addr]int)
+	for i := 0; i < 1000; i++ {
+		chosen, err := pt.choose(partners, 1)
+		c.Assert(err, gc.IsNil)
+		c.Assert(chosen, gc.HasLen, 1)
+		counts[chosen[0]]++
+	}
+	c.Assert(counts[partnerA] > 2*counts[partnerB], gc.Equals, true, gc.Commentf("%v", counts))
+}
+
+func (s *PartnersSuite) TestPeerPartnerStatus(c *gc.C) {
+	server := newTestPeer(c, cf.Zi(cf.P_SKS, 65537))
+	defer server.Stop()
+	client := newTestPeer(c)
+	defer client.Stop()
+	client.settings.Partners["a"] = Partner{HTTPAddr: "10.1.2.3:11371", ReconAddr: "10.1.2.3:11370"}
+
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+	<-client.RecoverChan
+
+	status, err := client.PartnerStatus()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status, gc.HasLen, 1)
+	c.Assert(status[0].Addr.String(), gc.Equals, "10.1.2.3:11370")
+	c.Assert(status[0].Sessions, gc.Equals, 1)
+	c.Assert(status[0].ConsecutiveFailures, gc.Equals, 0)
+	c.Assert(status[0].LastSuccess.IsZero(), gc.Equals, false)
+	c.Assert(status[0].RTT > 0, gc.Equals, true)
+	c.Assert(status[0].ElementsRecovered, gc.Equals, 1)
+}
+
+func (s *PartnersSuite) TestPeerBusy(c *gc.C) {
+	server := newTestPeer(c)
+	defer server.Stop()
+	server.mutating = true
+	client := newTestPeer(c)
+	defer client.Stop()
+	client.settings.Partners["a"] = Partner{HTTPAddr: "10.1.2.3:11371", ReconAddr: "10.1.2.3:11370"}
+
+	// Rejections while the partner is mutating are not failures, but the
+	// partner is left alone for as long as it asks.
+	clientErr, _ := pipeSession(c, client, server)
+	c.Assert(errgo.Cause(clientErr), gc.Equals, ErrPeerBusy)
+	status, err := client.PartnerStatus()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status, gc.HasLen, 1)
+	c.Assert(status[0].ConsecutiveFailures, gc.Equals, 0)
+	backoffLeft := status[0].BackoffUntil.Sub(time.Now())
+	c.Assert(backoffLeft > 0 && backoffLeft <= busyRetryAfter, gc.Equals, true)
+}
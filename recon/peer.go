@@ -23,6 +23,7 @@ package recon
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -44,9 +45,17 @@ var ErrNodeNotFound error = errors.New("prefix-tree node not found")
 var ErrRemoteRejectedConfig error = errors.New("remote rejected configuration")
 
 type Recover struct {
+	// Dataset is the name of the dataset the elements were recovered for,
+	// empty for the default dataset.
+	Dataset string
+
 	RemoteAddr     net.Addr
 	RemoteConfig   *Config
 	RemoteElements []*cf.Zp
+
+	// RemoteRecords contains the content of recovered elements fetched from
+	// the remote peer, if both peers have a ContentStore.
+	RemoteRecords []*Record
 }
 
 func (r *Recover) String() string {
@@ -77,18 +86,16 @@ var (
 )
 
 type Peer struct {
-	settings *Settings
-	ptree    PrefixTree
+	ptree PrefixTree
 
 	RecoverChan RecoverChan
 
 	muDie sync.Mutex
 	t     tomb.Tomb
 
-	wg sync.WaitGroup
-
 	mu       sync.RWMutex
-	full     bool
+	readers  int
+	released *sync.Cond
 	mutating bool
 	once     *sync.Once
 
@@ -97,14 +104,42 @@ type Peer struct {
 	removeElements []*cf.Zp
 
 	mutatedFunc func()
+
+	recoverQ   *recoverQueue
+	partners   *partnerTable
+	membership *membershipView
+	limiter    *sessionLimiter
+	status     *statusTracker
+
+	muDatasets sync.RWMutex
+	datasets   map[string]*Peer
+
+	muSettings sync.RWMutex
+	settings   *Settings
+	matcher    IPMatcher
+
+	muHooks        sync.RWMutex
+	contentStore   ContentStore
+	dialer         Dialer
+	listener       Listener
+	recoverJournal RecoverJournal
+	metrics        Metrics
+	observers      []PeerObserver
 }
 
 func NewPeer(settings *Settings, tree PrefixTree) *Peer {
-	return &Peer{
+	p := &Peer{
 		RecoverChan: make(RecoverChan, 1),
 		settings:    settings,
 		ptree:       tree,
+		recoverQ:    newRecoverQueue(settings.RecoverQueueCapacity),
+		partners:    newPartnerTable(),
+		membership:  newMembershipView(),
+		limiter:     newSessionLimiter(),
+		status:      newStatusTracker(),
 	}
+	p.released = sync.NewCond(&p.mu)
+	return p
 }
 
 func NewMemPeer() *Peer {
@@ -119,7 +154,7 @@ func (p *Peer) log(label string) *log.Entry {
 }
 
 func (p *Peer) logFields(label string, fields log.Fields) *log.Entry {
-	fields["label"] = fmt.Sprintf("%s %s", label, p.settings.ReconAddr)
+	fields["label"] = fmt.Sprintf("%s %s", label, p.getSettings().ReconAddr)
 	return log.WithFields(fields)
 }
 
@@ -128,6 +163,8 @@ func (p *Peer) logErr(label string, err error) *log.Entry {
 }
 
 func (p *Peer) StartMode(mode PeerMode) {
+	p.status.start(mode)
+	p.t.Go(p.replayJournal)
 	switch mode {
 	case PeerModeGossipOnly:
 		p.t.Go(p.Gossip)
@@ -140,6 +177,8 @@ func (p *Peer) StartMode(mode PeerMode) {
 }
 
 func (p *Peer) Start() {
+	p.status.start(PeerModeDefault)
+	p.t.Go(p.replayJournal)
 	p.t.Go(p.Serve)
 	p.t.Go(p.Gossip)
 }
@@ -161,12 +200,14 @@ func (p *Peer) Insert(zs ...*cf.Zp) {
 	p.muElements.Lock()
 	defer p.muElements.Unlock()
 	p.insertElements = append(p.insertElements, zs...)
+	p.getMetrics().PendingMutations(len(p.insertElements), len(p.removeElements))
 }
 
 func (p *Peer) Remove(zs ...*cf.Zp) {
 	p.muElements.Lock()
 	defer p.muElements.Unlock()
 	p.removeElements = append(p.removeElements, zs...)
+	p.getMetrics().PendingMutations(len(p.insertElements), len(p.removeElements))
 }
 
 func (p *Peer) SetMutatedFunc(f func()) {
@@ -176,16 +217,22 @@ func (p *Peer) SetMutatedFunc(f func()) {
 }
 
 func (p *Peer) readAcquire() bool {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+	return p.acquireReader(true)
+}
+
+// acquireReader is like readAcquire, but only refuses for a full recovery
+// queue if recovering.
+func (p *Peer) acquireReader(recovering bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
 	if !p.mutating {
-		if p.full {
-			// Outbound recovery channel is full.
+		if recovering && p.recoverQ.full() {
+			// Outbound recovery queue is full.
 			return false
 		}
 
-		p.wg.Add(1)
+		p.readers++
 
 		if p.once == nil {
 			p.once = &sync.Once{}
@@ -196,6 +243,16 @@ func (p *Peer) readAcquire() bool {
 	return false
 }
 
+func (p *Peer) readRelease() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readers--
+	if p.readers == 0 {
+		p.released.Broadcast()
+	}
+}
+
 func (p *Peer) isDying() bool {
 	select {
 	case <-p.t.Dying():
@@ -213,9 +270,10 @@ func (p *Peer) mutate() {
 	}
 
 	p.t.Go(func() error {
-		p.wg.Wait()
-
 		p.mu.Lock()
+		for p.readers > 0 {
+			p.released.Wait()
+		}
 		p.mutating = true
 		p.once = nil
 		p.mu.Unlock()
@@ -224,7 +282,6 @@ func (p *Peer) mutate() {
 
 		p.mu.Lock()
 		p.mutating = false
-		p.full = false
 		p.mu.Unlock()
 
 		return nil
@@ -233,6 +290,7 @@ func (p *Peer) mutate() {
 
 func (p *Peer) flush() {
 	p.muElements.Lock()
+	start := time.Now()
 
 	for _, z := range p.insertElements {
 		err := p.ptree.Insert(z)
@@ -254,50 +312,70 @@ func (p *Peer) flush() {
 		p.logFields("mutate", log.Fields{"elements": len(p.removeElements)}).Debugf("removed")
 	}
 
+	m := p.getMetrics()
+	if n := len(p.insertElements) + len(p.removeElements); n > 0 {
+		batch := &MutationBatch{
+			Inserted: p.insertElements,
+			Removed:  p.removeElements,
+			Duration: time.Since(start),
+		}
+		m.TreeMutated(n, batch.Duration)
+		p.observe(func(o PeerObserver) { o.Mutated(batch) })
+	}
 	p.insertElements = nil
 	p.removeElements = nil
+	m.PendingMutations(0, 0)
 	if p.mutatedFunc != nil {
 		p.mutatedFunc()
 	}
 	p.muElements.Unlock()
 }
 
+// Serve accepts recon sessions from remote peers, acting as a server, until
+// the peer is stopped.
 func (p *Peer) Serve() error {
-	addr, err := p.settings.ReconNet.Resolve(p.settings.ReconAddr)
+	return p.ServeContext(context.Background())
+}
+
+// ServeContext is like Serve, but also stops listening when ctx is done. ctx
+// is passed on to each accepted session.
+func (p *Peer) ServeContext(ctx context.Context) error {
+	ctx, cancel := p.sessionContext(ctx)
+	defer cancel()
+
+	settings := p.getSettings()
+	addr, err := settings.ReconNet.Resolve(settings.ReconAddr)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	matcher, err := p.settings.Matcher()
+	_, err = p.getMatcher()
 	if err != nil {
 		log.Errorf("cannot create matcher: %v", err)
 		return errgo.Mask(err)
 	}
 
-	ln, err := net.Listen(addr.Network(), addr.String())
+	ln, err := p.getListener().Listen(ctx, addr.Network(), addr.String())
 	if err != nil {
 		return errgo.Mask(err)
 	}
 	p.t.Go(func() error {
-		<-p.t.Dying()
+		<-ctx.Done()
 		return ln.Close()
 	})
+	p.t.Go(func() error {
+		p.resolvePartners(ctx)
+		return nil
+	})
 
 	for {
 		conn, err := ln.Accept()
-		if err != nil {
-			return errgo.Mask(err)
-		}
-
-		if tcConn, ok := conn.(*net.TCPConn); ok {
-			tcConn.SetKeepAlive(true)
-			tcConn.SetKeepAlivePeriod(3 * time.Minute)
-
-			remoteAddr := tcConn.RemoteAddr().(*net.TCPAddr)
-			if !matcher.Match(remoteAddr.IP) {
-				log.Warningf("connection rejected from %q", remoteAddr)
+		if ctx.Err() != nil {
+			if conn != nil {
 				conn.Close()
-				continue
 			}
+			return nil
+		} else if err != nil {
+			return errgo.Mask(err)
 		}
 
 		p.muDie.Lock()
@@ -305,21 +383,72 @@ func (p *Peer) Serve() error {
 			conn.Close()
 			return nil
 		}
+		if p.trustedProxy(conn) {
+			// Read the PROXY header without blocking further accepts.
+			p.admitProxied(ctx, conn)
+		} else {
+			err = p.admit(ctx, conn)
+		}
+		p.muDie.Unlock()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+}
+
+// admit applies access control and session limits to an accepted
+// connection, and then either accepts or rejects a recon session on it.
+func (p *Peer) admit(ctx context.Context, conn net.Conn) error {
+	// Connections without an IP address, such as unix sockets, are not
+	// subject to matching or per-IP limits.
+	matcher, err := p.getMatcher()
+	if err != nil {
+		conn.Close()
+		return errgo.Mask(err)
+	}
+	ip, ok := remoteIP(conn.RemoteAddr())
+	if ok {
+		if allowed, reason := matchReason(matcher, ip); !allowed && !p.datasetAllows(ip) {
+			p.logFields(SERVE, log.Fields{
+				"remoteAddr": conn.RemoteAddr(),
+				"reason":     reason,
+			}).Warning("connection rejected")
+			conn.Close()
+			return nil
+		}
+	}
+	release, reason := p.limiter.acquire(p.getSettings(), ip, time.Now())
+	if reason != "" {
+		if !p.limiter.startReject() {
+			p.logFields(SERVE, log.Fields{
+				"remoteAddr": conn.RemoteAddr(),
+				"reason":     reason,
+			}).Debug("too many rejections pending, closing connection")
+			conn.Close()
+			return nil
+		}
 		p.t.Go(func() error {
-			err = p.Accept(conn)
-			if errgo.Cause(err) == ErrPeerBusy {
-				p.logErr(GOSSIP, err).Debug()
-			} else if err != nil {
-				p.logErr(SERVE, err).Errorf("recon with %v failed", conn.RemoteAddr())
-			}
+			defer p.limiter.endReject()
+			p.rejectEarly(conn, reason)
 			return nil
 		})
-		p.muDie.Unlock()
+		return nil
 	}
+	// Keepalives are set here, once the address of a proxied client is known.
+	setKeepAlive(conn, p.getSettings().sessionTimeouts(conn.RemoteAddr(), p.partnerIPs()).keepAlive)
+	p.t.Go(func() error {
+		defer release()
+		err := p.AcceptContext(ctx, conn)
+		if errgo.Cause(err) == ErrPeerBusy {
+			p.logErr(GOSSIP, err).Debug()
+		} else if err != nil {
+			p.logErr(SERVE, err).Errorf("recon with %v failed", conn.RemoteAddr())
+		}
+		return nil
+	})
+	return nil
 }
 
-var defaultTimeout = 300 * time.Second
-
 func (p *Peer) setReadDeadline(conn net.Conn, d time.Duration) {
 	err := conn.SetReadDeadline(time.Now().Add(d))
 	if err != nil {
@@ -327,22 +456,44 @@ func (p *Peer) setReadDeadline(conn net.Conn, d time.Duration) {
 	}
 }
 
-func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Config, _err error) {
+func (p *Peer) handleConfig(s *session, conn net.Conn, failResp string) (_ *Config, _err error) {
+	role := s.Role
 	w := bufio.NewWriter(conn)
-	p.setReadDeadline(conn, defaultTimeout)
+	p.setReadDeadline(conn, s.timeouts.read)
 
-	config, err := p.settings.Config()
+	config, err := p.config(s.settings)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if s.dryRun != nil && role == GOSSIP {
+		config.Custom[customDryRun] = dryRunRequested
+	}
+	if s.direction != DirectionBoth {
+		config.Custom[customDirection] = string(s.direction)
+	}
+	if s.settings.MembershipSecret != "" && s.dryRun == nil && s.replay == nil {
+		s.nonce, err = newMembershipNonce()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		config.Custom[customMembershipNonce] = s.nonce
+	}
+	if s.replay != nil && s.replay.config != nil {
+		// The recorded config depended on the settings and nonce of the
+		// recorded session.
+		config = s.replay.config
+		s.nonce = config.Custom[customMembershipNonce]
+	}
+	s.config = config
 
 	var handshake tomb.Tomb
+	start := time.Now()
 	result := make(chan *Config)
 
 	// Send config to server on connect
 	handshake.Go(func() error {
 		p.logFields(role, log.Fields{"config": config}).Debug("writing config")
-		err := WriteMsg(w, config)
+		err := p.writeMsg(w, config)
 		if err != nil {
 			return errgo.Mask(err)
 		}
@@ -359,7 +510,7 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 
 		p.logFields(role, log.Fields{"remoteAddr": conn.RemoteAddr()}).Debug("reading remote config")
 		var msg ReconMsg
-		msg, err = ReadMsg(conn)
+		msg, err = p.readMsg(s, conn)
 		if err != nil {
 			return errgo.Mask(err)
 		}
@@ -382,9 +533,30 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 	}
 
 	p.logFields(role, log.Fields{"remoteConfig": remoteConfig}).Debug()
+	s.RemoteConfig = remoteConfig
+	s.rtt = time.Since(start)
 
+	// Dry runs report differences in both directions.
+	if s.dryRun == nil && remoteConfig.Custom[customDryRun] != dryRunRequested {
+		s.send, s.receive = negotiateDirection(s.direction, Direction(remoteConfig.Custom[customDirection]))
+	}
+
+	failCause := ErrPeerBusy
 	if failResp == "" {
-		if remoteConfig.BitQuantum != config.BitQuantum {
+		failCause = ErrIncompatiblePeer
+		if !s.send && !s.receive {
+			failResp = "incompatible sync directions"
+			p.logFields(role, log.Fields{
+				"remoteDirection": remoteConfig.Custom[customDirection],
+				"localDirection":  s.direction,
+			}).Error("incompatible sync directions")
+		} else if remoteConfig.Custom[customDataset] != s.settings.Dataset {
+			failResp = "mismatched dataset"
+			p.logFields(role, log.Fields{
+				"remoteDataset": remoteConfig.Custom[customDataset],
+				"localDataset":  s.settings.Dataset,
+			}).Error("mismatched dataset")
+		} else if remoteConfig.BitQuantum != config.BitQuantum {
 			failResp = "mismatched bitquantum"
 			p.logFields(role, log.Fields{
 				"remoteBitquantum": remoteConfig.BitQuantum,
@@ -396,11 +568,24 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 				"remoteMBar": remoteConfig.MBar,
 				"localMBar":  config.MBar,
 			}).Error("mismatched MBar")
+		} else if !s.settings.filtersCompatible(remoteConfig.Filters) {
+			fields := log.Fields{
+				"remoteFilters": remoteConfig.Filters,
+				"localFilters":  config.Filters,
+			}
+			if s.settings.FilterPolicy == FilterPolicyWarn {
+				p.logFields(role, fields).Warn("mismatched filters")
+			} else {
+				failResp = "mismatched filters"
+				p.logFields(role, fields).Error("mismatched filters")
+			}
 		}
 	}
 
 	if failResp != "" {
-		err = conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+		p.observe(func(o PeerObserver) { o.HandshakeRejected(&s.SessionInfo, failResp, false) })
+
+		err = conn.SetWriteDeadline(time.Now().Add(s.timeouts.reject))
 		if err != nil {
 			p.logErr(role, err)
 		}
@@ -409,7 +594,11 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 		if err != nil {
 			p.logErr(role, err)
 		}
-		err = WriteString(w, failResp)
+		var retryAfter time.Duration
+		if failCause == ErrPeerBusy {
+			retryAfter = busyRetryAfter
+		}
+		err = WriteString(w, formatReason(failResp, errorCode(failCause), retryAfter))
 		if err != nil {
 			p.logErr(role, err)
 		}
@@ -418,7 +607,7 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 			p.logErr(role, err)
 		}
 
-		return nil, errgo.Newf("cannot peer: %v", failResp)
+		return nil, errgo.WithCausef(nil, failCause, "cannot peer: %v", failResp)
 	}
 
 	var acknowledge tomb.Tomb
@@ -434,6 +623,8 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 		return nil
 	})
 
+	var rejectErr error
+	var rejectReason string
 	acknowledge.Go(func() error {
 		remoteConfigStatus, err := ReadString(conn)
 		if err != nil {
@@ -442,24 +633,73 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 		if remoteConfigStatus != RemoteConfigPassed {
 			reason, err := ReadString(conn)
 			if err != nil {
-				return errgo.WithCausef(err, ErrRemoteRejectedConfig, "remote rejected config")
+				rejectErr = errgo.WithCausef(err, ErrRemoteRejectedConfig, "remote rejected config")
+			} else {
+				text, code, retryAfter := parseReason(reason)
+				rejectReason = text
+				rejectErr = &RemoteError{Code: code, Reason: text, RetryAfter: retryAfter, rejected: true}
 			}
-			return errgo.NoteMask(ErrRemoteRejectedConfig, reason)
+			return rejectErr
 		}
 		return nil
 	})
 
-	// Ensure we were able to complete acknowledgement.
+	// Ensure we were able to complete acknowledgement. A rejection takes
+	// precedence over failing to write our own acknowledgement, as the
+	// remote peer may close the connection once it has rejected us.
 	err = acknowledge.Wait()
-	if err != nil {
-		return nil, errgo.Mask(err)
+	if rejectErr != nil {
+		p.observe(func(o PeerObserver) { o.HandshakeRejected(&s.SessionInfo, rejectReason, true) })
+		return nil, errgo.Mask(rejectErr, errgo.Any)
+	} else if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
 	}
 
+	p.startSession(s)
 	return remoteConfig, nil
 }
 
-func (p *Peer) Accept(conn net.Conn) (_err error) {
+// Accept handles a recon session with a remote peer on conn, acting as the
+// server.
+func (p *Peer) Accept(conn net.Conn) error {
+	return p.AcceptContext(context.Background(), conn)
+}
+
+// AcceptContext is like Accept, but the session is abandoned when ctx is
+// done. A deadline on ctx bounds all reads and writes in the session.
+func (p *Peer) AcceptContext(ctx context.Context, conn net.Conn) error {
+	return p.accept(ctx, conn, sessionOptions{})
+}
+
+// accept handles a recon session on conn, acting as the server. Only the
+// replay option applies.
+func (p *Peer) accept(ctx context.Context, conn net.Conn, opts sessionOptions) (_err error) {
+	if p.hasDatasets() {
+		target, dconn, err := p.dispatch(conn)
+		if err != nil {
+			conn.Close()
+			return errgo.Mask(err)
+		}
+		conn = dconn
+		if target != p {
+			return target.accept(ctx, conn, opts)
+		}
+	}
+	ctx, cancel := p.sessionContext(ctx)
+	defer cancel()
+	conn = newContextConn(ctx, conn)
 	defer conn.Close()
+	var s *session
+	s, conn = p.newSession(SERVE, conn)
+	s.replay = opts.replay
+	s.direction = s.settings.partnerDirection(conn.RemoteAddr(), p.partnerIPs())
+	defer p.recordSession(SERVE)(&_err)
+	defer func() {
+		p.endSession(s, _err)
+	}()
+	defer func() {
+		_err = contextErr(ctx, _err)
+	}()
 
 	p.logFields(SERVE, log.Fields{
 		"remoteAddr": conn.RemoteAddr(),
@@ -472,18 +712,25 @@ func (p *Peer) Accept(conn net.Conn) (_err error) {
 
 	var failResp string
 	if p.readAcquire() {
-		defer p.wg.Done()
+		defer p.readRelease()
 	} else {
-		failResp = "sync not available, currently mutating"
+		failResp = busyReason
 	}
 
-	remoteConfig, err := p.handleConfig(conn, SERVE, failResp)
+	remoteConfig, err := p.handleConfig(s, conn, failResp)
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Any)
 	}
 
 	if failResp == "" {
-		return p.interactWithClient(conn, remoteConfig, cf.NewBitstring(0))
+		if remoteConfig.Custom[customDryRun] == dryRunRequested {
+			s.dryRun = newDryRun()
+		}
+		err = p.exchangeMembership(s, conn, remoteConfig)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return p.interactWithClient(s, conn, remoteConfig, cf.NewBitstring(0))
 	}
 	return nil
 }
@@ -535,6 +782,7 @@ const maxRequestQueueLen = 60000
 
 type reconWithClient struct {
 	*Peer
+	session  *session
 	requestQ []*requestEntry
 	bottomQ  []*bottomEntry
 	rcvrSet  *cf.ZSet
@@ -542,6 +790,49 @@ type reconWithClient struct {
 	conn     net.Conn
 	bwr      *bufio.Writer
 	messages []ReconMsg
+	replies  <-chan *msgResult
+}
+
+type msgResult struct {
+	msg ReconMsg
+	err error
+}
+
+// readMessages decodes messages from conn in a separate goroutine, delivering
+// them on the returned channel until a read fails or stop is closed.
+func (p *Peer) readMessages(s *session, conn net.Conn, stop <-chan struct{}) <-chan *msgResult {
+	out := make(chan *msgResult)
+	go func() {
+		defer close(out)
+		for {
+			p.setReadDeadline(conn, s.timeouts.read)
+			msg, err := p.readMsg(s, conn)
+			select {
+			case out <- &msgResult{msg: msg, err: err}:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// readReply waits up to timeout for the next message from the client.
+func (rwc *reconWithClient) readReply(timeout time.Duration) (ReconMsg, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result, ok := <-rwc.replies:
+		if !ok {
+			return nil, errgo.New("connection closed")
+		}
+		return result.msg, result.err
+	case <-timer.C:
+		return nil, errgo.Newf("timeout waiting for reply after %v", timeout)
+	}
 }
 
 func (rwc *reconWithClient) pushBottom(bottom *bottomEntry) {
@@ -595,7 +886,7 @@ func (rwc *reconWithClient) sendRequest(p *Peer, req *requestEntry) error {
 	}
 
 	var msg ReconMsg
-	if req.node.IsLeaf() || (req.node.Size() < p.settings.MBar) {
+	if req.node.IsLeaf() || (req.node.Size() < rwc.session.settings.MBar) {
 		elements, err := req.node.Elements()
 		if err != nil {
 			return err
@@ -623,6 +914,8 @@ func (rwc *reconWithClient) handleReply(p *Peer, msg ReconMsg, req *requestEntry
 			return errgo.New("Syncfail received at leaf node")
 		}
 		rwc.Peer.log(SERVE).Debug("SyncFail: pushing children")
+		rwc.Peer.getMetrics().SyncFail(req.key.BitLen() / rwc.session.settings.BitQuantum)
+		rwc.Peer.observe(func(o PeerObserver) { o.SyncFailed(&rwc.session.SessionInfo, req.key) })
 		children, err := req.node.Children()
 		if err != nil {
 			return errgo.Mask(err)
@@ -645,12 +938,14 @@ func (rwc *reconWithClient) handleReply(p *Peer, msg ReconMsg, req *requestEntry
 		local := cf.NewZSet(elements...)
 		localNeeds := cf.ZSetDiff(m.ZSet, local)
 		remoteNeeds := cf.ZSetDiff(local, m.ZSet)
-		elementsMsg := &Elements{ZSet: remoteNeeds}
+		elementsMsg := &Elements{ZSet: rwc.session.provide(remoteNeeds)}
 		rwc.Peer.logFields(SERVE, log.Fields{
 			"msg": elementsMsg,
 		}).Debug("handleReply: sending")
 		rwc.messages = append(rwc.messages, elementsMsg)
 		rwc.rcvrSet.AddAll(localNeeds)
+	case *Error:
+		return m.Err()
 	default:
 		return errgo.Newf("unexpected message: %v", m)
 	}
@@ -660,7 +955,7 @@ func (rwc *reconWithClient) handleReply(p *Peer, msg ReconMsg, req *requestEntry
 func (rwc *reconWithClient) flushQueue() error {
 	rwc.Peer.log(SERVE).Debug("flush queue")
 	rwc.messages = append(rwc.messages, &Flush{})
-	err := WriteMsg(rwc.bwr, rwc.messages...)
+	err := rwc.Peer.writeMsg(rwc.bwr, rwc.messages...)
 	if err != nil {
 		return errgo.NoteMask(err, "error writing messages")
 	}
@@ -676,96 +971,132 @@ func (rwc *reconWithClient) flushQueue() error {
 
 var zeroTime time.Time
 
-func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring *cf.Bitstring) error {
+func (p *Peer) interactWithClient(s *session, conn net.Conn, remoteConfig *Config, bitstring *cf.Bitstring) error {
 	p.log(SERVE).Debug("interacting with client")
-	p.setReadDeadline(conn, defaultTimeout)
 
+	stop := make(chan struct{})
+	defer close(stop)
 	recon := reconWithClient{
 		Peer:    p,
+		session: s,
 		conn:    conn,
 		bwr:     bufio.NewWriter(conn),
 		rcvrSet: cf.NewZSet(),
+		replies: p.readMessages(s, conn, stop),
 	}
 	root, err := p.ptree.Root()
 	if err != nil {
 		return err
 	}
 
+	var records []*Record
 	defer func() {
-		p.sendItems(recon.rcvrSet.Items(), conn, remoteConfig)
-	}()
-	defer func() {
-		WriteMsg(recon.bwr, &Done{})
+		p.sendItems(s, recon.rcvrSet.Items(), records)
 	}()
 
 	recon.pushRequest(&requestEntry{node: root, key: bitstring})
-	for !recon.isDone() {
-		bottom := recon.topBottom()
+	err = recon.interact()
+	doneErr := p.writeMsg(recon.bwr, &Done{})
+	if doneErr == nil {
+		doneErr = recon.bwr.Flush()
+	}
+	if err != nil {
+		return err
+	} else if doneErr != nil {
+		return errgo.Mask(doneErr)
+	}
+
+	if s.dryRun != nil {
+		// Report the elements needed to the dry run client.
+		err = p.writeMsg(recon.bwr, &Elements{ZSet: recon.rcvrSet})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(recon.bwr.Flush())
+	}
+	if p.contentFetchEnabled(s, remoteConfig) {
+		readMsg := func() (ReconMsg, error) {
+			return recon.readReply(s.timeouts.read)
+		}
+		records, err = p.fetchContent(SERVE, recon.bwr, readMsg, s.accept(recon.rcvrSet).Items())
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		err = p.serveContent(SERVE, recon.bwr, readMsg)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+func (rwc *reconWithClient) interact() error {
+	p := rwc.Peer
+	var err error
+	for !rwc.isDone() {
+		bottom := rwc.topBottom()
 		p.logFields(SERVE, log.Fields{"bottom": bottom}).Debug("interact")
 		switch {
 		case bottom == nil:
-			req := recon.popRequest()
+			req := rwc.popRequest()
 			p.logFields(SERVE, log.Fields{
 				"popRequest": req,
 			}).Debug("interact: sending...")
-			err = recon.sendRequest(p, req)
+			err = rwc.sendRequest(p, req)
 			if err != nil {
 				return err
 			}
 		case bottom.state == reconStateFlushEnded:
 			p.log(SERVE).Debug("interact: flush ended, popBottom")
-			recon.popBottom()
-			recon.flushing = false
+			rwc.popBottom()
+			rwc.flushing = false
 		case bottom.state == reconStateBottom:
 			p.logFields(SERVE, log.Fields{
-				"queueLength": len(recon.bottomQ),
+				"queueLength": len(rwc.bottomQ),
 			}).Debug()
-			var msg ReconMsg
-			var hasMsg bool
-
-			// Set a small read timeout to simulate non-blocking I/O
-			p.setReadDeadline(conn, time.Millisecond)
-			if err != nil {
-				return errgo.Mask(err)
-			}
-			msg, nbErr := ReadMsg(conn)
-			hasMsg = (nbErr == nil)
-
-			// Restore blocking I/O
-			p.setReadDeadline(conn, defaultTimeout)
-			if err != nil {
-				return errgo.Mask(err)
+			var result *msgResult
+			var ok bool
+
+			// Take a reply if one has already been decoded, without waiting.
+			select {
+			case result, ok = <-rwc.replies:
+				if !ok {
+					return errgo.New("connection closed")
+				}
+			default:
 			}
 
-			if hasMsg {
-				recon.popBottom()
-				err = recon.handleReply(p, msg, bottom.requestEntry)
+			if result != nil {
+				if result.err != nil {
+					return errgo.Mask(result.err)
+				}
+				rwc.popBottom()
+				err = rwc.handleReply(p, result.msg, bottom.requestEntry)
 				if err != nil {
 					return errgo.Mask(err)
 				}
-			} else if len(recon.bottomQ) > p.settings.MaxOutstandingReconRequests ||
-				len(recon.requestQ) == 0 {
-				if !recon.flushing {
-					err = recon.flushQueue()
+			} else if len(rwc.bottomQ) > rwc.session.settings.MaxOutstandingReconRequests ||
+				len(rwc.requestQ) == 0 {
+				if !rwc.flushing {
+					err = rwc.flushQueue()
 					if err != nil {
 						return errgo.Mask(err)
 					}
 				} else {
-					recon.popBottom()
-					p.setReadDeadline(conn, 3*time.Second)
-					msg, err = ReadMsg(conn)
+					rwc.popBottom()
+					msg, err := rwc.readReply(rwc.session.timeouts.reply)
 					if err != nil {
 						return errgo.Mask(err)
 					}
 					p.logFields(SERVE, log.Fields{"msg": msg}).Debug("reply")
-					err = recon.handleReply(p, msg, bottom.requestEntry)
+					err = rwc.handleReply(p, msg, bottom.requestEntry)
 					if err != nil {
 						return errgo.Mask(err)
 					}
 				}
 			} else {
-				req := recon.popRequest()
-				err = recon.sendRequest(p, req)
+				req := rwc.popRequest()
+				err = rwc.sendRequest(p, req)
 				if err != nil {
 					return err
 				}
@@ -776,20 +1107,3 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 	}
 	return nil
 }
-
-func (p *Peer) sendItems(items []*cf.Zp, conn net.Conn, remoteConfig *Config) error {
-	if len(items) > 0 && p.t.Alive() {
-		select {
-		case p.RecoverChan <- &Recover{
-			RemoteAddr:     conn.RemoteAddr(),
-			RemoteConfig:   remoteConfig,
-			RemoteElements: items}:
-			p.log(SERVE).Infof("recovered %d items", len(items))
-		default:
-			p.mu.Lock()
-			p.full = true
-			p.mu.Unlock()
-		}
-	}
-	return nil
-}
@@ -22,9 +22,16 @@
 package recon
 
 import (
+	"context"
+	"errors"
 	"net"
+	"sync"
+	"time"
 
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
 )
 
 type PeerSuite struct{}
@@ -61,3 +68,296 @@ func (s *PeerSuite) TestResolveRecoverAddr(c *gc.C) {
 		c.Assert(testHost, gc.Equals, hkpHost)
 	}
 }
+
+// fragmentedConn delivers reads and writes in small pieces, with a delay
+// between each write, to simulate a slow and fragmented connection.
+type fragmentedConn struct {
+	net.Conn
+	size  int
+	delay time.Duration
+}
+
+func (c *fragmentedConn) Read(buf []byte) (int, error) {
+	if len(buf) > c.size {
+		buf = buf[:c.size]
+	}
+	return c.Conn.Read(buf)
+}
+
+func (c *fragmentedConn) Write(buf []byte) (int, error) {
+	var n int
+	for len(buf) > 0 {
+		m := c.size
+		if m > len(buf) {
+			m = len(buf)
+		}
+		time.Sleep(c.delay)
+		nw, err := c.Conn.Write(buf[:m])
+		n += nw
+		if err != nil {
+			return n, err
+		}
+		buf = buf[m:]
+	}
+	return n, nil
+}
+
+func newTestPeer(c *gc.C, elements ...*cf.Zp) *Peer {
+	p := NewMemPeer()
+	for _, z := range elements {
+		c.Assert(p.ptree.Insert(z), gc.IsNil)
+	}
+	// Keep the peer alive until stopped, as Serve and Gossip would.
+	p.t.Go(func() error {
+		<-p.t.Dying()
+		return nil
+	})
+	return p
+}
+
+func (s *PeerSuite) runSession(c *gc.C, wrap func(net.Conn) net.Conn) {
+	var common, onlyClient, onlyServer []*cf.Zp
+	for i := 1; i < 100; i++ {
+		common = append(common, cf.Zi(cf.P_SKS, 65537*i))
+	}
+	for i := 1; i < 40; i++ {
+		onlyClient = append(onlyClient, cf.Zi(cf.P_SKS, 68111*i))
+	}
+	for i := 1; i < 20; i++ {
+		onlyServer = append(onlyServer, cf.Zi(cf.P_SKS, 70001*i))
+	}
+	client := newTestPeer(c, append(common, onlyClient...)...)
+	defer client.Stop()
+	server := newTestPeer(c, append(common, onlyServer...)...)
+	defer server.Stop()
+
+	clientConn, serverConn := net.Pipe()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Accept(wrap(serverConn))
+	}()
+
+	sess, conn := client.newSession(GOSSIP, wrap(clientConn))
+	remoteConfig, err := client.handleConfig(sess, conn, "")
+	c.Assert(err, gc.IsNil)
+	err = client.clientRecon(sess, conn, remoteConfig)
+	c.Assert(err, gc.IsNil)
+	c.Assert(<-serverErr, gc.IsNil)
+	conn.Close()
+
+	clientRecover := <-client.RecoverChan
+	c.Assert(cf.NewZSet(clientRecover.RemoteElements...).Equal(cf.NewZSet(onlyServer...)), gc.Equals, true)
+	serverRecover := <-server.RecoverChan
+	c.Assert(cf.NewZSet(serverRecover.RemoteElements...).Equal(cf.NewZSet(onlyClient...)), gc.Equals, true)
+}
+
+func (s *PeerSuite) TestSession(c *gc.C) {
+	s.runSession(c, func(conn net.Conn) net.Conn { return conn })
+}
+
+func (s *PeerSuite) TestSessionFragmented(c *gc.C) {
+	s.runSession(c, func(conn net.Conn) net.Conn {
+		return &fragmentedConn{Conn: conn, size: 3}
+	})
+}
+
+func (s *PeerSuite) TestSessionSlow(c *gc.C) {
+	s.runSession(c, func(conn net.Conn) net.Conn {
+		return &fragmentedConn{Conn: conn, size: 5, delay: time.Millisecond}
+	})
+}
+
+func (s *PeerSuite) TestAcceptContextDeadline(c *gc.C) {
+	server := newTestPeer(c)
+	defer server.Stop()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	// The client never completes the handshake.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := server.AcceptContext(ctx, serverConn)
+	c.Assert(errgo.Cause(err), gc.Equals, context.DeadlineExceeded)
+}
+
+func (s *PeerSuite) TestAcceptContextCancel(c *gc.C) {
+	server := newTestPeer(c)
+	defer server.Stop()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	err := server.AcceptContext(ctx, serverConn)
+	c.Assert(errgo.Cause(err), gc.Equals, context.Canceled)
+}
+
+func (s *PeerSuite) TestInitiateReconContextCancel(c *gc.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	defer ln.Close()
+
+	client := newTestPeer(c)
+	defer client.Stop()
+
+	// The listener accepts connections but never responds.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = client.InitiateReconContext(ctx, ln.Addr())
+	c.Assert(errgo.Cause(err), gc.Equals, context.DeadlineExceeded)
+}
+
+// pipeNetwork is an in-memory transport, connecting a Dialer to a Listener
+// with net.Pipe.
+type pipeNetwork struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func newPipeNetwork() *pipeNetwork {
+	return &pipeNetwork{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (n *pipeNetwork) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case n.conns <- server:
+		return client, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.closed:
+		return nil, errors.New("network closed")
+	}
+}
+
+func (n *pipeNetwork) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	return n, nil
+}
+
+func (n *pipeNetwork) Accept() (net.Conn, error) {
+	select {
+	case conn := <-n.conns:
+		return conn, nil
+	case <-n.closed:
+		return nil, errors.New("network closed")
+	}
+}
+
+func (n *pipeNetwork) Close() error {
+	n.closeOnce.Do(func() { close(n.closed) })
+	return nil
+}
+
+func (n *pipeNetwork) Addr() net.Addr { return pipeAddr{} }
+
+func (s *PeerSuite) TestCustomTransport(c *gc.C) {
+	common := []*cf.Zp{cf.Zi(cf.P_SKS, 65537), cf.Zi(cf.P_SKS, 65539)}
+	onlyServer := cf.Zi(cf.P_SKS, 65541)
+	onlyClient := cf.Zi(cf.P_SKS, 65543)
+
+	network := newPipeNetwork()
+	server := newTestPeer(c, append(common, onlyServer)...)
+	server.SetListener(network)
+	server.t.Go(server.Serve)
+	defer server.Stop()
+
+	client := newTestPeer(c, append(common, onlyClient)...)
+	client.SetDialer(network)
+	defer client.Stop()
+
+	partnerAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370}
+	err := client.InitiateRecon(partnerAddr)
+	c.Assert(err, gc.IsNil)
+
+	clientRecover := <-client.RecoverChan
+	c.Assert(clientRecover.RemoteAddr, gc.Equals, partnerAddr)
+	c.Assert(clientRecover.RemoteElements, gc.HasLen, 1)
+	c.Assert(clientRecover.RemoteElements[0].Cmp(onlyServer), gc.Equals, 0)
+	hkpAddr, err := clientRecover.HkpAddr()
+	c.Assert(err, gc.IsNil)
+	c.Assert(hkpAddr, gc.Equals, "10.1.2.3:11371")
+
+	serverRecover := <-server.RecoverChan
+	c.Assert(serverRecover.RemoteElements, gc.HasLen, 1)
+	c.Assert(serverRecover.RemoteElements[0].Cmp(onlyClient), gc.Equals, 0)
+}
+
+// routedNetwork dials a distinct pipeNetwork for each address.
+type routedNetwork map[string]*pipeNetwork
+
+func (n routedNetwork) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	route, ok := n[address]
+	if !ok {
+		return nil, errors.New("no route to " + address)
+	}
+	return route.DialContext(ctx, network, address)
+}
+
+func (s *PeerSuite) TestConcurrentGossip(c *gc.C) {
+	common := cf.Zi(cf.P_SKS, 65537)
+	shared := cf.Zi(cf.P_SKS, 65539)
+	onlyA := cf.Zi(cf.P_SKS, 65541)
+	onlyB := cf.Zi(cf.P_SKS, 65543)
+
+	client := newTestPeer(c, common)
+	defer client.Stop()
+	client.settings.MaxConcurrentGossip = 2
+	routes := routedNetwork{}
+	for _, partner := range []struct {
+		addr     string
+		elements []*cf.Zp
+	}{
+		{"10.1.2.3:11370", []*cf.Zp{common, shared, onlyA}},
+		{"10.1.2.4:11370", []*cf.Zp{common, shared, onlyB}},
+	} {
+		network := newPipeNetwork()
+		server := newTestPeer(c, partner.elements...)
+		server.SetListener(network)
+		server.t.Go(server.Serve)
+		defer server.Stop()
+		routes[partner.addr] = network
+		client.settings.Partners[partner.addr] = Partner{ReconAddr: partner.addr}
+	}
+	client.SetDialer(routes)
+
+	go client.gossipRound(context.Background())
+
+	// Both partners are reconciled, and the element recovered from both is
+	// delivered once.
+	recovered := cf.NewZSet()
+	var n int
+	for i := 0; i < 2; i++ {
+		r := <-client.RecoverChan
+		recovered.AddSlice(r.RemoteElements)
+		n += len(r.RemoteElements)
+	}
+	c.Assert(n, gc.Equals, 3)
+	c.Assert(recovered.Equal(cf.NewZSet(shared, onlyA, onlyB)), gc.Equals, true)
+	select {
+	case r := <-client.RecoverChan:
+		c.Fatalf("unexpected recover %v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	status, err := client.PartnerStatus()
+	c.Assert(err, gc.IsNil)
+	c.Assert(status, gc.HasLen, 2)
+	for _, partner := range status {
+		c.Assert(partner.Sessions, gc.Equals, 1)
+		c.Assert(partner.ConsecutiveFailures, gc.Equals, 0)
+	}
+}
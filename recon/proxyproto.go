@@ -0,0 +1,203 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+)
+
+// proxyHeaderTimeout bounds the time spent reading a PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaxLen is the maximum length of a PROXY protocol v1 header,
+// including the terminating CRLF.
+const proxyV1MaxLen = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// trustedProxy returns whether conn is from a proxy trusted to send a PROXY
+// protocol header identifying the remote peer.
+func (p *Peer) trustedProxy(conn net.Conn) bool {
+	cidrs := p.getSettings().ProxyProtocolCIDRs
+	if len(cidrs) == 0 {
+		return false
+	}
+	ip, ok := remoteIP(conn.RemoteAddr())
+	if !ok {
+		return false
+	}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admitProxied reads the PROXY header from a trusted proxy connection in
+// the background, and then admits the connection from the proxied source.
+// Connections are closed if too many headers are already being read.
+func (p *Peer) admitProxied(ctx context.Context, conn net.Conn) {
+	if !p.limiter.startProxyRead() {
+		p.logFields(SERVE, log.Fields{
+			"remoteAddr": conn.RemoteAddr(),
+		}).Debug("too many PROXY headers pending, closing connection")
+		conn.Close()
+		return
+	}
+	p.t.Go(func() error {
+		proxied, err := readProxyHeader(conn)
+		p.limiter.endProxyRead()
+		if err != nil {
+			p.logFields(SERVE, log.Fields{
+				"remoteAddr": conn.RemoteAddr(),
+			}).Warningf("invalid PROXY header: %v", err)
+			conn.Close()
+			return nil
+		}
+		err = p.admit(ctx, proxied)
+		if err != nil {
+			p.logErr(SERVE, err).Error()
+		}
+		return nil
+	})
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from conn. The
+// returned connection reports the source address in the header as its
+// remote address. Headers which do not identify a TCP source, such as v1
+// UNKNOWN or v2 LOCAL, leave the remote address unchanged.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var src net.Addr
+	buf := make([]byte, len(proxyV2Signature))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if bytes.Equal(buf, proxyV2Signature) {
+		src, err = readProxyV2(conn)
+	} else if bytes.HasPrefix(buf, []byte("PROXY ")) {
+		src, err = readProxyV1(conn, buf)
+	} else {
+		err = errgo.New("missing PROXY header")
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if src == nil {
+		return conn, nil
+	}
+	return &addrConn{Conn: conn, remoteAddr: src}, nil
+}
+
+// readProxyV1 reads the remainder of a v1 header, which begins with prefix.
+func readProxyV1(r io.Reader, prefix []byte) (net.Addr, error) {
+	line := append([]byte(nil), prefix...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errgo.New("PROXY v1 header too long")
+		}
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errgo.Newf("invalid PROXY v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errgo.Newf("invalid PROXY v1 source %q %q", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the remainder of a v2 header, following the signature.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	var hdr [4]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, errgo.Newf("unsupported PROXY version %d", hdr[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	if cmd := hdr[0] & 0xf; cmd == 0x0 {
+		// LOCAL: health checks and the like, from the proxy itself.
+		return nil, nil
+	} else if cmd != 0x1 {
+		return nil, errgo.Newf("unsupported PROXY command %d", cmd)
+	}
+	switch hdr[1] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, errgo.New("short PROXY v2 TCP4 address")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[0:4]...)),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, errgo.New("short PROXY v2 TCP6 address")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[0:16]...)),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	}
+	// Other address families are not TCP peers.
+	return nil, nil
+}
@@ -0,0 +1,215 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type ProxyProtoSuite struct{}
+
+var _ = gc.Suite(&ProxyProtoSuite{})
+
+func proxyV2Header(cmd, fam byte, addr []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.Write([]byte{0x20 | cmd, fam})
+	binary.Write(&buf, binary.BigEndian, uint16(len(addr)))
+	buf.Write(addr)
+	return buf.Bytes()
+}
+
+func (s *ProxyProtoSuite) TestReadHeader(c *gc.C) {
+	v2TCP4 := []byte{10, 9, 8, 7, 10, 0, 0, 1, 0x2b, 0x66, 0x2c, 0x6a}
+	v2TCP6 := make([]byte, 36)
+	copy(v2TCP6, net.ParseIP("2001:db8::7"))
+	binary.BigEndian.PutUint16(v2TCP6[32:], 11370)
+	for i, tc := range []struct {
+		header string
+		addr   string
+		err    string
+	}{
+		{"PROXY TCP4 10.9.8.7 10.0.0.1 11110 11370\r\n", "10.9.8.7:11110", ""},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 11110 11370\r\n", "[2001:db8::7]:11110", ""},
+		{"PROXY UNKNOWN\r\n", "127.0.0.1:1", ""},
+		{"PROXY TCP4 10.9.8.7\r\n", "", "invalid PROXY v1 header.*"},
+		{"PROXY TCP4 " + string(make([]byte, 100)), "", "PROXY v1 header too long"},
+		{string(proxyV2Header(1, 0x11, v2TCP4)), "10.9.8.7:11110", ""},
+		{string(proxyV2Header(1, 0x21, v2TCP6)), "[2001:db8::7]:11370", ""},
+		{string(proxyV2Header(0, 0x00, nil)), "127.0.0.1:1", ""},
+		{string(proxyV2Header(1, 0x11, v2TCP4[:4])), "", "short PROXY v2 TCP4 address"},
+		{"GET / HTTP/1.1\r\n\r\n", "", "missing PROXY header"},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(tc.header))
+			client.Write([]byte("rest"))
+		}()
+		conn, err := readProxyHeader(&addrConn{
+			Conn:       server,
+			remoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1},
+		})
+		if tc.err != "" {
+			c.Check(err, gc.ErrorMatches, tc.err, gc.Commentf("case %d", i))
+		} else if c.Check(err, gc.IsNil, gc.Commentf("case %d", i)) {
+			c.Check(conn.RemoteAddr().String(), gc.Equals, tc.addr, gc.Commentf("case %d", i))
+			rest := make([]byte, 4)
+			_, err = conn.Read(rest)
+			c.Check(err, gc.IsNil)
+			c.Check(string(rest), gc.Equals, "rest")
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+type fixedListener struct {
+	net.Listener
+}
+
+func (l fixedListener) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	return l.Listener, nil
+}
+
+type proxyDialer struct {
+	header string
+}
+
+func (d proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write([]byte(d.header))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *ProxyProtoSuite) TestServeProxied(c *gc.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+
+	onlyClient := cf.Zi(cf.P_SKS, 65537)
+	server := newTestPeer(c)
+	server.settings.ProxyProtocolCIDRs = []string{"127.0.0.0/8"}
+	server.settings.StrictLoopback = true
+	server.settings.AllowCIDRs = []string{"10.0.0.0/8"}
+	server.SetListener(fixedListener{ln})
+	server.t.Go(server.Serve)
+	defer server.Stop()
+
+	client := newTestPeer(c, onlyClient)
+	defer client.Stop()
+
+	// A proxied peer which is allowed.
+	client.SetDialer(proxyDialer{"PROXY TCP4 10.9.8.7 127.0.0.1 11110 11370\r\n"})
+	err = client.InitiateRecon(ln.Addr())
+	c.Assert(err, gc.IsNil)
+	r := <-server.RecoverChan
+	c.Assert(r.RemoteAddr.String(), gc.Equals, "10.9.8.7:11110")
+	c.Assert(r.RemoteElements, gc.HasLen, 1)
+
+	// A proxied peer which is not allowed.
+	client.SetDialer(proxyDialer{"PROXY TCP4 192.168.1.1 127.0.0.1 11110 11370\r\n"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = client.InitiateReconContext(ctx, ln.Addr())
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *ProxyProtoSuite) TestServeProxiedPending(c *gc.C) {
+	defer func(n int) { maxPendingProxyHeaders = n }(maxPendingProxyHeaders)
+	maxPendingProxyHeaders = 1
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+
+	server := newTestPeer(c)
+	server.settings.ProxyProtocolCIDRs = []string{"127.0.0.0/8"}
+	server.SetListener(fixedListener{ln})
+	server.t.Go(server.Serve)
+	defer server.Stop()
+
+	// A proxy which has not sent its header holds the only pending read.
+	slow, err := net.Dial("tcp", ln.Addr().String())
+	c.Assert(err, gc.IsNil)
+	defer slow.Close()
+
+	// Further connections are closed without waiting for their headers.
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		c.Assert(err, gc.IsNil)
+		conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout / 2))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			c.Fatalf("connection not closed while PROXY header pending")
+		}
+	}
+}
+
+// keepAliveRecorder records the keepalive period set on a connection.
+type keepAliveRecorder struct {
+	net.Conn
+	period chan time.Duration
+}
+
+func (c *keepAliveRecorder) SetKeepAlive(keepalive bool) error {
+	if !keepalive {
+		c.period <- 0
+	}
+	return nil
+}
+
+func (c *keepAliveRecorder) SetKeepAlivePeriod(d time.Duration) error {
+	c.period <- d
+	return nil
+}
+
+func (s *ProxyProtoSuite) TestProxiedKeepAlive(c *gc.C) {
+	server := newTestPeer(c)
+	server.settings.AllowCIDRs = []string{"10.0.0.0/8"}
+	server.settings.Partners["a"] = Partner{
+		ReconAddr: "10.9.8.7:11370",
+		Timeouts:  Timeouts{KeepAliveSecs: 60},
+	}
+	defer server.Stop()
+
+	client, conn := net.Pipe()
+	client.Close()
+	ka := &keepAliveRecorder{Conn: conn, period: make(chan time.Duration, 2)}
+	proxied := &addrConn{Conn: ka, remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.9.8.7"), Port: 11110}}
+
+	// The keepalive is that of the proxied partner.
+	c.Assert(server.admit(context.Background(), proxied), gc.IsNil)
+	c.Assert(<-ka.period, gc.Equals, 60*time.Second)
+}
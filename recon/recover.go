@@ -0,0 +1,222 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+	log "gopkg.in/hockeypuck/logrus.v0"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+var ErrPeerStopped error = errors.New("peer stopped")
+
+// recoverQueue bounds the number of recovered elements outstanding between
+// recon sessions and the consumer of RecoverChan. An element is outstanding
+// from the time it is recovered until it is delivered on RecoverChan or, in
+// acknowledge mode, until the consumer acknowledges it with Peer.Ack.
+// Elements recovered again while still outstanding are coalesced.
+type recoverQueue struct {
+	mu       sync.Mutex
+	capacity int
+	pending  *cf.ZSet
+	changed  chan struct{}
+}
+
+func newRecoverQueue(capacity int) *recoverQueue {
+	if capacity <= 0 {
+		capacity = DefaultRecoverQueueCapacity
+	}
+	return &recoverQueue{
+		capacity: capacity,
+		pending:  cf.NewZSet(),
+		changed:  make(chan struct{}),
+	}
+}
+
+// reserve adds the elements in items which are not already outstanding to
+// the queue, returning them. If there is not enough capacity, reserve blocks
+// until enough elements are released, or stop is closed. A batch larger than
+// the queue capacity is admitted once the queue is empty.
+func (q *recoverQueue) reserve(items []*cf.Zp, stop <-chan struct{}) ([]*cf.Zp, error) {
+	for {
+		q.mu.Lock()
+		fresh := cf.NewZSet()
+		for _, z := range items {
+			if !q.pending.Has(z) {
+				fresh.Add(z)
+			}
+		}
+		n := q.pending.Len()
+		if n == 0 || n+fresh.Len() <= q.capacity {
+			q.pending.AddAll(fresh)
+			q.mu.Unlock()
+			return fresh.Items(), nil
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-stop:
+			return nil, errgo.Mask(ErrPeerStopped, errgo.Any)
+		}
+	}
+}
+
+// release removes elements from the queue.
+func (q *recoverQueue) release(items []*cf.Zp) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending.RemoveSlice(items)
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// setCapacity changes the capacity of the queue, waking any reservations
+// blocked on it.
+func (q *recoverQueue) setCapacity(capacity int) {
+	if capacity <= 0 {
+		capacity = DefaultRecoverQueueCapacity
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.capacity = capacity
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// full returns whether the queue has reached capacity.
+func (q *recoverQueue) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending.Len() >= q.capacity
+}
+
+// Ack acknowledges that the consumer of RecoverChan has processed the
+// elements in r, releasing their capacity in the recovery queue and removing
+// them from the journal. Ack is required when the RecoverAck setting is
+// enabled, or a journal is set; otherwise elements are released as soon as
+// they are delivered, and Ack has no effect.
+func (p *Peer) Ack(r *Recover) {
+	if p.ackRequired() {
+		p.recoverQ.release(r.RemoteElements)
+		p.unjournal(r)
+	}
+}
+
+// ackRequired returns whether recoveries are held until acknowledged with
+// Ack. A journal implies acknowledgement, so that elements are only removed
+// from it once the consumer has processed them.
+func (p *Peer) ackRequired() bool {
+	return p.getSettings().RecoverAck || p.getJournal() != nil
+}
+
+// sendItems delivers the elements recovered in a session, or collects them if
+// the session is part of a gossip round.
+func (p *Peer) sendItems(s *session, items []*cf.Zp, records []*Record) error {
+	s.recovered = len(items)
+	s.records = len(records)
+	if s.dryRun != nil {
+		s.dryRun.localNeeds = items
+		return nil
+	}
+	if s.replay != nil {
+		return nil
+	}
+	if !s.receive && len(items) > 0 {
+		p.logFields(s.Role, log.Fields{"elements": len(items)}).Debug("not recovering elements, session is push only")
+		return nil
+	}
+	if s.round != nil {
+		s.round.add(s, items, records)
+		return nil
+	}
+	return p.recoverItems(s, items, records)
+}
+
+// recoverItems delivers elements recovered in a session to RecoverChan, along
+// with any records fetched for them. Delivery blocks until the consumer has
+// capacity, applying backpressure to recon, and fails only if the peer is
+// stopped.
+func (p *Peer) recoverItems(s *session, items []*cf.Zp, records []*Record) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	fresh, err := p.recoverQ.reserve(items, p.t.Dying())
+	if err != nil {
+		p.getMetrics().RecoverDropped(len(items))
+		return errgo.Mask(err, errgo.Any)
+	} else if len(fresh) == 0 {
+		p.logFields(s.Role, log.Fields{"elements": len(items)}).Debug("recovered elements already pending")
+		return nil
+	}
+	if len(fresh) < len(items) {
+		records = recordsOf(fresh, records)
+	}
+
+	r := &Recover{
+		Dataset:        s.settings.Dataset,
+		RemoteAddr:     s.RemoteAddr,
+		RemoteConfig:   s.RemoteConfig,
+		RemoteElements: fresh,
+		RemoteRecords:  records,
+	}
+	p.observe(func(o PeerObserver) { o.ElementsRecovered(&s.SessionInfo, r) })
+	p.journal(s.Role, r)
+	return p.deliver(s.Role, r)
+}
+
+// deliver sends r on RecoverChan, whose elements must already be reserved in
+// the recovery queue.
+func (p *Peer) deliver(role string, r *Recover) error {
+	select {
+	case p.RecoverChan <- r:
+		p.log(role).Infof("recovered %d items", len(r.RemoteElements))
+		p.getMetrics().ElementsRecovered(len(r.RemoteElements))
+		if !p.ackRequired() {
+			p.recoverQ.release(r.RemoteElements)
+		}
+		return nil
+	case <-p.t.Dying():
+		// Journaled elements are left to be replayed on restart.
+		p.recoverQ.release(r.RemoteElements)
+		p.getMetrics().RecoverDropped(len(r.RemoteElements))
+		return errgo.Mask(ErrPeerStopped, errgo.Any)
+	}
+}
+
+// recordsOf returns the records of elements in zs.
+func recordsOf(zs []*cf.Zp, records []*Record) []*Record {
+	set := cf.NewZSet(zs...)
+	var result []*Record
+	for _, r := range records {
+		if set.Has(r.Element) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
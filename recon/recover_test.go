@@ -0,0 +1,117 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type RecoverSuite struct{}
+
+var _ = gc.Suite(&RecoverSuite{})
+
+func newAckPeer(c *gc.C, capacity int) *Peer {
+	p := newTestPeer(c)
+	p.settings.RecoverQueueCapacity = capacity
+	p.settings.RecoverAck = true
+	p.recoverQ = newRecoverQueue(capacity)
+	p.RecoverChan = make(RecoverChan)
+	return p
+}
+
+func testSession(c *gc.C) *session {
+	conn, _ := net.Pipe()
+	s, _ := NewMemPeer().newSession(GOSSIP, conn)
+	return s
+}
+
+func zs(ns ...int) []*cf.Zp {
+	var result []*cf.Zp
+	for _, n := range ns {
+		result = append(result, cf.Zi(cf.P_SKS, n))
+	}
+	return result
+}
+
+func (s *RecoverSuite) TestBackpressure(c *gc.C) {
+	p := newAckPeer(c, 2)
+	defer p.Stop()
+
+	sent := make(chan error, 2)
+	go func() { sent <- p.sendItems(testSession(c), zs(1, 2), nil) }()
+	r1 := <-p.RecoverChan
+	c.Assert(<-sent, gc.IsNil)
+	c.Assert(p.readAcquire(), gc.Equals, false)
+
+	go func() { sent <- p.sendItems(testSession(c), zs(3), nil) }()
+	select {
+	case <-p.RecoverChan:
+		c.Fatal("expected recovery to block until acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Ack(r1)
+	r2 := <-p.RecoverChan
+	c.Assert(<-sent, gc.IsNil)
+	c.Assert(r2.RemoteElements, gc.DeepEquals, zs(3))
+}
+
+func (s *RecoverSuite) TestCoalesce(c *gc.C) {
+	p := newAckPeer(c, 10)
+	defer p.Stop()
+
+	sent := make(chan error, 2)
+	go func() { sent <- p.sendItems(testSession(c), zs(1, 2), nil) }()
+	r1 := <-p.RecoverChan
+	c.Assert(<-sent, gc.IsNil)
+
+	// Elements still awaiting acknowledgement are not delivered again.
+	c.Assert(p.sendItems(testSession(c), zs(1, 2), nil), gc.IsNil)
+	records := []*Record{{Element: cf.Zi(cf.P_SKS, 2)}, {Element: cf.Zi(cf.P_SKS, 3)}}
+	go func() { sent <- p.sendItems(testSession(c), zs(2, 3), records) }()
+	r2 := <-p.RecoverChan
+	c.Assert(<-sent, gc.IsNil)
+	c.Assert(r2.RemoteElements, gc.DeepEquals, zs(3))
+	c.Assert(r2.RemoteRecords, gc.DeepEquals, records[1:])
+
+	p.Ack(r1)
+	go func() { sent <- p.sendItems(testSession(c), zs(1), nil) }()
+	r3 := <-p.RecoverChan
+	c.Assert(<-sent, gc.IsNil)
+	c.Assert(r3.RemoteElements, gc.DeepEquals, zs(1))
+}
+
+func (s *RecoverSuite) TestStopWhileBlocked(c *gc.C) {
+	p := newAckPeer(c, 10)
+
+	sent := make(chan error, 1)
+	go func() { sent <- p.sendItems(testSession(c), zs(1), nil) }()
+	time.Sleep(10 * time.Millisecond)
+	p.Stop()
+	c.Assert(errgo.Cause(<-sent), gc.Equals, ErrPeerStopped)
+}
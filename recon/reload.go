@@ -0,0 +1,298 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+const SETTINGS = "settings"
+
+func (p *Peer) getSettings() *Settings {
+	p.muSettings.RLock()
+	defer p.muSettings.RUnlock()
+	return p.settings
+}
+
+// getMatcher returns the IP matcher for the current settings, creating it if
+// necessary.
+func (p *Peer) getMatcher() (IPMatcher, error) {
+	p.muSettings.RLock()
+	matcher := p.matcher
+	p.muSettings.RUnlock()
+	if matcher != nil {
+		return matcher, nil
+	}
+
+	err := p.refreshMatcher()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return p.getMatcher()
+}
+
+// partnerIPs returns the partner addresses resolved for the current IP
+// matcher, so that partners can be matched without name lookups.
+func (p *Peer) partnerIPs() partnerIPs {
+	matcher, err := p.getMatcher()
+	if err != nil {
+		return nil
+	}
+	return matcherPartnerIPs(matcher)
+}
+
+// refreshMatcher recreates the IP matcher from the current settings,
+// resolving partner hostnames again.
+func (p *Peer) refreshMatcher() error {
+	settings := p.getSettings()
+	m, err := settings.Matcher()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	p.muSettings.Lock()
+	defer p.muSettings.Unlock()
+	// Settings updated in the meantime have a matcher of their own.
+	if p.settings == settings {
+		p.matcher = m
+	}
+	return nil
+}
+
+// resolvePartners refreshes the IP matcher every ResolveIntervalSecs, until
+// ctx is done.
+func (p *Peer) resolvePartners(ctx context.Context) {
+	for {
+		secs := p.getSettings().ResolveIntervalSecs
+		d := time.Duration(secs) * time.Second
+		if secs <= 0 {
+			// Check again later, in case re-resolution is enabled by a
+			// settings update.
+			d = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+		if secs > 0 {
+			err := p.refreshMatcher()
+			if err != nil {
+				p.logErr(SETTINGS, err).Error("cannot refresh matcher")
+			}
+		}
+	}
+}
+
+// UpdateSettings replaces the settings of a running peer. The IP matcher is
+// rebuilt from the new settings and replaced along with them, so that
+// accepted connections are matched against one or the other. Sessions in
+// progress continue with the settings they started with.
+//
+// Settings which cannot change while the peer is running, such as the prefix
+// tree configuration and the recon address, must be the same as the current
+// settings.
+func (p *Peer) UpdateSettings(settings *Settings) error {
+	return p.swapSettings(func(*Settings) (*Settings, error) {
+		return settings, nil
+	})
+}
+
+// swapSettings replaces the current settings with those returned by f, which
+// is called with the current settings. The new settings are checked and their
+// matcher built, which resolves partner hostnames, without holding the
+// settings lock. If the settings are updated in the meantime, f is called
+// again with the newer settings.
+func (p *Peer) swapSettings(f func(current *Settings) (*Settings, error)) error {
+	for {
+		current := p.getSettings()
+		settings, err := f(current)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		matcher, err := checkSettings(current, settings)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+
+		p.muSettings.Lock()
+		if p.settings != current {
+			p.muSettings.Unlock()
+			continue
+		}
+		p.settings = settings
+		p.matcher = matcher
+		if settings.RecoverQueueCapacity != current.RecoverQueueCapacity {
+			p.recoverQ.setCapacity(settings.RecoverQueueCapacity)
+		}
+		p.muSettings.Unlock()
+		return nil
+	}
+}
+
+// checkSettings checks that settings may replace the current settings of a
+// running peer, and returns their IP matcher.
+func checkSettings(current, settings *Settings) (IPMatcher, error) {
+	if settings.PTreeConfig != current.PTreeConfig {
+		return nil, errgo.New("cannot change prefix tree settings of a running peer")
+	}
+	if settings.ReconNet != current.ReconNet || settings.ReconAddr != current.ReconAddr {
+		return nil, errgo.New("cannot change recon address of a running peer")
+	}
+	if settings.Dataset != current.Dataset {
+		return nil, errgo.New("cannot change dataset of a running peer")
+	}
+	if settings.RecoverAck != current.RecoverAck {
+		return nil, errgo.New("cannot change recoverAck of a running peer")
+	}
+	if _, err := settings.Config(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if _, err := settings.PartnerAddrs(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	matcher, err := settings.Matcher()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return matcher, nil
+}
+
+// modifySettings updates a copy of the current settings with f.
+func (p *Peer) modifySettings(f func(settings *Settings) error) error {
+	return p.swapSettings(func(current *Settings) (*Settings, error) {
+		settings := *current
+		settings.Partners = make(PartnerMap)
+		for name, partner := range current.Partners {
+			settings.Partners[name] = partner
+		}
+		err := f(&settings)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		return &settings, nil
+	})
+}
+
+// AddPartner adds a partner to a running peer, or replaces the partner of
+// the same name.
+func (p *Peer) AddPartner(name string, partner Partner) error {
+	return p.modifySettings(func(settings *Settings) error {
+		settings.Partners[name] = partner
+		return nil
+	})
+}
+
+// RemovePartner removes a partner from a running peer.
+func (p *Peer) RemovePartner(name string) error {
+	return p.modifySettings(func(settings *Settings) error {
+		if _, ok := settings.Partners[name]; !ok {
+			return errgo.Newf("partner %q not found", name)
+		}
+		delete(settings.Partners, name)
+		return nil
+	})
+}
+
+// LoadSettings reads TOML-formatted settings from a file.
+func LoadSettings(path string) (*Settings, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err, os.IsNotExist)
+	}
+	settings, err := ParseSettings(string(data))
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid settings in %q", path)
+	}
+	return settings, nil
+}
+
+// ReloadSettings updates the settings of a running peer from a file.
+func (p *Peer) ReloadSettings(path string) error {
+	settings, err := LoadSettings(path)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return p.UpdateSettings(settings)
+}
+
+// WatchSettings reloads the settings of a running peer from a file when the
+// process receives SIGHUP, or when the file is modified, checking every
+// interval. A zero interval disables checking for modification. Reload
+// failures are logged, and the current settings are kept. Watching stops
+// when the peer is stopped, and a stopped peer is not watched.
+func (p *Peer) WatchSettings(path string, interval time.Duration) {
+	modTime := fileModTime(path)
+
+	p.muDie.Lock()
+	defer p.muDie.Unlock()
+	if p.isDying() {
+		return
+	}
+
+	// The signal is registered only once the goroutine which stops it is
+	// sure to be tracked.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	p.t.Go(func() error {
+		defer signal.Stop(hup)
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-p.t.Dying():
+				return nil
+			case <-hup:
+				p.log(SETTINGS).Infof("SIGHUP received, reloading %q", path)
+			case <-tick:
+				mt := fileModTime(path)
+				if mt.Equal(modTime) {
+					continue
+				}
+				modTime = mt
+				p.log(SETTINGS).Infof("%q modified, reloading", path)
+			}
+			err := p.ReloadSettings(path)
+			if err != nil {
+				p.logErr(SETTINGS, err).Error("cannot reload settings")
+			}
+		}
+	})
+}
+
+func fileModTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,151 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type ReloadSuite struct{}
+
+var _ = gc.Suite(&ReloadSuite{})
+
+func (s *ReloadSuite) TestAddRemovePartner(c *gc.C) {
+	p := NewMemPeer()
+	partnerIP := net.ParseIP("10.1.2.3")
+	conn, _ := net.Pipe()
+	inFlight, _ := p.newSession(GOSSIP, conn)
+
+	matcher, err := p.getMatcher()
+	c.Assert(err, gc.IsNil)
+	c.Assert(matcher.Match(partnerIP), gc.Equals, false)
+
+	err = p.AddPartner("a", Partner{HTTPAddr: "10.1.2.3:11371", ReconAddr: "10.1.2.3:11370"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.getSettings().Partners, gc.HasLen, 1)
+	matcher, err = p.getMatcher()
+	c.Assert(err, gc.IsNil)
+	c.Assert(matcher.Match(partnerIP), gc.Equals, true)
+
+	// Sessions in progress keep their settings.
+	c.Assert(inFlight.settings.Partners, gc.HasLen, 0)
+
+	err = p.RemovePartner("a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.getSettings().Partners, gc.HasLen, 0)
+	matcher, err = p.getMatcher()
+	c.Assert(err, gc.IsNil)
+	c.Assert(matcher.Match(partnerIP), gc.Equals, false)
+
+	err = p.RemovePartner("a")
+	c.Assert(err, gc.ErrorMatches, `partner "a" not found`)
+}
+
+func (s *ReloadSuite) TestUpdateSettingsInvalid(c *gc.C) {
+	p := NewMemPeer()
+	current := p.getSettings()
+
+	settings := DefaultSettings()
+	settings.MBar = DefaultMBar + 1
+	c.Assert(p.UpdateSettings(settings), gc.ErrorMatches, "cannot change prefix tree settings of a running peer")
+
+	settings = DefaultSettings()
+	settings.AllowCIDRs = []string{"not a cidr"}
+	c.Assert(p.UpdateSettings(settings), gc.NotNil)
+
+	err := p.AddPartner("a", Partner{ReconAddr: "no port"})
+	c.Assert(err, gc.NotNil)
+	c.Assert(p.getSettings(), gc.Equals, current)
+}
+
+func (s *ReloadSuite) TestUpdateSettingsResolve(c *gc.C) {
+	resolving, resolved := make(chan struct{}), make(chan struct{})
+	defer func(f func(string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		resolving <- struct{}{}
+		<-resolved
+		return []net.IP{net.ParseIP("10.1.2.3")}, nil
+	}
+
+	p := NewMemPeer()
+	current, err := p.getMatcher()
+	c.Assert(err, gc.IsNil)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.AddPartner("a", Partner{ReconAddr: "localhost:11370", HTTPNet: NetworkUnix})
+	}()
+
+	// Partners are resolved without holding the settings lock.
+	<-resolving
+	matcher, err := p.getMatcher()
+	c.Assert(err, gc.IsNil)
+	c.Assert(matcher, gc.Equals, current)
+	close(resolved)
+
+	c.Assert(<-errs, gc.IsNil)
+	matcher, err = p.getMatcher()
+	c.Assert(err, gc.IsNil)
+	c.Assert(matcher.Match(net.ParseIP("10.1.2.3")), gc.Equals, true)
+}
+
+func (s *ReloadSuite) TestWatchSettings(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "recon.conf")
+	c.Assert(ioutil.WriteFile(path, []byte("[conflux.recon]\n"), 0644), gc.IsNil)
+
+	p := newTestPeer(c)
+	defer p.Stop()
+	p.WatchSettings(path, 10*time.Millisecond)
+
+	c.Assert(ioutil.WriteFile(path, []byte(`
+[conflux.recon]
+gossipIntervalSecs = 10
+[conflux.recon.partner.a]
+httpAddr = "10.1.2.3:11371"
+reconAddr = "10.1.2.3:11370"
+`), 0644), gc.IsNil)
+	future := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(path, future, future), gc.IsNil)
+
+	deadline := time.After(5 * time.Second)
+	for len(p.getSettings().Partners) == 0 {
+		select {
+		case <-deadline:
+			c.Fatal("settings not reloaded")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.Assert(p.getSettings().GossipIntervalSecs, gc.Equals, 10)
+	c.Assert(p.getSettings().Partners["a"].ReconAddr, gc.Equals, "10.1.2.3:11370")
+}
+
+func (s *ReloadSuite) TestWatchStopped(c *gc.C) {
+	p := newTestPeer(c)
+	c.Assert(p.Stop(), gc.IsNil)
+	// Watching a stopped peer does nothing.
+	p.WatchSettings(filepath.Join(c.MkDir(), "recon.conf"), time.Millisecond)
+}
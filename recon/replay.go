@@ -0,0 +1,320 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ErrReplayDiverged is returned by a replayed session when the local peer
+// sends anything other than what was recorded.
+var ErrReplayDiverged error = errors.New("replay diverged from transcript")
+
+// ReplayResult reports the outcome of replaying a session transcript.
+type ReplayResult struct {
+	Role       string
+	RemoteAddr string
+
+	// RemoteConfig is the recorded config of the remote peer.
+	RemoteConfig *Config
+
+	// Diverged is whether the local peer sent anything different from the
+	// recorded session, or stopped short of it.
+	Diverged bool
+
+	// Offset is the position in the data sent at which the replay diverged.
+	Offset int
+
+	// Index is the position of the first differing message sent, described
+	// as recorded in Expected and as replayed in Actual. Either is empty if
+	// there was no such message.
+	Index    int
+	Expected string
+	Actual   string
+
+	// Err is the error which ended the replayed session, if any.
+	Err error
+}
+
+// Replay replays the transcript t against the local prefix tree, acting in
+// the recorded role. The messages recorded from the remote peer are fed to
+// the local peer in their recorded order relative to the messages sent, and
+// the messages sent are compared with those recorded. The local config and
+// membership are sent as recorded, as they depended on the settings, clock
+// and nonce of the recorded session. Content is served from the local content
+// store, if any. Recovered elements are not delivered.
+func (p *Peer) Replay(ctx context.Context, t *Transcript) (*ReplayResult, error) {
+	result := &ReplayResult{Role: t.Role, RemoteAddr: t.RemoteAddr}
+	received, _ := decodeStream(t.Received())
+	if len(received) > 0 {
+		result.RemoteConfig, _ = received[0].Msg.(*Config)
+	}
+
+	conn := newReplayConn(t)
+	opts := sessionOptions{conn: conn, replay: recordedLocal(t)}
+	switch t.Role {
+	case GOSSIP:
+		result.Err = p.initiateRecon(ctx, conn.RemoteAddr(), opts)
+	case SERVE:
+		result.Err = p.accept(ctx, conn, opts)
+	default:
+		return nil, errgo.Newf("invalid transcript role %q", t.Role)
+	}
+
+	expected, actual := t.Sent(), conn.sent()
+	result.Offset = commonPrefix(expected, actual)
+	result.Diverged = result.Offset < len(expected) || result.Offset < len(actual)
+	if !result.Diverged {
+		return result, nil
+	}
+	expectedMsgs, _ := decodeStream(expected)
+	actualMsgs, _ := decodeStream(actual)
+	for result.Index = 0; result.Index < len(expectedMsgs) || result.Index < len(actualMsgs); result.Index++ {
+		if result.Index < len(expectedMsgs) {
+			result.Expected = expectedMsgs[result.Index].String()
+		} else {
+			result.Expected = ""
+		}
+		if result.Index < len(actualMsgs) {
+			result.Actual = actualMsgs[result.Index].String()
+		} else {
+			result.Actual = ""
+		}
+		if result.Expected != result.Actual {
+			break
+		}
+	}
+	return result, nil
+}
+
+// replayedLocal holds messages sent by the local peer in a recorded session,
+// which are sent again as recorded in a replay.
+type replayedLocal struct {
+	config     *Config
+	membership *Membership
+}
+
+func recordedLocal(t *Transcript) *replayedLocal {
+	r := &replayedLocal{}
+	sent, _ := decodeStream(t.Sent())
+	for _, m := range sent {
+		switch msg := m.Msg.(type) {
+		case *Config:
+			if r.config == nil {
+				r.config = msg
+			}
+		case *Membership:
+			if r.membership == nil {
+				r.membership = msg
+			}
+		}
+	}
+	return r
+}
+
+func commonPrefix(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// replayAddr is the address of a replayed remote peer which is not a TCP
+// address.
+type replayAddr string
+
+func (a replayAddr) Network() string { return "replay" }
+func (a replayAddr) String() string  { return string(a) }
+
+// replayChunk is data received from the remote peer, after the local peer
+// had sent the given number of bytes.
+type replayChunk struct {
+	data  []byte
+	after int
+}
+
+// replayConn is a connection to a recorded remote peer. Recorded data is
+// received once the local peer has sent everything it had sent before the
+// data was originally received. Data sent which differs from the recording
+// fails with ErrReplayDiverged.
+type replayConn struct {
+	remoteAddr net.Addr
+	expected   []byte
+	chunks     []replayChunk
+
+	mu           sync.Mutex
+	changed      chan struct{}
+	written      []byte
+	pending      []byte
+	next         int
+	diverged     bool
+	closed       bool
+	readDeadline time.Time
+}
+
+func newReplayConn(t *Transcript) *replayConn {
+	c := &replayConn{
+		remoteAddr: replayAddr(t.RemoteAddr),
+		expected:   t.Sent(),
+		changed:    make(chan struct{}),
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", t.RemoteAddr); err == nil && addr.IP != nil {
+		c.remoteAddr = addr
+	}
+	var sent int
+	for _, entry := range t.Entries {
+		sent += len(entry.Sent)
+		if len(entry.Received) > 0 {
+			c.chunks = append(c.chunks, replayChunk{data: entry.Received, after: sent})
+		}
+	}
+	return c
+}
+
+// signal wakes readers waiting on a change. c.mu must be held.
+func (c *replayConn) signal() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *replayConn) sent() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written...)
+}
+
+// replayTimeout is returned when a read deadline is exceeded.
+type replayTimeout struct{}
+
+func (replayTimeout) Error() string   { return "i/o timeout" }
+func (replayTimeout) Timeout() bool   { return true }
+func (replayTimeout) Temporary() bool { return true }
+
+// Read implements net.Conn.
+func (c *replayConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if len(c.pending) > 0 {
+			n := copy(b, c.pending)
+			c.pending = c.pending[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.next >= len(c.chunks) {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.diverged || len(c.written) >= c.chunks[c.next].after {
+			c.pending = c.chunks[c.next].data
+			c.next++
+			c.mu.Unlock()
+			continue
+		}
+		deadline, changed := c.readDeadline, c.changed
+		c.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-changed
+			continue
+		}
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, replayTimeout{}
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+			return 0, replayTimeout{}
+		}
+	}
+}
+
+// Write implements net.Conn.
+func (c *replayConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	offset := len(c.written)
+	c.written = append(c.written, b...)
+	defer c.signal()
+	var expected []byte
+	if offset < len(c.expected) {
+		expected = c.expected[offset:]
+	}
+	if n := commonPrefix(b, expected); n < len(b) {
+		c.diverged = true
+		return 0, errgo.WithCausef(nil, ErrReplayDiverged, "replay diverged at offset %d", offset+n)
+	}
+	return len(b), nil
+}
+
+// Close implements net.Conn.
+func (c *replayConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.signal()
+	}
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (c *replayConn) LocalAddr() net.Addr { return replayAddr("local") }
+
+// RemoteAddr implements net.Conn.
+func (c *replayConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// SetDeadline implements net.Conn.
+func (c *replayConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *replayConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.signal()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn. Writes never block.
+func (c *replayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -57,15 +57,88 @@ type Settings struct {
 	ReconNet   netType    `toml:"reconNet" json:"-"`
 	Partners   PartnerMap `toml:"partner"`
 	AllowCIDRs []string   `toml:"allowCIDRs"`
+	DenyCIDRs  []string   `toml:"denyCIDRs"`
 	Filters    []string   `toml:"filters"`
 
+	// FilterPolicy determines how peers with different filters are
+	// handled. The default rejects them.
+	FilterPolicy FilterPolicy `toml:"filterPolicy" json:"-"`
+
+	// FilterEquivalences are groups of comma-separated filter lists which
+	// are considered compatible with each other.
+	FilterEquivalences [][]string `toml:"filterEquivalences" json:"-"`
+
 	// Backwards-compatible keys
 	CompatHTTPPort     int      `toml:"httpPort" json:"-"`
 	CompatReconPort    int      `toml:"reconPort" json:"-"`
 	CompatPartnerAddrs []string `toml:"partners" json:"-"`
 
+	// Dataset names the dataset reconciled with these settings, when hosted
+	// with Peer.AddDataset. Peers only reconcile the same dataset, and the
+	// default dataset is unnamed.
+	Dataset string `toml:"dataset"`
+
+	// Timeouts bounds the phases of recon sessions.
+	Timeouts
+
 	GossipIntervalSecs          int `toml:"gossipIntervalSecs" json:"-"`
 	MaxOutstandingReconRequests int `toml:"maxOutstandingReconRequests" json:"-"`
+
+	// TranscriptDir enables recording a transcript of each recon session,
+	// in a new file in this directory.
+	TranscriptDir string `toml:"transcriptDir" json:"-"`
+
+	// MaxConcurrentGossip is the maximum number of recon sessions initiated
+	// concurrently with distinct partners in each gossip round.
+	MaxConcurrentGossip int `toml:"maxConcurrentGossip" json:"-"`
+
+	// RecoverQueueCapacity is the maximum number of recovered elements
+	// outstanding before recon sessions block, and new sessions are refused.
+	RecoverQueueCapacity int `toml:"recoverQueueCapacity" json:"-"`
+
+	// RecoverAck requires the consumer of RecoverChan to acknowledge each
+	// Recover with Peer.Ack before its elements are released from the
+	// recovery queue.
+	RecoverAck bool `toml:"recoverAck" json:"-"`
+
+	// StrictLoopback disables implicitly allowing connections from loopback
+	// addresses, which must then be allowed explicitly.
+	StrictLoopback bool `toml:"strictLoopback" json:"-"`
+
+	// ResolveIntervalSecs is the interval at which partner hostnames are
+	// resolved again, to follow changes in DNS. Zero disables re-resolution.
+	ResolveIntervalSecs int `toml:"resolveIntervalSecs" json:"-"`
+
+	// ProxyProtocolCIDRs are the networks of proxies trusted to identify
+	// remote peers with a PROXY protocol v1 or v2 header. Connections from
+	// these networks must begin with a PROXY header.
+	ProxyProtocolCIDRs []string `toml:"proxyProtocolCIDRs" json:"-"`
+
+	// MaxConcurrentSessions limits the number of sessions accepted
+	// concurrently. Zero is unlimited.
+	MaxConcurrentSessions int `toml:"maxConcurrentSessions" json:"-"`
+
+	// MaxSessionsPerIP limits the number of sessions accepted concurrently
+	// from each remote IP address. Zero is unlimited.
+	MaxSessionsPerIP int `toml:"maxSessionsPerIP" json:"-"`
+
+	// AcceptRate limits the rate at which connections are accepted, per
+	// second, allowing bursts of up to AcceptBurst connections. Zero is
+	// unlimited.
+	AcceptRate  float64 `toml:"acceptRate" json:"-"`
+	AcceptBurst int     `toml:"acceptBurst" json:"-"`
+
+	// MembershipSecret enables the exchange of partner lists with remote
+	// peers which share the same secret. Discovered peers are gossiped with
+	// in addition to configured partners.
+	MembershipSecret string `toml:"membershipSecret" json:"-"`
+
+	// MaxDiscoveredPeers is the maximum number of discovered peers retained.
+	MaxDiscoveredPeers int `toml:"maxDiscoveredPeers" json:"-"`
+
+	// DiscoveryDenyCIDRs are networks from which discovered peers are never
+	// accepted. Discovered peers must also be allowed by the IP matcher.
+	DiscoveryDenyCIDRs []string `toml:"discoveryDenyCIDRs" json:"-"`
 }
 
 type Partner struct {
@@ -73,77 +146,212 @@ type Partner struct {
 	HTTPNet   netType `toml:"httpNet" json:"-"`
 	ReconAddr string  `toml:"reconAddr"`
 	ReconNet  netType `toml:"reconNet" json:"-"`
+
+	// AllowCIDRs are additional networks from which the partner may connect.
+	AllowCIDRs []string `toml:"allowCIDRs" json:"-"`
+
+	// Direction restricts the flow of elements in sessions with the partner.
+	Direction Direction `toml:"direction" json:"-"`
+
+	// Timeouts override the peer timeouts in sessions with the partner.
+	Timeouts
+}
+
+// partnerIPs are the IP addresses of partner recon addresses by partner
+// name, as resolved for the IP matcher.
+type partnerIPs map[string][]net.IP
+
+// matchPartner returns the first partner at the IP address of addr for
+// which match returns true. Partner addresses are not resolved here, but
+// looked up in resolved.
+func (s *Settings) matchPartner(addr net.Addr, resolved partnerIPs, match func(Partner) bool) (Partner, bool) {
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return Partner{}, false
+	}
+	for name, partner := range s.Partners {
+		if !match(partner) {
+			continue
+		}
+		if partner.ReconNet != NetworkDefault && partner.ReconNet != NetworkTCP {
+			continue
+		}
+		for _, partnerIP := range resolved[name] {
+			if partnerIP.Equal(ip) {
+				return partner, true
+			}
+		}
+	}
+	return Partner{}, false
 }
 
 type matchAccessType uint8
 
 const (
 	matchAllowAccess matchAccessType = iota
+	matchDenyAccess
 )
 
 type IPMatcher interface {
 	Match(ip net.IP) bool
 }
 
+// ipRule allows or denies access to addresses in a network.
+type ipRule struct {
+	ipnet  *net.IPNet
+	access matchAccessType
+	reason string
+}
+
 type ipMatcher struct {
-	nets []*net.IPNet
+	strictLoopback bool
+	rules          []ipRule
+	partners       partnerIPs
 }
 
 func newIPMatcher() *ipMatcher {
-	return &ipMatcher{}
+	return &ipMatcher{partners: make(partnerIPs)}
+}
+
+// matcherPartnerIPs returns the partner addresses resolved for m, if known.
+func matcherPartnerIPs(m IPMatcher) partnerIPs {
+	if m, ok := m.(*ipMatcher); ok {
+		return m.partners
+	}
+	return nil
 }
 
-func (m *ipMatcher) allow(partner Partner) error {
-	var httpAddr *net.TCPAddr
+// lookupIP resolves partner hostnames. It may be replaced in tests.
+var lookupIP = net.LookupIP
+
+// hostIPs returns the IP addresses of the host in hostPort, resolving it if
+// necessary.
+func hostIPs(hostPort string) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return lookupIP(host)
+}
+
+func (m *ipMatcher) allow(name string, partner Partner) error {
+	reason := fmt.Sprintf("partner %q", name)
 	if partner.HTTPNet == NetworkDefault || partner.HTTPNet == NetworkTCP {
-		httpAddr, resolveErr := net.ResolveTCPAddr("tcp", partner.HTTPAddr)
-		if resolveErr == nil && httpAddr.IP != nil {
-			err := m.allowCIDR(fmt.Sprintf("%s/32", httpAddr.IP.String()))
-			if err != nil {
-				return errgo.Mask(err)
-			}
-		}
+		m.allowHost(partner.HTTPAddr, reason)
 	}
 	if partner.ReconNet == NetworkDefault || partner.ReconNet == NetworkTCP {
-		addr, resolveErr := net.ResolveTCPAddr("tcp", partner.ReconAddr)
-		if resolveErr == nil && addr.IP != nil && (httpAddr == nil || !addr.IP.Equal(httpAddr.IP)) {
-			return m.allowCIDR(fmt.Sprintf("%s/32", addr.IP.String()))
+		m.partners[name] = m.allowHost(partner.ReconAddr, reason)
+	}
+	for _, cidr := range partner.AllowCIDRs {
+		err := m.addCIDR(cidr, matchAllowAccess, reason)
+		if err != nil {
+			return errgo.Notef(err, "invalid allowCIDRs for partner %q", name)
 		}
 	}
 	return nil
 }
 
+// allowHost allows the IP addresses of the host in hostPort, and returns
+// them. Hosts which cannot be resolved now may be on a later attempt.
+func (m *ipMatcher) allowHost(hostPort, reason string) []net.IP {
+	ips, err := hostIPs(hostPort)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		m.addIP(ip, matchAllowAccess, reason)
+	}
+	return ips
+}
+
 func (m *ipMatcher) allowCIDR(cidr string) error {
+	return m.addCIDR(cidr, matchAllowAccess, "allowCIDRs "+cidr)
+}
+
+func (m *ipMatcher) denyCIDR(cidr string) error {
+	return m.addCIDR(cidr, matchDenyAccess, "denyCIDRs "+cidr)
+}
+
+func (m *ipMatcher) addCIDR(cidr string, access matchAccessType, reason string) error {
 	_, ipnet, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	m.nets = append(m.nets, ipnet)
+	m.rules = append(m.rules, ipRule{ipnet: ipnet, access: access, reason: reason})
 	return nil
 }
 
+// addIP adds a rule for a single address, with a /32 prefix for IPv4 and
+// /128 for IPv6.
+func (m *ipMatcher) addIP(ip net.IP, access matchAccessType, reason string) {
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	ipnet := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	m.rules = append(m.rules, ipRule{ipnet: ipnet, access: access, reason: reason})
+}
+
 func (m *ipMatcher) Match(ip net.IP) bool {
-	if ip.IsLoopback() {
-		return true
+	ok, _ := m.decide(ip)
+	return ok
+}
+
+// decide returns whether ip is allowed, and the reason for the decision.
+// Denied networks take precedence over allowed networks and loopback.
+func (m *ipMatcher) decide(ip net.IP) (bool, string) {
+	for _, rule := range m.rules {
+		if rule.access == matchDenyAccess && rule.ipnet.Contains(ip) {
+			return false, "denied by " + rule.reason
+		}
 	}
-	for _, matchNet := range m.nets {
-		if matchNet.Contains(ip) {
-			return true
+	if ip.IsLoopback() && !m.strictLoopback {
+		return true, "loopback"
+	}
+	for _, rule := range m.rules {
+		if rule.access == matchAllowAccess && rule.ipnet.Contains(ip) {
+			return true, "allowed by " + rule.reason
 		}
 	}
-	return false
+	return false, "not allowed"
 }
 
+// matchReason returns whether m allows ip, and the reason if known.
+func matchReason(m IPMatcher, ip net.IP) (bool, string) {
+	if d, ok := m.(interface {
+		decide(net.IP) (bool, string)
+	}); ok {
+		return d.decide(ip)
+	}
+	if m.Match(ip) {
+		return true, "allowed"
+	}
+	return false, "not allowed"
+}
+
+// Matcher returns an IP matcher for remote peers. Partner hostnames are
+// resolved when the matcher is created, so it should be recreated
+// periodically to follow changes in DNS.
 func (s *Settings) Matcher() (IPMatcher, error) {
 	m := newIPMatcher()
+	m.strictLoopback = s.StrictLoopback
+	for _, denyCIDR := range s.DenyCIDRs {
+		err := m.denyCIDR(denyCIDR)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
 	for _, allowCIDR := range s.AllowCIDRs {
 		err := m.allowCIDR(allowCIDR)
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
 	}
-	for _, partner := range s.Partners {
-		err := m.allow(partner)
+	for name, partner := range s.Partners {
+		err := m.allow(name, partner)
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
@@ -184,6 +392,16 @@ const (
 	DefaultReconAddr                   = ":11370"
 	DefaultGossipIntervalSecs          = 60
 	DefaultMaxOutstandingReconRequests = 100
+	DefaultMaxConcurrentGossip         = 1
+	DefaultRecoverQueueCapacity        = 4 * maxRecoverSize
+	DefaultMaxDiscoveredPeers          = 64
+	DefaultResolveIntervalSecs         = 300
+	DefaultDialTimeoutSecs             = 30
+	DefaultReadTimeoutSecs             = 300
+	DefaultWriteTimeoutSecs            = 300
+	DefaultReplyTimeoutSecs            = 3
+	DefaultRejectTimeoutSecs           = 3
+	DefaultKeepAliveSecs               = 180
 
 	DefaultThreshMult = 10
 	DefaultBitQuantum = 2
@@ -204,8 +422,14 @@ var defaultSettings = Settings{
 	HTTPAddr:  DefaultHTTPAddr,
 	ReconAddr: DefaultReconAddr,
 
+	Timeouts: defaultTimeouts,
+
 	GossipIntervalSecs:          DefaultGossipIntervalSecs,
 	MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+	MaxConcurrentGossip:         DefaultMaxConcurrentGossip,
+	RecoverQueueCapacity:        DefaultRecoverQueueCapacity,
+	MaxDiscoveredPeers:          DefaultMaxDiscoveredPeers,
+	ResolveIntervalSecs:         DefaultResolveIntervalSecs,
 }
 
 // Resolve resolves network addresses and backwards-compatible settings. Use
@@ -240,6 +464,34 @@ func (s *Settings) Resolve() error {
 	if err != nil {
 		return errgo.Notef(err, "invalid reconNet %q reconAddr %q", s.ReconNet, s.ReconAddr)
 	}
+	err = s.Timeouts.validate()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !s.FilterPolicy.valid() {
+		return errgo.Newf("invalid filterPolicy %q", s.FilterPolicy)
+	}
+	for name, partner := range s.Partners {
+		if !partner.Direction.valid() {
+			return errgo.Newf("invalid direction %q for partner %q", partner.Direction, name)
+		}
+		err = partner.Timeouts.validate()
+		if err != nil {
+			return errgo.Notef(err, "invalid timeouts for partner %q", name)
+		}
+	}
+	for _, cidr := range s.ProxyProtocolCIDRs {
+		_, _, err = net.ParseCIDR(cidr)
+		if err != nil {
+			return errgo.Notef(err, "invalid proxyProtocolCIDRs")
+		}
+	}
+	for _, cidr := range s.DiscoveryDenyCIDRs {
+		_, _, err = net.ParseCIDR(cidr)
+		if err != nil {
+			return errgo.Notef(err, "invalid discoveryDenyCIDRs")
+		}
+	}
 
 	return nil
 }
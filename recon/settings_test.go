@@ -63,6 +63,11 @@ filters=["something","else"]
 			Partners:                    PartnerMap{},
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			MaxConcurrentGossip:         DefaultMaxConcurrentGossip,
+			RecoverQueueCapacity:        DefaultRecoverQueueCapacity,
+			MaxDiscoveredPeers:          DefaultMaxDiscoveredPeers,
+			ResolveIntervalSecs:         DefaultResolveIntervalSecs,
+			Timeouts:                    defaultTimeouts,
 		},
 		"",
 	}, {
@@ -85,6 +90,11 @@ filters=["something","else"]
 			Partners:                    PartnerMap{},
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			MaxConcurrentGossip:         DefaultMaxConcurrentGossip,
+			RecoverQueueCapacity:        DefaultRecoverQueueCapacity,
+			MaxDiscoveredPeers:          DefaultMaxDiscoveredPeers,
+			ResolveIntervalSecs:         DefaultResolveIntervalSecs,
+			Timeouts:                    defaultTimeouts,
 		},
 		"",
 	}, {
@@ -154,6 +164,11 @@ reconAddr="8.7.6.5:11370"
 			ReconAddr:                   DefaultReconAddr,
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			MaxConcurrentGossip:         DefaultMaxConcurrentGossip,
+			RecoverQueueCapacity:        DefaultRecoverQueueCapacity,
+			MaxDiscoveredPeers:          DefaultMaxDiscoveredPeers,
+			ResolveIntervalSecs:         DefaultResolveIntervalSecs,
+			Timeouts:                    defaultTimeouts,
 			Partners: map[string]Partner{
 				"alice": Partner{
 					HTTPAddr:  "1.2.3.4:11371",
@@ -184,6 +199,11 @@ partners=["1.2.3.4:11370","5.6.7.8:11370"]
 			CompatReconPort:             11370,
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			MaxConcurrentGossip:         DefaultMaxConcurrentGossip,
+			RecoverQueueCapacity:        DefaultRecoverQueueCapacity,
+			MaxDiscoveredPeers:          DefaultMaxDiscoveredPeers,
+			ResolveIntervalSecs:         DefaultResolveIntervalSecs,
+			Timeouts:                    defaultTimeouts,
 			Partners: map[string]Partner{
 				"1.2.3.4": Partner{
 					HTTPAddr:  "1.2.3.4:11371",
@@ -280,3 +300,79 @@ func (s *SettingsSuite) TestMatchAll(c *gc.C) {
 		c.Check(result, gc.Equals, tc.expect, gc.Commentf("addr=%q", tc.addr))
 	}
 }
+
+func (s *SettingsSuite) TestMatcherDeny(c *gc.C) {
+	settings := &Settings{
+		AllowCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"},
+		DenyCIDRs:  []string{"10.6.0.0/16", "2001:db8:6::/48"},
+		Partners: map[string]Partner{
+			"foo": Partner{
+				HTTPAddr:   "[2001:db9::1]:11371",
+				ReconAddr:  "10.6.1.1:11370",
+				AllowCIDRs: []string{"172.16.0.0/12"},
+			},
+		},
+		StrictLoopback: true,
+	}
+
+	matcher, err := settings.Matcher()
+	c.Assert(err, gc.IsNil)
+	testCases := []struct {
+		addr   string
+		expect bool
+		reason string
+	}{
+		{"10.1.2.3", true, "allowed by allowCIDRs 10.0.0.0/8"},
+		{"10.6.1.1", false, "denied by denyCIDRs 10.6.0.0/16"},
+		{"2001:db8::1", true, "allowed by allowCIDRs 2001:db8::/32"},
+		{"2001:db8:6::1", false, "denied by denyCIDRs 2001:db8:6::/48"},
+		{"2001:db9::1", true, `allowed by partner "foo"`},
+		{"2001:db9::2", false, "not allowed"},
+		{"172.17.1.1", true, `allowed by partner "foo"`},
+		{"127.0.0.1", false, "not allowed"},
+		{"::1", false, "not allowed"},
+	}
+	for _, tc := range testCases {
+		result, reason := matchReason(matcher, net.ParseIP(tc.addr))
+		c.Check(result, gc.Equals, tc.expect, gc.Commentf("addr=%q", tc.addr))
+		c.Check(reason, gc.Equals, tc.reason, gc.Commentf("addr=%q", tc.addr))
+	}
+
+	settings.StrictLoopback = false
+	matcher, err = settings.Matcher()
+	c.Assert(err, gc.IsNil)
+	c.Assert(matcher.Match(net.ParseIP("127.0.0.1")), gc.Equals, true)
+}
+
+func (s *SettingsSuite) TestMatcherResolve(c *gc.C) {
+	addrs := map[string][]net.IP{
+		"partner.example.com": {net.ParseIP("10.1.1.1"), net.ParseIP("2001:db8::1")},
+	}
+	defer func(f func(string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		return addrs[host], nil
+	}
+
+	settings := &Settings{
+		Partners: map[string]Partner{
+			"foo": Partner{
+				HTTPAddr:  "partner.example.com:11371",
+				ReconAddr: "partner.example.com:11370",
+			},
+		},
+	}
+	p := NewPeer(settings, nil)
+	matcher, err := p.getMatcher()
+	c.Assert(err, gc.IsNil)
+	c.Assert(matcher.Match(net.ParseIP("10.1.1.1")), gc.Equals, true)
+	c.Assert(matcher.Match(net.ParseIP("2001:db8::1")), gc.Equals, true)
+	c.Assert(matcher.Match(net.ParseIP("2001:db8::2")), gc.Equals, false)
+	c.Assert(matcher.Match(net.ParseIP("10.2.2.2")), gc.Equals, false)
+
+	addrs["partner.example.com"] = []net.IP{net.ParseIP("10.2.2.2")}
+	c.Assert(p.refreshMatcher(), gc.IsNil)
+	matcher, err = p.getMatcher()
+	c.Assert(err, gc.IsNil)
+	c.Assert(matcher.Match(net.ParseIP("10.1.1.1")), gc.Equals, false)
+	c.Assert(matcher.Match(net.ParseIP("10.2.2.2")), gc.Equals, true)
+}
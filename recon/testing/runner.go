@@ -176,6 +176,26 @@ func portPair(c *gc.C) (int, int) {
 	return p1, p2
 }
 
+// memContentStore serves record content derived from element values.
+type memContentStore struct {
+	ptree recon.PrefixTree
+}
+
+func contentOf(z *cf.Zp) []byte {
+	return []byte(fmt.Sprintf("record %v", z))
+}
+
+func (cs *memContentStore) Content(z *cf.Zp) ([]byte, error) {
+	root, err := cs.ptree.Root()
+	if err != nil {
+		return nil, err
+	}
+	if !cf.NewZSet(recon.MustElements(root)...).Has(z) {
+		return nil, recon.ErrContentNotFound
+	}
+	return contentOf(z), nil
+}
+
 func (s *ReconSuite) newPeer(listenPort, partnerPort int, mode recon.PeerMode, ptree recon.PrefixTree) *recon.Peer {
 	settings := recon.DefaultSettings()
 	settings.ReconAddr = fmt.Sprintf(":%d", listenPort)
@@ -308,6 +328,63 @@ func (s *ReconSuite) TestPolySyncLowMBar(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 }
 
+// Test fetching record content for recovered elements.
+func (s *ReconSuite) TestContentFetch(c *gc.C) {
+	ptree1, cleanup, err := s.Factory()
+	c.Assert(err, gc.IsNil)
+	defer cleanup()
+
+	ptree2, cleanup, err := s.Factory()
+	c.Assert(err, gc.IsNil)
+	defer cleanup()
+
+	peer1Needs := cf.NewZSet()
+	peer2Needs := cf.NewZSet()
+	for i := 1; i < 20; i++ {
+		ptree1.Insert(cf.Zi(cf.P_SKS, 65537*i))
+		ptree2.Insert(cf.Zi(cf.P_SKS, 65537*i))
+	}
+	for i := 1; i < 5; i++ {
+		z := cf.Zi(cf.P_SKS, 68111*i)
+		ptree1.Insert(z)
+		peer2Needs.Add(z)
+	}
+	for i := 1; i < 3; i++ {
+		z := cf.Zi(cf.P_SKS, 70001*i)
+		ptree2.Insert(z)
+		peer1Needs.Add(z)
+	}
+
+	port1, port2 := portPair(c)
+	peer1 := s.newPeer(port1, port2, recon.PeerModeGossipOnly, ptree1)
+	peer1.SetContentStore(&memContentStore{ptree1})
+	peer2 := s.newPeer(port2, port1, recon.PeerModeServeOnly, ptree2)
+	peer2.SetContentStore(&memContentStore{ptree2})
+	defer peer1.Stop()
+	defer peer2.Stop()
+
+	checkRecords := func(r *recon.Recover, needs *cf.ZSet) {
+		c.Assert(r.RemoteRecords, gc.HasLen, len(r.RemoteElements))
+		for _, record := range r.RemoteRecords {
+			c.Assert(string(record.Content), gc.Equals, string(contentOf(record.Element)))
+			needs.Remove(record.Element)
+		}
+	}
+	timer := time.NewTimer(LongTimeout)
+	for peer1Needs.Len() > 0 || peer2Needs.Len() > 0 {
+		select {
+		case r1 := <-peer1.RecoverChan:
+			c.Logf("peer1 recover: %v", r1)
+			checkRecords(r1, peer1Needs)
+		case r2 := <-peer2.RecoverChan:
+			c.Logf("peer2 recover: %v", r2)
+			checkRecords(r2, peer2Needs)
+		case <-timer.C:
+			c.Fatalf("timeout waiting for content, peer1 needs %v, peer2 needs %v", peer1Needs, peer2Needs)
+		}
+	}
+}
+
 func (s *ReconSuite) RunOneSided(c *gc.C, n int, serverHas bool, timeout time.Duration) {
 	ptree1, cleanup, err := s.Factory()
 	c.Assert(err, gc.IsNil)
@@ -0,0 +1,163 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Timeouts bounds the phases of a recon session, in seconds. Zero uses the
+// default, or for a partner, the peer setting.
+type Timeouts struct {
+	// DialTimeoutSecs bounds connecting to a partner.
+	DialTimeoutSecs int `toml:"dialTimeoutSecs" json:"-"`
+
+	// ReadTimeoutSecs bounds waiting for each message from the remote peer.
+	ReadTimeoutSecs int `toml:"readTimeoutSecs" json:"-"`
+
+	// WriteTimeoutSecs bounds each write to the remote peer.
+	WriteTimeoutSecs int `toml:"writeTimeoutSecs" json:"-"`
+
+	// ReplyTimeoutSecs bounds waiting for replies to outstanding requests
+	// while the server flushes its request queue.
+	ReplyTimeoutSecs int `toml:"replyTimeoutSecs" json:"-"`
+
+	// RejectTimeoutSecs bounds sending a rejection to the remote peer.
+	RejectTimeoutSecs int `toml:"rejectTimeoutSecs" json:"-"`
+
+	// KeepAliveSecs is the TCP keepalive period. A negative value disables
+	// keepalives.
+	KeepAliveSecs int `toml:"keepAliveSecs" json:"-"`
+}
+
+var defaultTimeouts = Timeouts{
+	DialTimeoutSecs:   DefaultDialTimeoutSecs,
+	ReadTimeoutSecs:   DefaultReadTimeoutSecs,
+	WriteTimeoutSecs:  DefaultWriteTimeoutSecs,
+	ReplyTimeoutSecs:  DefaultReplyTimeoutSecs,
+	RejectTimeoutSecs: DefaultRejectTimeoutSecs,
+	KeepAliveSecs:     DefaultKeepAliveSecs,
+}
+
+func (t Timeouts) validate() error {
+	for _, v := range []struct {
+		name string
+		secs int
+	}{
+		{"dialTimeoutSecs", t.DialTimeoutSecs},
+		{"readTimeoutSecs", t.ReadTimeoutSecs},
+		{"writeTimeoutSecs", t.WriteTimeoutSecs},
+		{"replyTimeoutSecs", t.ReplyTimeoutSecs},
+		{"rejectTimeoutSecs", t.RejectTimeoutSecs},
+	} {
+		if v.secs < 0 {
+			return errgo.Newf("invalid %s %d", v.name, v.secs)
+		}
+	}
+	return nil
+}
+
+// sessionTimeouts are the timeouts resolved for a session with a remote
+// peer. A zero keepAlive disables keepalives.
+type sessionTimeouts struct {
+	dial, read, write, reply, reject, keepAlive time.Duration
+}
+
+func (st *sessionTimeouts) override(t Timeouts) {
+	for _, v := range []struct {
+		d    *time.Duration
+		secs int
+	}{
+		{&st.dial, t.DialTimeoutSecs},
+		{&st.read, t.ReadTimeoutSecs},
+		{&st.write, t.WriteTimeoutSecs},
+		{&st.reply, t.ReplyTimeoutSecs},
+		{&st.reject, t.RejectTimeoutSecs},
+		{&st.keepAlive, t.KeepAliveSecs},
+	} {
+		if v.secs != 0 {
+			*v.d = time.Duration(v.secs) * time.Second
+		}
+	}
+	if st.keepAlive < 0 {
+		st.keepAlive = 0
+	}
+}
+
+// sessionTimeouts returns the timeouts for a session with the remote peer at
+// addr, applying the overrides of a partner matched by its resolved address.
+func (s *Settings) sessionTimeouts(addr net.Addr, resolved partnerIPs) sessionTimeouts {
+	var st sessionTimeouts
+	st.override(defaultTimeouts)
+	st.override(s.Timeouts)
+	partner, ok := s.matchPartner(addr, resolved, func(partner Partner) bool {
+		return partner.Timeouts != Timeouts{}
+	})
+	if ok {
+		st.override(partner.Timeouts)
+	}
+	return st
+}
+
+// timeoutConn sets a write deadline before each write, unless a deadline has
+// been set explicitly.
+type timeoutConn struct {
+	net.Conn
+	writeTimeout time.Duration
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+// Write implements net.Conn.
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	explicit := !c.writeDeadline.IsZero()
+	c.mu.Unlock()
+	if !explicit && c.writeTimeout > 0 {
+		err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		if err != nil {
+			return 0, errgo.Mask(err)
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// SetDeadline implements net.Conn.
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *timeoutConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,151 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type TimeoutsSuite struct{}
+
+var _ = gc.Suite(&TimeoutsSuite{})
+
+func (s *TimeoutsSuite) TestSessionTimeouts(c *gc.C) {
+	settings := DefaultSettings()
+	addr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370}
+	c.Assert(settings.sessionTimeouts(addr, nil), gc.Equals, sessionTimeouts{
+		dial:      30 * time.Second,
+		read:      300 * time.Second,
+		write:     300 * time.Second,
+		reply:     3 * time.Second,
+		reject:    3 * time.Second,
+		keepAlive: 180 * time.Second,
+	})
+
+	settings.Timeouts = Timeouts{ReadTimeoutSecs: 60}
+	settings.Partners["slow"] = Partner{
+		ReconAddr: "10.1.2.3:11370",
+		Timeouts:  Timeouts{WriteTimeoutSecs: 900, KeepAliveSecs: -1},
+	}
+	matcher, err := settings.Matcher()
+	c.Assert(err, gc.IsNil)
+	resolved := matcherPartnerIPs(matcher)
+	st := settings.sessionTimeouts(addr, resolved)
+	c.Assert(st.dial, gc.Equals, 30*time.Second)
+	c.Assert(st.read, gc.Equals, 60*time.Second)
+	c.Assert(st.write, gc.Equals, 900*time.Second)
+	c.Assert(st.keepAlive, gc.Equals, time.Duration(0))
+
+	st = settings.sessionTimeouts(&net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 11370}, resolved)
+	c.Assert(st.write, gc.Equals, 300*time.Second)
+	c.Assert(st.keepAlive, gc.Equals, 180*time.Second)
+}
+
+func (s *TimeoutsSuite) TestSessionTimeoutsResolved(c *gc.C) {
+	addrs := map[string][]net.IP{"partner.example.com": {net.ParseIP("10.1.2.3")}}
+	var lookups int
+	defer func(f func(string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		lookups++
+		return addrs[host], nil
+	}
+
+	settings := DefaultSettings()
+	settings.Partners["slow"] = Partner{
+		HTTPNet:   NetworkUnix,
+		ReconAddr: "partner.example.com:11370",
+		Timeouts:  Timeouts{WriteTimeoutSecs: 900},
+	}
+	p := NewPeer(settings, nil)
+	_, err := p.getMatcher()
+	c.Assert(err, gc.IsNil)
+	c.Assert(lookups, gc.Equals, 1)
+
+	// Partners are matched by the addresses resolved for the matcher,
+	// without looking them up again.
+	addr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370}
+	c.Assert(settings.sessionTimeouts(addr, p.partnerIPs()).write, gc.Equals, 900*time.Second)
+	c.Assert(lookups, gc.Equals, 1)
+
+	addrs["partner.example.com"] = []net.IP{net.ParseIP("10.1.2.4")}
+	c.Assert(settings.sessionTimeouts(addr, p.partnerIPs()).write, gc.Equals, 900*time.Second)
+	c.Assert(p.refreshMatcher(), gc.IsNil)
+	c.Assert(settings.sessionTimeouts(addr, p.partnerIPs()).write, gc.Equals, 300*time.Second)
+	c.Assert(lookups, gc.Equals, 2)
+}
+
+func (s *TimeoutsSuite) TestValidate(c *gc.C) {
+	settings, err := ParseSettings(`
+[conflux.recon]
+readTimeoutSecs = 60
+keepAliveSecs = -1
+
+[conflux.recon.partner.slow]
+reconAddr = "10.1.2.3:11370"
+writeTimeoutSecs = 900
+`)
+	c.Assert(err, gc.IsNil)
+	c.Assert(settings.ReadTimeoutSecs, gc.Equals, 60)
+	c.Assert(settings.DialTimeoutSecs, gc.Equals, DefaultDialTimeoutSecs)
+	c.Assert(settings.KeepAliveSecs, gc.Equals, -1)
+	c.Assert(settings.Partners["slow"].WriteTimeoutSecs, gc.Equals, 900)
+
+	_, err = ParseSettings(`
+[conflux.recon]
+dialTimeoutSecs = -5
+`)
+	c.Assert(err, gc.ErrorMatches, `invalid dialTimeoutSecs -5`)
+
+	_, err = ParseSettings(`
+[conflux.recon.partner.slow]
+reconAddr = "10.1.2.3:11370"
+replyTimeoutSecs = -1
+`)
+	c.Assert(err, gc.ErrorMatches, `invalid timeouts for partner "slow": invalid replyTimeoutSecs -1`)
+}
+
+func (s *TimeoutsSuite) TestWriteTimeout(c *gc.C) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := &timeoutConn{Conn: client, writeTimeout: 50 * time.Millisecond}
+	defer conn.Close()
+
+	// Nothing reads from the pipe, so the write times out.
+	_, err := conn.Write([]byte("hello"))
+	c.Assert(err, gc.NotNil)
+	netErr, ok := err.(net.Error)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(netErr.Timeout(), gc.Equals, true)
+
+	// An explicit deadline takes precedence over the write timeout.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		server.Read(make([]byte, 5))
+	}()
+	err = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	c.Assert(err, gc.IsNil)
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, gc.IsNil)
+}
@@ -0,0 +1,295 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// TranscriptEntry is a line of a session transcript. The first entry
+// identifies the session, following entries record data sent or received,
+// and the last entry records how the session ended.
+type TranscriptEntry struct {
+	Time time.Time `json:"time"`
+
+	Role       string `json:"role,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+
+	Sent     []byte `json:"sent,omitempty"`
+	Received []byte `json:"received,omitempty"`
+
+	End   bool   `json:"end,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// transcriptWriter records a session transcript to a file.
+type transcriptWriter struct {
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+	err error
+}
+
+var transcriptUnsafe = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// createTranscript creates a new transcript file in dir for the session.
+func createTranscript(dir string, info *SessionInfo) (*transcriptWriter, error) {
+	var remoteAddr string
+	if info.RemoteAddr != nil {
+		remoteAddr = info.RemoteAddr.String()
+	}
+	name := fmt.Sprintf("%s-%s-%s.transcript", info.Start.UTC().Format("20060102T150405.000000000Z"),
+		info.Role, transcriptUnsafe.ReplaceAllString(remoteAddr, "_"))
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	w := bufio.NewWriter(f)
+	t := &transcriptWriter{f: f, w: w, enc: json.NewEncoder(w)}
+	t.write(&TranscriptEntry{Time: info.Start, Role: info.Role, RemoteAddr: remoteAddr})
+	return t, nil
+}
+
+func (t *transcriptWriter) write(entry *TranscriptEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil && t.f != nil {
+		t.err = t.enc.Encode(entry)
+	}
+}
+
+func (t *transcriptWriter) record(sent, received []byte) {
+	entry := &TranscriptEntry{Time: time.Now()}
+	if len(sent) > 0 {
+		entry.Sent = append([]byte(nil), sent...)
+	}
+	if len(received) > 0 {
+		entry.Received = append([]byte(nil), received...)
+	}
+	t.write(entry)
+}
+
+// close records the end of the session and closes the transcript file.
+func (t *transcriptWriter) close(err error) {
+	entry := &TranscriptEntry{Time: time.Now(), End: true}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	t.write(entry)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return
+	}
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+	if closeErr := t.f.Close(); t.err == nil {
+		t.err = closeErr
+	}
+	t.f = nil
+}
+
+// transcriptConn records the data sent and received on a connection.
+type transcriptConn struct {
+	net.Conn
+	t *transcriptWriter
+}
+
+// Read implements net.Conn.
+func (c *transcriptConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.t.record(nil, b[:n])
+	}
+	return n, err
+}
+
+// Write implements net.Conn.
+func (c *transcriptConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.t.record(b[:n], nil)
+	}
+	return n, err
+}
+
+// Transcript is a recorded recon session.
+type Transcript struct {
+	Role       string
+	RemoteAddr string
+	Start      time.Time
+
+	// Entries record the data sent and received, in order.
+	Entries []TranscriptEntry
+
+	// Ended is whether the end of the session was recorded, and Error how
+	// it ended.
+	Ended bool
+	Error string
+}
+
+// ReadTranscript reads a session transcript.
+func ReadTranscript(r io.Reader) (*Transcript, error) {
+	dec := json.NewDecoder(r)
+	var header TranscriptEntry
+	err := dec.Decode(&header)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read transcript header")
+	}
+	if header.Role != GOSSIP && header.Role != SERVE {
+		return nil, errgo.Newf("invalid transcript role %q", header.Role)
+	}
+	t := &Transcript{Role: header.Role, RemoteAddr: header.RemoteAddr, Start: header.Time}
+	for {
+		var entry TranscriptEntry
+		err = dec.Decode(&entry)
+		if err == io.EOF {
+			return t, nil
+		} else if err != nil {
+			return nil, errgo.Notef(err, "cannot read transcript entry %d", len(t.Entries)+1)
+		}
+		if entry.End {
+			t.Ended, t.Error = true, entry.Error
+			continue
+		}
+		t.Entries = append(t.Entries, entry)
+	}
+}
+
+// Sent returns all of the data sent by the local peer.
+func (t *Transcript) Sent() []byte {
+	var buf bytes.Buffer
+	for _, entry := range t.Entries {
+		buf.Write(entry.Sent)
+	}
+	return buf.Bytes()
+}
+
+// Received returns all of the data received from the remote peer.
+func (t *Transcript) Received() []byte {
+	var buf bytes.Buffer
+	for _, entry := range t.Entries {
+		buf.Write(entry.Received)
+	}
+	return buf.Bytes()
+}
+
+// TranscriptMsg is a message decoded from a transcript.
+type TranscriptMsg struct {
+	// Time is when the start of the message was sent or received.
+	Time time.Time
+
+	// Offset is the position of the message in the data sent or received.
+	Offset int
+
+	// Msg is the message, or nil for a config status or reason string,
+	// which is in Text.
+	Msg  ReconMsg
+	Text string
+}
+
+// String returns a description of the message.
+func (m *TranscriptMsg) String() string {
+	if m.Msg == nil {
+		return fmt.Sprintf("%q", m.Text)
+	}
+	return fmt.Sprintf("%v", m.Msg)
+}
+
+// Messages decodes the messages sent by the local peer, or received from the
+// remote peer. An error is returned with the messages decoded if the data
+// ends in the middle of a message.
+func (t *Transcript) Messages(sent bool) ([]TranscriptMsg, error) {
+	var data []byte
+	var times []time.Time
+	var ends []int
+	for _, entry := range t.Entries {
+		chunk := entry.Received
+		if sent {
+			chunk = entry.Sent
+		}
+		if len(chunk) == 0 {
+			continue
+		}
+		data = append(data, chunk...)
+		times = append(times, entry.Time)
+		ends = append(ends, len(data))
+	}
+	msgs, err := decodeStream(data)
+	i := 0
+	for j := range msgs {
+		for i < len(ends)-1 && msgs[j].Offset >= ends[i] {
+			i++
+		}
+		if i < len(times) {
+			msgs[j].Time = times[i]
+		}
+	}
+	return msgs, err
+}
+
+// decodeStream decodes the messages in the data sent by one side of a
+// session. The config message is followed by a status string, and a reason
+// string if the config was rejected.
+func decodeStream(data []byte) ([]TranscriptMsg, error) {
+	var msgs []TranscriptMsg
+	r := bytes.NewReader(data)
+	offset := func() int { return len(data) - r.Len() }
+	for r.Len() > 0 {
+		start := offset()
+		msg, err := ReadMsg(r)
+		if err != nil {
+			return msgs, errgo.Notef(err, "cannot decode message at offset %d", start)
+		}
+		msgs = append(msgs, TranscriptMsg{Offset: start, Msg: msg})
+		if _, ok := msg.(*Config); !ok {
+			continue
+		}
+		for expect := 1; expect > 0 && r.Len() > 0; expect-- {
+			start = offset()
+			text, err := ReadString(r)
+			if err != nil {
+				return msgs, errgo.Notef(err, "cannot decode config status at offset %d", start)
+			}
+			msgs = append(msgs, TranscriptMsg{Offset: start, Text: text})
+			if text == RemoteConfigFailed {
+				expect++
+			}
+		}
+	}
+	return msgs, nil
+}
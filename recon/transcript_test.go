@@ -0,0 +1,179 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	cf "gopkg.in/hockeypuck/conflux.v2"
+)
+
+type TranscriptSuite struct{}
+
+var _ = gc.Suite(&TranscriptSuite{})
+
+var (
+	transcriptCommon = []*cf.Zp{cf.Zi(cf.P_SKS, 65537), cf.Zi(cf.P_SKS, 65539)}
+	transcriptServer = cf.Zi(cf.P_SKS, 65541)
+	transcriptClient = cf.Zi(cf.P_SKS, 65543)
+)
+
+// recordSession runs a session with transcripts recorded on both sides,
+// returning the client and server transcripts. Both peers are configured with
+// configure, if not nil.
+func recordSession(c *gc.C, configure func(*Peer)) (clientT, serverT *Transcript) {
+	server := newTestPeer(c, append(transcriptCommon, transcriptServer)...)
+	defer server.Stop()
+	server.settings.TranscriptDir = c.MkDir()
+	client := newTestPeer(c, append(transcriptCommon, transcriptClient)...)
+	defer client.Stop()
+	client.settings.TranscriptDir = c.MkDir()
+	if configure != nil {
+		configure(server)
+		configure(client)
+	}
+
+	clientErr, serverErr := pipeSession(c, client, server)
+	c.Assert(clientErr, gc.IsNil)
+	c.Assert(serverErr, gc.IsNil)
+	<-client.RecoverChan
+	<-server.RecoverChan
+	return readOnlyTranscript(c, client.settings.TranscriptDir), readOnlyTranscript(c, server.settings.TranscriptDir)
+}
+
+func readOnlyTranscript(c *gc.C, dir string) *Transcript {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.transcript"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(matches, gc.HasLen, 1)
+	f, err := os.Open(matches[0])
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	t, err := ReadTranscript(f)
+	c.Assert(err, gc.IsNil)
+	return t
+}
+
+func (s *TranscriptSuite) TestRecord(c *gc.C) {
+	clientT, serverT := recordSession(c, nil)
+	c.Assert(clientT.Role, gc.Equals, GOSSIP)
+	c.Assert(clientT.RemoteAddr, gc.Equals, "10.1.2.3:11370")
+	c.Assert(clientT.Ended, gc.Equals, true)
+	c.Assert(clientT.Error, gc.Equals, "")
+	c.Assert(serverT.Role, gc.Equals, SERVE)
+	c.Assert(clientT.Sent(), gc.DeepEquals, serverT.Received())
+	c.Assert(clientT.Received(), gc.DeepEquals, serverT.Sent())
+
+	sent, err := clientT.Messages(true)
+	c.Assert(err, gc.IsNil)
+	c.Assert(len(sent) > 2, gc.Equals, true)
+	_, ok := sent[0].Msg.(*Config)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(sent[1].Msg, gc.IsNil)
+	c.Assert(sent[1].Text, gc.Equals, RemoteConfigPassed)
+	c.Assert(sent[0].Time.IsZero(), gc.Equals, false)
+
+	received, err := clientT.Messages(false)
+	c.Assert(err, gc.IsNil)
+	var done bool
+	for _, msg := range received {
+		_, done = msg.Msg.(*Done)
+		if done {
+			break
+		}
+	}
+	c.Assert(done, gc.Equals, true)
+}
+
+func (s *TranscriptSuite) TestReadInvalid(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "bad.transcript")
+	c.Assert(ioutil.WriteFile(path, []byte(`{"role":"juggler"}`), 0600), gc.IsNil)
+	f, err := os.Open(path)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	_, err = ReadTranscript(f)
+	c.Assert(err, gc.ErrorMatches, `invalid transcript role "juggler"`)
+}
+
+func replay(c *gc.C, t *Transcript, cs ContentStore, elements ...*cf.Zp) *ReplayResult {
+	p := newTestPeer(c, elements...)
+	defer p.Stop()
+	if cs != nil {
+		p.SetContentStore(cs)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := p.Replay(ctx, t)
+	c.Assert(err, gc.IsNil)
+	// Replayed sessions do not deliver recovered elements.
+	c.Assert(p.RecoverChan, gc.HasLen, 0)
+	return result
+}
+
+func (s *TranscriptSuite) TestReplay(c *gc.C) {
+	clientT, serverT := recordSession(c, nil)
+
+	// Replaying against the same elements reproduces the session.
+	result := replay(c, serverT, nil, append(transcriptCommon, transcriptServer)...)
+	c.Assert(result.Err, gc.IsNil)
+	c.Assert(result.Diverged, gc.Equals, false)
+	c.Assert(result.RemoteConfig, gc.NotNil)
+	result = replay(c, clientT, nil, append(transcriptCommon, transcriptClient)...)
+	c.Assert(result.Err, gc.IsNil)
+	c.Assert(result.Diverged, gc.Equals, false)
+
+	// Replaying against different elements diverges after the handshake.
+	result = replay(c, serverT, nil, transcriptCommon...)
+	c.Assert(result.Diverged, gc.Equals, true)
+	c.Assert(result.Index > 1, gc.Equals, true)
+	c.Assert(result.Offset > 0, gc.Equals, true)
+	c.Assert(result.Expected, gc.Not(gc.Equals), result.Actual)
+}
+
+func (s *TranscriptSuite) TestReplayLiveSettings(c *gc.C) {
+	cs := sizedContentStore{}
+	for _, z := range append(transcriptCommon, transcriptServer, transcriptClient) {
+		cs[z.String()] = 10
+	}
+	clientT, serverT := recordSession(c, func(p *Peer) {
+		p.settings.MembershipSecret = "sekrit"
+		p.SetContentStore(cs)
+	})
+
+	// The configs and membership recorded depended on settings, the clock
+	// and nonces of the recorded session, and are sent as recorded. Content
+	// is served from the replaying peer's content store.
+	result := replay(c, serverT, cs, append(transcriptCommon, transcriptServer)...)
+	c.Assert(result.Err, gc.IsNil)
+	c.Assert(result.Diverged, gc.Equals, false)
+	c.Assert(result.RemoteConfig.Custom[customMembershipNonce], gc.Not(gc.Equals), "")
+	c.Assert(result.RemoteConfig.Custom[customContentFetch], gc.Equals, "true")
+	result = replay(c, clientT, cs, append(transcriptCommon, transcriptClient)...)
+	c.Assert(result.Err, gc.IsNil)
+	c.Assert(result.Diverged, gc.Equals, false)
+}